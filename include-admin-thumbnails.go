@@ -9,6 +9,7 @@ import (
     "os"
     "os/exec"
     "path/filepath"
+    "strconv"
     "strings"
 )
 
@@ -32,8 +33,6 @@ func generateThumbnailAtTime(videoPath, uploadDir, filename, timestamp string) e
 }
 
 func getVideoFiles() ([]VideoFile, error) {
-	videoExts := []string{".mp4", ".webm", ".mov", ".avi", ".mkv", ".m4v"}
-
 	rows, err := db.Query(`SELECT id, filename, path FROM files ORDER BY id DESC`)
 	if err != nil {
 		return nil, err
@@ -48,17 +47,12 @@ func getVideoFiles() ([]VideoFile, error) {
 			continue
 		}
 
-		// Check if it's a video file
-		isVideo := false
-		ext := strings.ToLower(filepath.Ext(v.Filename))
-		for _, vidExt := range videoExts {
-			if ext == vidExt {
-				isVideo = true
-				break
-			}
-		}
+		// Check if it's a video, audio or image file
+		isVideo := isVideoFile(v.Filename)
+		v.IsAudio = isAudioFile(v.Filename)
+		v.IsImage = isImageFile(v.Filename)
 
-		if !isVideo {
+		if !isVideo && !v.IsAudio && !v.IsImage {
 			continue
 		}
 
@@ -135,7 +129,11 @@ func generateThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 		var errors []string
 
 		for _, v := range missing {
-			if err := generateThumbnail(v.Path, config.UploadDir, v.Filename); err != nil {
+			path := v.Path
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(config.UploadDir, path)
+			}
+			if err := generateThumbnail(path, config.UploadDir, v.Filename); err != nil {
 				log.Printf("Error: generateThumbnailHandler: failed to generate thumbnail for %s: %v", v.Filename, err)
 				errors = append(errors, fmt.Sprintf("%s: %v", v.Filename, err))
 			} else {
@@ -169,7 +167,15 @@ func generateThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 			path = filepath.Join(config.UploadDir, path)
 		}
 
-		if err = generateThumbnailAtTime(path, config.UploadDir, filename, timestamp); err != nil {
+		if isAudioFile(filename) {
+			// Cover art and waveforms have no timestamp to pick
+			err = generateAudioThumbnail(path, config.UploadDir, filename)
+		} else if isImageFile(filename) {
+			err = generateImageThumbnail(path, config.UploadDir, filename)
+		} else {
+			err = generateThumbnailAtTime(path, config.UploadDir, filename, timestamp)
+		}
+		if err != nil {
 			log.Printf("Error: generateThumbnailHandler: failed to generate thumbnail for file id=%s at %s: %v", fileID, timestamp, err)
 			http.Redirect(w, r, redirectBase+"?error="+url.QueryEscape("Failed to generate thumbnail: "+err.Error()), http.StatusSeeOther)
 			return
@@ -181,12 +187,43 @@ func generateThumbnailHandler(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, fmt.Sprintf("/file/%s?success=%s", fileID, url.QueryEscape(fmt.Sprintf("Thumbnail generated at %s", timestamp))), http.StatusSeeOther)
 		}
 
+	case "generate_sprites":
+		missing, err := getMissingSpriteVideos()
+		if err != nil {
+			log.Printf("Error: generateThumbnailHandler: failed to get missing sprites: %v", err)
+			http.Redirect(w, r, redirectBase+"?error="+url.QueryEscape("Failed to get videos: "+err.Error()), http.StatusSeeOther)
+			return
+		}
+		for _, v := range missing {
+			queueSpriteJob(int64(v.ID), v.Filename)
+		}
+		http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+
+	case "generate_sprite":
+		fileID, err := strconv.ParseInt(r.FormValue("file_id"), 10, 64)
+		var filename string
+		if err == nil {
+			err = db.QueryRow("SELECT filename FROM files WHERE id=?", fileID).Scan(&filename)
+		}
+		if err != nil || !isVideoFile(filename) {
+			http.Redirect(w, r, redirectBase+"?error="+url.QueryEscape("Video not found"), http.StatusSeeOther)
+			return
+		}
+		queueSpriteJob(fileID, filename)
+		http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+
 	default:
 		http.Redirect(w, r, redirectBase, http.StatusSeeOther)
 	}
 }
 
 func generateThumbnail(videoPath, uploadDir, filename string) error {
+	if isAudioFile(filename) {
+		return generateAudioThumbnail(videoPath, uploadDir, filename)
+	}
+	if isImageFile(filename) {
+		return generateImageThumbnail(videoPath, uploadDir, filename)
+	}
 	if err := generateThumbnailAtTime(videoPath, uploadDir, filename, "00:00:05"); err != nil {
 		log.Printf("Warning: generateThumbnail: seek to 5s failed for %s, retrying from start: %v", filename, err)
 		return generateThumbnailAtTime(videoPath, uploadDir, filename, "00:00:00")
@@ -16,6 +16,16 @@ func renderAdminPage(w http.ResponseWriter, r *http.Request, data AdminPageData)
 	if data.ActiveTab == "" {
 		data.ActiveTab = r.FormValue("active_tab")
 	}
+	// Finding videos without sprite sheets stats every video, so it is left
+	// out unless the page opens on the thumbnails tab
+	if data.ActiveTab == "thumbnails" {
+		missingSprites, err := getMissingSpriteVideos()
+		if err != nil {
+			log.Printf("Warning: renderAdminPage: failed to get missing sprites: %v", err)
+		}
+		data.MissingSprites = missingSprites
+		data.SpritesChecked = true
+	}
 	pageData := buildPageData("Admin", data)
 	renderTemplate(w, "admin.html", pageData)
 }
@@ -26,6 +36,8 @@ func currentAdminState(r *http.Request, orphanData OrphanData, missingThumbnails
 		OrphanData:        orphanData,
 		ActiveTab:         r.FormValue("active_tab"),
 		MissingThumbnails: missingThumbnails,
+		MetadataSources:   metadataSources,
+		ConflictPolicies:  conflictPolicies,
 	}
 }
 
@@ -36,6 +48,15 @@ func validateConfig(newConfig Config) error {
 	if newConfig.ItemsPerPage == "" {
 		return fmt.Errorf("items per page cannot be empty")
 	}
+	if mb, err := strconv.Atoi(newConfig.HLSCacheMB); err != nil || mb <= 0 {
+		return fmt.Errorf("HLS cache size must be a positive number of megabytes")
+	}
+	if n, err := strconv.Atoi(newConfig.TextVersions); err != nil || n < 0 {
+		return fmt.Errorf("text versions must be zero or a positive number")
+	}
+	if n, err := strconv.Atoi(newConfig.NotesVersions); err != nil || n < 0 {
+		return fmt.Errorf("notes versions must be zero (unlimited) or a positive number")
+	}
 	return nil
 }
 
@@ -86,6 +107,49 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 
 		case "compute_properties":
 			handleComputeProperties(w, r, orphanData, missingThumbnails)
+
+		case "rebuild_text_index":
+			enqueueJob("index", "Rebuild text index", func() (int64, string, error) {
+				n, err := rebuildTextIndex()
+				if err != nil {
+					return 0, "", err
+				}
+				return 0, fmt.Sprintf("Indexed the contents of %d files", n), nil
+			})
+			http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+
+		case "save_filename_rules":
+			handleSaveFilenameRules(w, r, orphanData, missingThumbnails)
+
+		case "preview_filename_rules":
+			handlePreviewFilenameRules(w, r, orphanData, missingThumbnails)
+
+		case "apply_filename_rules":
+			handleApplyFilenameRules(w, r, orphanData, missingThumbnails)
+
+		case "save_tag_rules":
+			handleSaveTagRules(w, r, orphanData, missingThumbnails)
+
+		case "test_tag_rules":
+			handleTestTagRules(w, r, orphanData, missingThumbnails)
+
+		case "apply_tag_rules":
+			handleApplyTagRules(w, r, orphanData, missingThumbnails)
+
+		case "save_metadata_mappings":
+			handleSaveMetadataMappings(w, r, orphanData, missingThumbnails)
+
+		case "test_metadata_mappings":
+			handleTestMetadataMappings(w, r, orphanData, missingThumbnails)
+
+		case "backfill_comicinfo":
+			handleBackfillComicInfo(w, r, orphanData, missingThumbnails)
+
+		case "save_transcode_profiles":
+			handleSaveTranscodeProfiles(w, r, orphanData, missingThumbnails)
+
+		case "test_transcode_profiles":
+			handleTestTranscodeProfiles(w, r, orphanData, missingThumbnails)
 		}
 
 	default:
@@ -157,6 +221,13 @@ func handleSaveSettings(w http.ResponseWriter, r *http.Request, orphanData Orpha
 	newConfig := config // preserve runtime fields
 	newConfig.GallerySize = strings.TrimSpace(r.FormValue("gallery_size"))
 	newConfig.ItemsPerPage = strings.TrimSpace(r.FormValue("items_per_page"))
+	newConfig.ConflictPolicy = resolveConflictPolicy(r.FormValue("conflict_policy"))
+	newConfig.AutoFinishStatus = r.FormValue("auto_finish_status") == "on"
+	newConfig.HLSCacheMB = strings.TrimSpace(r.FormValue("hls_cache_mb"))
+	newConfig.IndexSubtitles = r.FormValue("index_subtitles") == "on"
+	newConfig.IndexEPUB = r.FormValue("index_epub") == "on"
+	newConfig.TextVersions = strings.TrimSpace(r.FormValue("text_versions"))
+	newConfig.NotesVersions = strings.TrimSpace(r.FormValue("notes_versions"))
 
 	if err := validateConfig(newConfig); err != nil {
 		data := currentAdminState(r, orphanData, missingThumbnails)
@@ -242,6 +313,9 @@ func vacuumDatabase() error {
 	if _, err := db.Exec("VACUUM;"); err != nil {
 		return fmt.Errorf("VACUUM failed: %w", err)
 	}
+	if err := rebuildTextFTS(); err != nil {
+		return fmt.Errorf("failed to rebuild search index: %w", err)
+	}
 
 	log.Printf("Info: vacuumDatabase: VACUUM completed successfully")
 	return nil
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var audioExts = map[string]bool{
+	".mp3": true, ".flac": true, ".ogg": true, ".oga": true,
+	".opus": true, ".m4a": true, ".wav": true, ".aac": true,
+}
+
+// audioTagAliases maps the many spellings of ID3, Vorbis comment and MP4 tag
+// keys (as lowercased by probeMedia) onto one field name per concept
+var audioTagAliases = map[string]string{
+	"albumartist":  "album_artist",
+	"album artist": "album_artist",
+	"tracknumber":  "track",
+	"discnumber":   "disc",
+	"date":         "year",
+	"tdrc":         "year",
+	"tyer":         "year",
+	"originaldate": "year",
+}
+
+var yearPattern = regexp.MustCompile(`\d{4}`)
+
+func isAudioFile(filename string) bool {
+	return audioExts[strings.ToLower(filepath.Ext(filename))]
+}
+
+// audioFields turns embedded tags into metadata fields for the "audio" mapping
+// source. Every tag is available under its own name, and common aliases are
+// normalised: "3/12" tracks become "3", dates become a year and genres are
+// split on semicolons
+func audioFields(tags map[string]string) map[string][]string {
+	fields := make(map[string][]string)
+	for key, value := range tags {
+		if value = strings.TrimSpace(value); value != "" {
+			fields[key] = []string{value}
+		}
+	}
+
+	for key, value := range tags {
+		name, ok := audioTagAliases[key]
+		if !ok {
+			name = key
+		} else if _, canonical := tags[name]; canonical {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch name {
+		case "track", "disc":
+			value = strings.TrimLeft(strings.SplitN(value, "/", 2)[0], "0")
+		case "year":
+			value = yearPattern.FindString(value)
+		case "genre":
+			var genres []string
+			for _, g := range strings.Split(value, ";") {
+				if g = strings.TrimSpace(g); g != "" {
+					genres = append(genres, g)
+				}
+			}
+			fields[name] = genres
+			continue
+		default:
+			if !ok {
+				continue
+			}
+		}
+		if value != "" {
+			fields[name] = []string{value}
+		} else {
+			delete(fields, name)
+		}
+	}
+	return fields
+}
+
+// computeAudioProperties records duration, bitrate and sample rate and maps
+// embedded tags through the "audio" metadata mappings
+func computeAudioProperties(fileID int64, filePath string) {
+	probe, err := probeMedia(filePath)
+	if err != nil {
+		log.Printf("Warning: ffprobe failed for %s: %v", filePath, err)
+		return
+	}
+
+	if probe.Duration > 0 {
+		setProperty(fileID, "duration", durationBucket(probe.Duration))
+	}
+	if probe.BitRate > 0 {
+		setProperty(fileID, "bitrate", strconv.Itoa(probe.BitRate/1000))
+	}
+	if probe.SampleRate > 0 {
+		setProperty(fileID, "samplerate", strconv.Itoa(probe.SampleRate))
+	}
+
+	applyMetadata(fileID, mapMetadata("audio", audioFields(probe.Tags), config.MetadataMappings))
+}
+
+// generateAudioThumbnail extracts embedded cover art, or draws a waveform
+// when the file has none
+func generateAudioThumbnail(audioPath, uploadDir, filename string) error {
+	thumbDir := filepath.Join(uploadDir, "thumbnails")
+	if err := os.MkdirAll(thumbDir, 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnails directory: %v", err)
+	}
+	thumbPath := filepath.Join(thumbDir, filename+".jpg")
+
+	probe, err := probeMedia(audioPath)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-y", "-i", audioPath}
+	if probe.HasCover {
+		args = append(args, "-map", "0:v:0", "-frames:v", "1", "-vf", "scale=400:-1", thumbPath)
+	} else {
+		args = append(args, "-filter_complex", "showwavespic=s=400x150:colors=#add8e6", "-frames:v", "1", thumbPath)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to generate audio thumbnail: %v\nffmpeg output: %s", err, stderr.String())
+	}
+	return nil
+}
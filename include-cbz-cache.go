@@ -0,0 +1,344 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cbzOpenReaders caps how many CBZ archives are kept open at once
+const cbzOpenReaders = 8
+
+// cbzReader is an open archive in the reader LRU, together with its reading
+// order once that has been worked out. It is only closed once it has been
+// evicted and no request is still reading from it
+type cbzReader struct {
+	path    string
+	modTime time.Time
+	size    int64
+	zr      *zip.ReadCloser
+	files   map[string]*zip.File
+	pages   []CBZImage // nil until first needed
+	refs    int
+	evicted bool
+}
+
+var cbzCache = struct {
+	sync.Mutex
+	readers map[string]*list.Element
+	lru     *list.List // most recently used at the front
+}{
+	readers: make(map[string]*list.Element),
+	lru:     list.New(),
+}
+
+// cbzPageIndex returns the pages of a CBZ in reading order. The order is
+// cached with the open archive, so it is rebuilt when the file has changed
+// on disk or the archive has been evicted
+func cbzPageIndex(cbzPath string) ([]CBZImage, os.FileInfo, error) {
+	info, err := os.Stat(cbzPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rd, err := acquireCBZReader(cbzPath, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer releaseCBZReader(rd)
+
+	cbzCache.Lock()
+	pages := rd.pages
+	cbzCache.Unlock()
+	if pages != nil {
+		return pages, info, nil
+	}
+
+	pages = []CBZImage{}
+	for i, page := range cbzPages(&rd.zr.Reader) {
+		pages = append(pages, CBZImage{Filename: page.file.Name, Index: i, Type: page.kind})
+	}
+
+	cbzCache.Lock()
+	rd.pages = pages
+	cbzCache.Unlock()
+	return pages, info, nil
+}
+
+// acquireCBZReader returns an open reader for the archive, reusing a cached
+// one unless the file changed. The archive is opened without holding the
+// cache lock. Callers must release it with releaseCBZReader
+func acquireCBZReader(cbzPath string, info os.FileInfo) (*cbzReader, error) {
+	if rd := lookupCBZReader(cbzPath, info); rd != nil {
+		return rd, nil
+	}
+
+	zr, err := zip.OpenReader(cbzPath)
+	if err != nil {
+		return nil, err
+	}
+	rd := &cbzReader{
+		path:    cbzPath,
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		zr:      zr,
+		files:   make(map[string]*zip.File, len(zr.File)),
+		refs:    1,
+	}
+	for _, f := range zr.File {
+		rd.files[f.Name] = f
+	}
+
+	cbzCache.Lock()
+	defer cbzCache.Unlock()
+	if el, ok := cbzCache.readers[cbzPath]; ok {
+		cached := el.Value.(*cbzReader)
+		if cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+			// Another request opened the same archive meanwhile
+			zr.Close()
+			cbzCache.lru.MoveToFront(el)
+			cached.refs++
+			return cached, nil
+		}
+		evictCBZReaderLocked(el)
+	}
+	cbzCache.readers[cbzPath] = cbzCache.lru.PushFront(rd)
+
+	for cbzCache.lru.Len() > cbzOpenReaders {
+		evictCBZReaderLocked(cbzCache.lru.Back())
+	}
+	return rd, nil
+}
+
+func lookupCBZReader(cbzPath string, info os.FileInfo) *cbzReader {
+	cbzCache.Lock()
+	defer cbzCache.Unlock()
+	el, ok := cbzCache.readers[cbzPath]
+	if !ok {
+		return nil
+	}
+	rd := el.Value.(*cbzReader)
+	if !rd.modTime.Equal(info.ModTime()) || rd.size != info.Size() {
+		evictCBZReaderLocked(el)
+		return nil
+	}
+	cbzCache.lru.MoveToFront(el)
+	rd.refs++
+	return rd
+}
+
+func releaseCBZReader(rd *cbzReader) {
+	cbzCache.Lock()
+	defer cbzCache.Unlock()
+	rd.refs--
+	if rd.evicted && rd.refs == 0 {
+		rd.zr.Close()
+	}
+}
+
+func evictCBZReaderLocked(el *list.Element) {
+	rd := el.Value.(*cbzReader)
+	cbzCache.lru.Remove(el)
+	delete(cbzCache.readers, rd.path)
+	rd.evicted = true
+	if rd.refs == 0 {
+		rd.zr.Close()
+	}
+}
+
+// snapVariantSize snaps a requested width or height to a multiple of 100
+// between 100 and 4000 so the disk caches hold a bounded number of variants
+func snapVariantSize(raw string) int {
+	width, err := strconv.Atoi(raw)
+	if err != nil || width <= 0 {
+		return 0
+	}
+	width = (width + 99) / 100 * 100
+	if width < 100 {
+		width = 100
+	}
+	if width > 4000 {
+		width = 4000
+	}
+	return width
+}
+
+// cbzVariantFormat picks WebP for clients that accept it and JPEG otherwise.
+// ?format= overrides the Accept header
+func cbzVariantFormat(r *http.Request) string {
+	switch r.URL.Query().Get("format") {
+	case "jpeg", "jpg":
+		return "jpg"
+	case "webp":
+		return "webp"
+	}
+	if strings.Contains(r.Header.Get("Accept"), "image/webp") {
+		return "webp"
+	}
+	return "jpg"
+}
+
+// cbzVariantPath returns where a resized page is cached. The file's mtime is
+// part of the name so replaced archives never serve stale pages
+func cbzVariantPath(fileID int, info os.FileInfo, index, width int, format string) string {
+	name := fmt.Sprintf("%d-%x-%d-w%d.%s", fileID, info.ModTime().UnixNano(), index, width, format)
+	return filepath.Join(config.UploadDir, "cache", "cbz", name)
+}
+
+// buildCBZVariant scales one page with ffmpeg and stores it in the variant
+// cache, removing variants left over from older versions of the file
+func buildCBZVariant(f *zip.File, variantPath string, fileID int, info os.FileInfo, width int, format string) error {
+	dir := filepath.Dir(variantPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmpPath := strings.TrimSuffix(variantPath, filepath.Ext(variantPath)) + ".tmp." + format
+	args := []string{"-y", "-loglevel", "error", "-f", "image2pipe", "-i", "pipe:0",
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", width), "-frames:v", "1"}
+	if format == "webp" {
+		args = append(args, "-c:v", "libwebp", "-quality", "80")
+	} else {
+		args = append(args, "-q:v", "3")
+	}
+	args = append(args, tmpPath)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg", args...)
+	cmd.Stdin = rc
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("ffmpeg failed: %v\nffmpeg output: %s", err, stderr.String())
+	}
+	if err := os.Rename(tmpPath, variantPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	removeStaleVariants(dir, fileID, info)
+	return nil
+}
+
+// removeStaleVariants deletes a file's cached variants in dir that were built
+// from an older version of the file
+func removeStaleVariants(dir string, fileID int, info os.FileInfo) {
+	current := fmt.Sprintf("%d-%x-", fileID, info.ModTime().UnixNano())
+	stale, _ := filepath.Glob(filepath.Join(dir, fmt.Sprintf("%d-*", fileID)))
+	for _, p := range stale {
+		if !strings.HasPrefix(filepath.Base(p), current) {
+			os.Remove(p)
+		}
+	}
+}
+
+// serveCBZImage serves a page of a CBZ file. With ?w= a downscaled JPEG or
+// WebP variant is served from the on-disk cache, building it on first use
+func serveCBZImage(w http.ResponseWriter, r *http.Request, fileID int, cbzPath string, imageIndex int) error {
+	pages, info, err := cbzPageIndex(cbzPath)
+	if err != nil {
+		return err
+	}
+	if imageIndex < 0 || imageIndex >= len(pages) {
+		return fmt.Errorf("image index out of range")
+	}
+
+	width := snapVariantSize(r.URL.Query().Get("w"))
+	format := ""
+	if width > 0 {
+		format = cbzVariantFormat(r)
+		w.Header().Set("Vary", "Accept")
+	}
+
+	etag := fmt.Sprintf(`"%x-%x-%d-%d%s"`, info.ModTime().UnixNano(), info.Size(), imageIndex, width, format)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	if width > 0 {
+		variantPath := cbzVariantPath(fileID, info, imageIndex, width, format)
+		if _, err := os.Stat(variantPath); err != nil {
+			rd, err := acquireCBZReader(cbzPath, info)
+			if err != nil {
+				return err
+			}
+			err = buildCBZVariant(rd.files[pages[imageIndex].Filename], variantPath, fileID, info, width, format)
+			releaseCBZReader(rd)
+			if err != nil {
+				// Fall back to the full-size page rather than failing the request
+				log.Printf("Warning: serveCBZImage: failed to build %dpx variant of page %d in %s: %v", width, imageIndex, cbzPath, err)
+				w.Header().Set("ETag", fmt.Sprintf(`"%x-%x-%d-0"`, info.ModTime().UnixNano(), info.Size(), imageIndex))
+				return serveCBZPage(w, cbzPath, info, pages[imageIndex].Filename)
+			}
+		}
+
+		out, err := os.Open(variantPath)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		if format == "webp" {
+			w.Header().Set("Content-Type", "image/webp")
+		} else {
+			w.Header().Set("Content-Type", "image/jpeg")
+		}
+		_, err = io.Copy(w, out)
+		return err
+	}
+
+	return serveCBZPage(w, cbzPath, info, pages[imageIndex].Filename)
+}
+
+// serveCBZPage streams a page unchanged from the archive
+func serveCBZPage(w http.ResponseWriter, cbzPath string, info os.FileInfo, name string) error {
+	rd, err := acquireCBZReader(cbzPath, info)
+	if err != nil {
+		return err
+	}
+	defer releaseCBZReader(rd)
+
+	targetFile, ok := rd.files[name]
+	if !ok {
+		return fmt.Errorf("page %s missing from archive", name)
+	}
+
+	// Set content type based on extension
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg":
+		w.Header().Set("Content-Type", "image/jpeg")
+	case ".png":
+		w.Header().Set("Content-Type", "image/png")
+	case ".webp":
+		w.Header().Set("Content-Type", "image/webp")
+	}
+	w.Header().Set("Content-Length", strconv.FormatUint(targetFile.UncompressedSize64, 10))
+
+	rc, err := targetFile.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.Copy(w, rc)
+	return err
+}
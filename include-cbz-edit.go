@@ -0,0 +1,436 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	comicInfoPagesPattern     = regexp.MustCompile(`(?s)\s*<Pages\s*/>|\s*<Pages>.*?</Pages>`)
+	comicInfoPageCountPattern = regexp.MustCompile(`<PageCount>\s*\d*\s*</PageCount>`)
+)
+
+// cbzBuildSource is an image file selected for a new CBZ
+type cbzBuildSource struct {
+	ID       int
+	Filename string
+	Path     string
+}
+
+func isImageFilename(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		return true
+	}
+	return false
+}
+
+// writeCBZAtomically writes an archive through fill into a temporary file next
+// to target and renames it into place, so readers never see a partial archive
+func writeCBZAtomically(target string, fill func(zw *zip.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".cbz-write-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmp.Name()
+	fail := func(err error) error {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	zw := zip.NewWriter(tmp)
+	if err := fill(zw); err != nil {
+		return fail(err)
+	}
+	if err := zw.Close(); err != nil {
+		return fail(fmt.Errorf("failed to finish archive: %v", err))
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, target); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to move archive into place: %v", err)
+	}
+	return nil
+}
+
+// cbzPageName numbers pages so that name order is reading order
+func cbzPageName(index int, original string) string {
+	return fmt.Sprintf("%04d%s", index+1, strings.ToLower(filepath.Ext(original)))
+}
+
+// buildCBZFromImages packs image files into a new archive at target, one page
+// per image in the given order. Images are stored uncompressed
+func buildCBZFromImages(target string, sources []cbzBuildSource) error {
+	return writeCBZAtomically(target, func(zw *zip.Writer) error {
+		for i, src := range sources {
+			in, err := os.Open(filepath.Join(config.UploadDir, src.Path))
+			if err != nil {
+				return fmt.Errorf("failed to open %s: %v", src.Filename, err)
+			}
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: cbzPageName(i, src.Filename), Method: zip.Store, Modified: time.Now()})
+			if err == nil {
+				_, err = io.Copy(w, in)
+			}
+			in.Close()
+			if err != nil {
+				return fmt.Errorf("failed to add %s: %v", src.Filename, err)
+			}
+		}
+		return nil
+	})
+}
+
+// rewriteComicInfo replaces the page list of a ComicInfo.xml so it matches
+// renumbered pages, keeping every other element untouched
+func rewriteComicInfo(data []byte, kinds []string) []byte {
+	var b strings.Builder
+	b.WriteString("\n  <Pages>")
+	for i, kind := range kinds {
+		if kind != "" {
+			fmt.Fprintf(&b, "\n    <Page Image=\"%d\" Type=\"%s\" />", i, html.EscapeString(kind))
+		} else {
+			fmt.Fprintf(&b, "\n    <Page Image=\"%d\" />", i)
+		}
+	}
+	b.WriteString("\n  </Pages>")
+
+	out := comicInfoPagesPattern.ReplaceAll(data, nil)
+	out = comicInfoPageCountPattern.ReplaceAll(out, []byte(fmt.Sprintf("<PageCount>%d</PageCount>", len(kinds))))
+	if end := strings.LastIndex(string(out), "</ComicInfo>"); end >= 0 {
+		out = []byte(string(out[:end]) + b.String() + "\n" + string(out[end:]))
+	}
+	return out
+}
+
+// rewriteCBZPages rewrites an archive with its pages in a new order. order
+// holds indexes into the current reading order; pages left out are removed.
+// When cover is a valid index that page is moved to the front and marked as
+// the front cover. Other entries such as ComicInfo.xml are kept
+func rewriteCBZPages(cbzPath string, order []int, cover int) error {
+	zr, err := zip.OpenReader(cbzPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	pages := cbzPages(&zr.Reader)
+	var kept []cbzPage
+	for _, i := range order {
+		if i < 0 || i >= len(pages) {
+			return fmt.Errorf("page %d does not exist", i+1)
+		}
+		page := pages[i]
+		if strings.EqualFold(page.kind, "FrontCover") && cover >= 0 {
+			page.kind = ""
+		}
+		if i == cover {
+			page.kind = "FrontCover"
+			kept = append([]cbzPage{page}, kept...)
+		} else {
+			kept = append(kept, page)
+		}
+	}
+	if len(kept) == 0 {
+		return fmt.Errorf("an archive needs at least one page")
+	}
+
+	isPage := make(map[*zip.File]bool)
+	for _, f := range zr.File {
+		if isCBZImage(f) {
+			isPage[f] = true
+		}
+	}
+	infoFile := findComicInfo(&zr.Reader)
+
+	return writeCBZAtomically(cbzPath, func(zw *zip.Writer) error {
+		kinds := make([]string, len(kept))
+		for i, page := range kept {
+			header := page.file.FileHeader
+			header.Name = cbzPageName(i, page.file.Name)
+			w, err := zw.CreateRaw(&header)
+			if err != nil {
+				return err
+			}
+			raw, err := page.file.OpenRaw()
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, raw); err != nil {
+				return err
+			}
+			kinds[i] = page.kind
+		}
+
+		for _, f := range zr.File {
+			if isPage[f] || f.FileInfo().IsDir() {
+				continue
+			}
+			if f == infoFile {
+				rc, err := f.Open()
+				if err != nil {
+					return err
+				}
+				data, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					return err
+				}
+				w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: f.Modified})
+				if err != nil {
+					return err
+				}
+				if _, err := w.Write(rewriteComicInfo(data, kinds)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := zw.Copy(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeSourceTags copies the tags of the source images onto a new archive
+func mergeSourceTags(targetID int64, sources []cbzBuildSource) {
+	for _, src := range sources {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO file_tags (file_id, tag_id) SELECT ?, tag_id FROM file_tags WHERE file_id = ?`, targetID, src.ID); err != nil {
+			log.Printf("Warning: mergeSourceTags: failed to copy tags from file id=%d to file id=%d: %v", src.ID, targetID, err)
+		}
+	}
+}
+
+// orderBuildSources orders selected files by the requested mode: as listed
+// in the selection, by file ID or by filename
+func orderBuildSources(ids []int, files []File, mode string) []cbzBuildSource {
+	byID := make(map[int]File, len(files))
+	for _, f := range files {
+		byID[f.ID] = f
+	}
+
+	var sources []cbzBuildSource
+	seen := make(map[int]bool)
+	for _, id := range ids {
+		f, ok := byID[id]
+		if !ok || seen[id] {
+			continue
+		}
+		seen[id] = true
+		sources = append(sources, cbzBuildSource{ID: f.ID, Filename: f.Filename, Path: f.Path})
+	}
+
+	switch mode {
+	case "id":
+		sort.SliceStable(sources, func(i, j int) bool { return sources[i].ID < sources[j].ID })
+	case "filename":
+		sort.SliceStable(sources, func(i, j int) bool {
+			return strings.ToLower(sources[i].Filename) < strings.ToLower(sources[j].Filename)
+		})
+	}
+	return sources
+}
+
+// cbzBuilderHandler creates a new CBZ from image files selected by ID range
+// or tag query
+func cbzBuilderHandler(w http.ResponseWriter, r *http.Request) {
+	data := CBZBuilderData{SelectionMode: "range", Order: "listed", MergeTags: true}
+	if r.Method != http.MethodPost {
+		renderTemplate(w, "cbz-builder.html", buildPageData("Build CBZ", data))
+		return
+	}
+
+	data.SelectionMode = r.FormValue("selection_mode")
+	data.FileRange = strings.TrimSpace(r.FormValue("file_range"))
+	data.TagQuery = strings.TrimSpace(r.FormValue("tag_query"))
+	data.Order = r.FormValue("order")
+	data.Filename = strings.TrimSpace(r.FormValue("filename"))
+	data.MergeTags = r.FormValue("merge_tags") == "on"
+
+	fail := func(msg string) {
+		data.Error = msg
+		renderTemplate(w, "cbz-builder.html", buildPageData("Build CBZ", data))
+	}
+
+	if data.Filename == "" {
+		fail("A filename is required")
+		return
+	}
+	filename := sanitizeFilename(data.Filename)
+	if !strings.HasSuffix(strings.ToLower(filename), ".cbz") {
+		filename += ".cbz"
+	}
+
+	var ids []int
+	var err error
+	if data.SelectionMode == "tags" {
+		ids, err = getFileIDsFromTagQuery(data.TagQuery)
+	} else {
+		ids, err = parseFileIDRange(data.FileRange)
+	}
+	if err != nil {
+		fail("Invalid selection: " + err.Error())
+		return
+	}
+	files, err := validateFileIDs(ids)
+	if err != nil {
+		fail("Invalid selection: " + err.Error())
+		return
+	}
+
+	var sources []cbzBuildSource
+	skipped := 0
+	for _, src := range orderBuildSources(ids, files, data.Order) {
+		if isImageFilename(src.Filename) {
+			sources = append(sources, src)
+		} else {
+			skipped++
+		}
+	}
+	if len(sources) == 0 {
+		fail("None of the selected files are JPEG, PNG or WebP images")
+		return
+	}
+
+	policy := resolveConflictPolicy(r.FormValue("conflict_policy"))
+	if taken, _ := filenameTaken(filename); taken && policy == "skip" {
+		fail(filename + " already exists; choose another name or conflict policy")
+		return
+	}
+
+	tmp, err := os.CreateTemp(config.UploadDir, ".cbz-build-*.cbz")
+	if err != nil {
+		fail("Failed to create temp file: " + err.Error())
+		return
+	}
+	tmp.Close()
+	tempPath := tmp.Name()
+
+	if err := buildCBZFromImages(tempPath, sources); err != nil {
+		os.Remove(tempPath)
+		log.Printf("Error: cbzBuilderHandler: failed to build %s: %v", filename, err)
+		fail("Failed to build archive: " + err.Error())
+		return
+	}
+
+	id, warningMsg, err := ingestFile(tempPath, filename, policy)
+	if errors.Is(err, errIngestSkipped) {
+		http.Redirect(w, r, fmt.Sprintf("/file/%d?warning=%s", id, url.QueryEscape(warningMsg)), http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		log.Printf("Error: cbzBuilderHandler: failed to store %s: %v", filename, err)
+		fail("Failed to store archive: " + err.Error())
+		return
+	}
+	if data.MergeTags {
+		mergeSourceTags(id, sources)
+		applyTagRules(id)
+	}
+
+	msg := fmt.Sprintf("Built CBZ with %d pages", len(sources))
+	if skipped > 0 {
+		msg += fmt.Sprintf(" (skipped %d files that are not images)", skipped)
+	}
+	redirect := fmt.Sprintf("/file/%d?success=%s", id, url.QueryEscape(msg))
+	if warningMsg != "" {
+		redirect += "&warning=" + url.QueryEscape(warningMsg)
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// cbzEditHandler reorders, removes pages of and sets the cover of an existing CBZ
+func cbzEditHandler(w http.ResponseWriter, r *http.Request, f File) {
+	cbzPath := filepath.Join(config.UploadDir, f.Path)
+	editURL := fmt.Sprintf("/cbz/%d/edit", f.ID)
+
+	if r.Method == http.MethodPost {
+		images, err := getCBZImages(cbzPath)
+		if err != nil {
+			renderError(w, "Failed to read CBZ contents", http.StatusInternalServerError)
+			return
+		}
+
+		type placed struct {
+			index    int
+			position float64
+		}
+		var kept []placed
+		for i := range images {
+			if r.FormValue(fmt.Sprintf("remove_%d", i)) == "on" {
+				continue
+			}
+			pos, err := strconv.ParseFloat(r.FormValue(fmt.Sprintf("position_%d", i)), 64)
+			if err != nil {
+				pos = float64(i + 1)
+			}
+			kept = append(kept, placed{i, pos})
+		}
+		sort.SliceStable(kept, func(a, b int) bool { return kept[a].position < kept[b].position })
+
+		order := make([]int, len(kept))
+		for i, p := range kept {
+			order[i] = p.index
+		}
+		cover := -1
+		if c, err := strconv.Atoi(r.FormValue("cover")); err == nil {
+			cover = c
+		}
+		if cover >= 0 && r.FormValue(fmt.Sprintf("remove_%d", cover)) == "on" {
+			cover = -1
+		}
+
+		if err := rewriteCBZPages(cbzPath, order, cover); err != nil {
+			log.Printf("Error: cbzEditHandler: failed to rewrite %s: %v", cbzPath, err)
+			http.Redirect(w, r, editURL+"?error="+url.QueryEscape("Failed to save pages: "+err.Error()), http.StatusSeeOther)
+			return
+		}
+		if err := generateCBZThumbnail(cbzPath, config.UploadDir, filepath.Base(cbzPath)); err != nil {
+			log.Printf("Warning: cbzEditHandler: could not regenerate thumbnail for %s: %v", cbzPath, err)
+		}
+		refreshProperties(int64(f.ID), cbzPath)
+
+		msg := fmt.Sprintf("Saved %d pages (%d removed)", len(order), len(images)-len(order))
+		http.Redirect(w, r, editURL+"?success="+url.QueryEscape(msg), http.StatusSeeOther)
+		return
+	}
+
+	images, err := getCBZImages(cbzPath)
+	if err != nil {
+		log.Printf("Error: cbzEditHandler: failed to read CBZ contents at %s: %v", cbzPath, err)
+		renderError(w, "Failed to read CBZ contents", http.StatusInternalServerError)
+		return
+	}
+
+	pageData := buildPageData("Edit "+f.Filename, CBZEditorData{
+		File:    f,
+		Images:  images,
+		Error:   r.URL.Query().Get("error"),
+		Success: r.URL.Query().Get("success"),
+	})
+	renderTemplate(w, "cbz-editor.html", pageData)
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"image"
 	"image/jpeg"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -32,26 +31,16 @@ func generateCBZThumbnail(cbzPath, uploadDir, filename string) error {
 	}
 	defer r.Close()
 
-	// Get list of image files from the archive
+	// Get image files from the archive in reading order
 	var imageFiles []*zip.File
-	for _, f := range r.File {
-		if !f.FileInfo().IsDir() {
-			ext := strings.ToLower(filepath.Ext(f.Name))
-			if ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".webp" {
-				imageFiles = append(imageFiles, f)
-			}
-		}
+	for _, page := range cbzPages(&r.Reader) {
+		imageFiles = append(imageFiles, page.file)
 	}
 
 	if len(imageFiles) == 0 {
 		return fmt.Errorf("no images found in CBZ")
 	}
 
-	// Sort files by name to get consistent ordering
-	sort.Slice(imageFiles, func(i, j int) bool {
-		return imageFiles[i].Name < imageFiles[j].Name
-	})
-
 	// Select up to 4 images evenly distributed
 	var selectedFiles []*zip.File
 	if len(imageFiles) <= 4 {
@@ -185,88 +174,53 @@ func drawImage(dst *image.RGBA, src image.Image, x, y int) {
 	}
 }
 
-// getCBZImages returns a list of images in a CBZ file
-func getCBZImages(cbzPath string) ([]CBZImage, error) {
-	r, err := zip.OpenReader(cbzPath)
-	if err != nil {
-		return nil, err
-	}
-	defer r.Close()
-
-	var images []CBZImage
-	for i, f := range r.File {
-		if !f.FileInfo().IsDir() {
-			ext := strings.ToLower(filepath.Ext(f.Name))
-			if ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".webp" {
-				images = append(images, CBZImage{
-					Filename: f.Name,
-					Index:    i,
-				})
-			}
-		}
-	}
-
-	// Sort by filename for consistent ordering
-	sort.Slice(images, func(i, j int) bool {
-		return images[i].Filename < images[j].Filename
-	})
-
-	// Re-index after sorting
-	for i := range images {
-		images[i].Index = i
-	}
-
-	return images, nil
+// cbzPage is one image of a CBZ archive together with its ComicInfo page type
+type cbzPage struct {
+	file *zip.File
+	kind string
 }
 
-// serveCBZImage extracts and serves a specific image from a CBZ file
-func serveCBZImage(w http.ResponseWriter, cbzPath string, imageIndex int) error {
-	r, err := zip.OpenReader(cbzPath)
-	if err != nil {
-		return err
+func isCBZImage(f *zip.File) bool {
+	if f.FileInfo().IsDir() {
+		return false
 	}
-	defer r.Close()
+	ext := strings.ToLower(filepath.Ext(f.Name))
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".webp"
+}
 
-	// Get sorted list of images
+// cbzImageFiles returns the images of a CBZ archive sorted by name
+func cbzImageFiles(zr *zip.Reader) []*zip.File {
 	var imageFiles []*zip.File
-	for _, f := range r.File {
-		if !f.FileInfo().IsDir() {
-			ext := strings.ToLower(filepath.Ext(f.Name))
-			if ext == ".jpg" || ext == ".jpeg" || ext == ".png" || ext == ".webp" {
-				imageFiles = append(imageFiles, f)
-			}
+	for _, f := range zr.File {
+		if isCBZImage(f) {
+			imageFiles = append(imageFiles, f)
 		}
 	}
 
+	// Sort files by name to get consistent ordering
 	sort.Slice(imageFiles, func(i, j int) bool {
 		return imageFiles[i].Name < imageFiles[j].Name
 	})
+	return imageFiles
+}
 
-	if imageIndex < 0 || imageIndex >= len(imageFiles) {
-		return fmt.Errorf("image index out of range")
-	}
-
-	targetFile := imageFiles[imageIndex]
-
-	// Set content type based on extension
-	ext := strings.ToLower(filepath.Ext(targetFile.Name))
-	switch ext {
-	case ".jpg", ".jpeg":
-		w.Header().Set("Content-Type", "image/jpeg")
-	case ".png":
-		w.Header().Set("Content-Type", "image/png")
-	case ".webp":
-		w.Header().Set("Content-Type", "image/webp")
-	}
-
-	rc, err := targetFile.Open()
-	if err != nil {
-		return err
+// cbzPages returns the images of a CBZ archive in reading order: sorted by
+// name, then reordered by the ComicInfo.xml page list if the archive has one
+func cbzPages(zr *zip.Reader) []cbzPage {
+	var info *ComicInfo
+	if f := findComicInfo(zr); f != nil {
+		var err error
+		if info, err = readComicInfo(f); err != nil {
+			log.Printf("Warning: cbzPages: ignoring invalid ComicInfo.xml: %v", err)
+		}
 	}
-	defer rc.Close()
+	return orderComicPages(cbzImageFiles(zr), info)
+}
 
-	_, err = io.Copy(w, rc)
-	return err
+// getCBZImages returns a list of images in a CBZ file
+func getCBZImages(cbzPath string) ([]CBZImage, error) {
+	images, _, err := cbzPageIndex(cbzPath)
+	return images, err
 }
 
 // cbzViewerHandler handles the CBZ gallery viewer
@@ -297,13 +251,18 @@ func cbzViewerHandler(w http.ResponseWriter, r *http.Request) {
 		imageIndex := 0
 		fmt.Sscanf(parts[2], "%d", &imageIndex)
 
-		if err := serveCBZImage(w, cbzPath, imageIndex); err != nil {
+		if err := serveCBZImage(w, r, f.ID, cbzPath, imageIndex); err != nil {
 			log.Printf("Error: cbzViewerHandler: failed to serve image index %d from %s: %v", imageIndex, cbzPath, err)
 			renderError(w, "Failed to serve image", http.StatusInternalServerError)
 		}
 		return
 	}
 
+	if len(parts) >= 2 && parts[1] == "edit" {
+		cbzEditHandler(w, r, f)
+		return
+	}
+
 	// Get list of images
 	images, err := getCBZImages(cbzPath)
 	if err != nil {
@@ -312,10 +271,14 @@ func cbzViewerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Determine which image to display
+	// Determine which image to display. Without a page in the URL, resume
+	// from the stored position unless the book was read to the end
 	currentIndex := 0
-	if len(parts) >= 2 {
+	explicitPage := len(parts) >= 2 && parts[1] != ""
+	if explicitPage {
 		fmt.Sscanf(parts[1], "%d", &currentIndex)
+	} else if pos := getFilePosition(f.ID); pos != nil && pos.Kind == "page" && !positionReachedEnd(pos.Kind, pos.Position, float64(len(images))) {
+		currentIndex = int(pos.Position)
 	}
 
 	if currentIndex < 0 {
@@ -325,6 +288,12 @@ func cbzViewerHandler(w http.ResponseWriter, r *http.Request) {
 		currentIndex = len(images) - 1
 	}
 
+	if explicitPage {
+		if err := saveFilePosition(f.ID, "page", float64(currentIndex), float64(len(images))); err != nil {
+			log.Printf("Warning: cbzViewerHandler: failed to save position for file id=%d: %v", f.ID, err)
+		}
+	}
+
 	// Prepare data for template
 	type CBZViewData struct {
 		File         File
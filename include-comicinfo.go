@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// comicInfoListFields hold comma separated lists in ComicInfo.xml
+var comicInfoListFields = map[string]bool{
+	"writer": true, "penciller": true, "inker": true, "colorist": true,
+	"letterer": true, "cover_artist": true, "editor": true, "translator": true,
+	"genre": true, "tags": true, "characters": true, "teams": true,
+	"locations": true, "story_arc": true,
+}
+
+// snakeCase turns ComicInfo element names such as CoverArtist or LanguageISO
+// into cover_artist and language_iso
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prevLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || (nextLower && unicode.IsUpper(runes[i-1])) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// findComicInfo returns the archive's ComicInfo.xml, preferring the one
+// closest to the root
+func findComicInfo(zr *zip.Reader) *zip.File {
+	var found *zip.File
+	for _, f := range zr.File {
+		if !strings.EqualFold(filepath.Base(f.Name), "ComicInfo.xml") {
+			continue
+		}
+		if found == nil || strings.Count(f.Name, "/") < strings.Count(found.Name, "/") {
+			found = f
+		}
+	}
+	return found
+}
+
+func readComicInfo(f *zip.File) (*ComicInfo, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, 4<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var doc struct {
+		Elements []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+		Pages []struct {
+			Image string `xml:"Image,attr"`
+			Type  string `xml:"Type,attr"`
+		} `xml:"Pages>Page"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid ComicInfo.xml: %v", err)
+	}
+
+	info := &ComicInfo{Fields: make(map[string]string)}
+	for _, el := range doc.Elements {
+		value := strings.TrimSpace(el.Value)
+		// ComicRack writes -1 and Unknown for fields that were never filled in
+		if value == "" || value == "-1" || value == "Unknown" {
+			continue
+		}
+		info.Fields[snakeCase(el.XMLName.Local)] = value
+	}
+	for _, p := range doc.Pages {
+		index, err := strconv.Atoi(strings.TrimSpace(p.Image))
+		if err != nil {
+			continue
+		}
+		info.Pages = append(info.Pages, ComicPageInfo{Image: index, Type: strings.TrimSpace(p.Type)})
+	}
+	return info, nil
+}
+
+// orderComicPages applies the ComicInfo page list to the name-sorted images:
+// pages follow the listed order, front covers come first and deleted pages are
+// dropped. Images the list does not mention are kept at the end
+func orderComicPages(files []*zip.File, info *ComicInfo) []cbzPage {
+	var covers, pages []cbzPage
+	used := make([]bool, len(files))
+	if info != nil {
+		for _, p := range info.Pages {
+			if p.Image < 0 || p.Image >= len(files) || used[p.Image] {
+				continue
+			}
+			used[p.Image] = true
+			page := cbzPage{file: files[p.Image], kind: p.Type}
+			switch {
+			case strings.EqualFold(p.Type, "Deleted"):
+			case strings.EqualFold(p.Type, "FrontCover"):
+				covers = append(covers, page)
+			default:
+				pages = append(pages, page)
+			}
+		}
+	}
+	for i, f := range files {
+		if !used[i] {
+			pages = append(pages, cbzPage{file: f})
+		}
+	}
+
+	ordered := append(covers, pages...)
+	if len(ordered) == 0 {
+		// Never hide every page because of a bad page list
+		for _, f := range files {
+			ordered = append(ordered, cbzPage{file: f})
+		}
+	}
+	return ordered
+}
+
+// comicInfoFields turns ComicInfo elements into metadata fields for the
+// "comicinfo" mapping source. List fields are split on commas and
+// language_iso is also available as language
+func comicInfoFields(info *ComicInfo) map[string][]string {
+	fields := make(map[string][]string)
+	for name, value := range info.Fields {
+		if !comicInfoListFields[name] {
+			fields[name] = []string{value}
+			continue
+		}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				fields[name] = append(fields[name], v)
+			}
+		}
+	}
+	if lang, ok := fields["language_iso"]; ok {
+		if _, set := fields["language"]; !set {
+			fields["language"] = lang
+		}
+	}
+	return fields
+}
+
+// loadComicInfo reads a CBZ's ComicInfo.xml and counts its pages. info is nil
+// when the archive has no ComicInfo.xml
+func loadComicInfo(cbzPath string) (info *ComicInfo, pageCount int, err error) {
+	r, err := zip.OpenReader(cbzPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+
+	if f := findComicInfo(&r.Reader); f != nil {
+		if info, err = readComicInfo(f); err != nil {
+			return nil, 0, err
+		}
+	}
+	return info, len(orderComicPages(cbzImageFiles(&r.Reader), info)), nil
+}
+
+func computeCBZProperties(fileID int64, filePath string) {
+	info, pageCount, err := loadComicInfo(filePath)
+	if err != nil {
+		log.Printf("Warning: could not read CBZ %s: %v", filePath, err)
+		return
+	}
+
+	setProperty(fileID, "pages", strconv.Itoa(pageCount))
+	if info != nil {
+		applyMetadata(fileID, mapMetadata("comicinfo", comicInfoFields(info), config.MetadataMappings))
+	}
+}
+
+// reapplyComicInfo re-reads a CBZ's ComicInfo.xml and maps it onto the file.
+// Properties written by the comicinfo mappings are replaced rather than kept,
+// so edits to the archive show up. It reports whether ComicInfo was found
+func reapplyComicInfo(fileID int64, cbzPath string) (bool, error) {
+	info, pageCount, err := loadComicInfo(cbzPath)
+	if err != nil {
+		return false, err
+	}
+
+	keys := []interface{}{fileID, "pages"}
+	for _, m := range config.MetadataMappings {
+		if m.Source == "comicinfo" && m.Target == "property" {
+			keys = append(keys, m.Name)
+		}
+	}
+	query := "DELETE FROM file_properties WHERE file_id = ? AND key IN (?" + strings.Repeat(", ?", len(keys)-2) + ")"
+	if _, err := db.Exec(query, keys...); err != nil {
+		return false, fmt.Errorf("failed to clear properties: %v", err)
+	}
+
+	setProperty(fileID, "pages", strconv.Itoa(pageCount))
+	if info == nil {
+		return false, nil
+	}
+	applyMetadata(fileID, mapMetadata("comicinfo", comicInfoFields(info), config.MetadataMappings))
+	return true, nil
+}
+
+// fileComicInfoHandler re-reads ComicInfo.xml for a single CBZ on demand
+func fileComicInfoHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+		return
+	}
+
+	var f File
+	err := db.QueryRow("SELECT id, filename, path FROM files WHERE id = ?", parts[2]).Scan(&f.ID, &f.Filename, &f.Path)
+	if err != nil {
+		renderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	found, err := reapplyComicInfo(int64(f.ID), filepath.Join(config.UploadDir, f.Path))
+	if err != nil {
+		log.Printf("Error: fileComicInfoHandler: failed to read ComicInfo for file id=%d: %v", f.ID, err)
+		http.Redirect(w, r, "/file/"+parts[2]+"?error="+url.QueryEscape("Failed to read ComicInfo.xml: "+err.Error()), http.StatusSeeOther)
+		return
+	}
+	if !found {
+		http.Redirect(w, r, "/file/"+parts[2]+"?error="+url.QueryEscape("This archive has no ComicInfo.xml"), http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/file/"+parts[2]+"?success="+url.QueryEscape("ComicInfo.xml re-read and applied"), http.StatusSeeOther)
+}
+
+// handleBackfillComicInfo applies ComicInfo.xml to every CBZ in the library
+func handleBackfillComicInfo(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	data := currentAdminState(r, orphanData, missingThumbnails)
+
+	rows, err := db.Query("SELECT id, path FROM files WHERE LOWER(path) LIKE '%.cbz'")
+	if err != nil {
+		data.Error = "Failed to list CBZ files: " + err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+	type cbzFile struct {
+		id   int64
+		path string
+	}
+	var files []cbzFile
+	for rows.Next() {
+		var f cbzFile
+		if err := rows.Scan(&f.id, &f.path); err == nil {
+			files = append(files, f)
+		}
+	}
+	rows.Close()
+
+	applied, failed := 0, 0
+	for _, f := range files {
+		found, err := reapplyComicInfo(f.id, filepath.Join(config.UploadDir, f.path))
+		if err != nil {
+			log.Printf("Warning: handleBackfillComicInfo: file id=%d: %v", f.id, err)
+			failed++
+			continue
+		}
+		if found {
+			applied++
+		}
+	}
+
+	data.Success = fmt.Sprintf("Applied ComicInfo.xml to %d of %d CBZ files (%d without ComicInfo, %d unreadable).",
+		applied, len(files), len(files)-applied-failed, failed)
+	renderAdminPage(w, r, data)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errIngestSkipped is returned, together with the ID of the file already in
+// the library and a warning, when the conflict policy leaves the library
+// unchanged. Callers must not tag, record a source for or attach anything to
+// that file, since it is not the content they tried to add
+var errIngestSkipped = errors.New("file already in the library")
+
+// conflictPolicies lists what ingest can do when a filename is already taken
+var conflictPolicies = []string{"skip", "rename", "replace", "hash"}
+
+// resolveConflictPolicy returns the policy to use for a request, falling back
+// to the configured default and then to "skip"
+func resolveConflictPolicy(requested string) string {
+	for _, candidate := range []string{requested, config.ConflictPolicy} {
+		candidate = strings.ToLower(strings.TrimSpace(candidate))
+		for _, p := range conflictPolicies {
+			if candidate == p {
+				return p
+			}
+		}
+	}
+	return "skip"
+}
+
+// filenameTaken reports whether a name is in use on disk or in the database,
+// returning the ID of the database entry when there is one
+func filenameTaken(filename string) (bool, int64) {
+	id, err := getFileIDByName(filename)
+	if err == nil {
+		return true, id
+	}
+	if _, err := os.Stat(filepath.Join(config.UploadDir, filename)); err == nil {
+		return true, 0
+	}
+	return false, 0
+}
+
+// numberedFilename finds the first free "name (N).ext" for N >= 2
+func numberedFilename(filename string) string {
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+	for n := 2; ; n++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+		if taken, _ := filenameTaken(candidate); !taken {
+			return candidate
+		}
+	}
+}
+
+// hashedFilename appends the first 8 hex digits of the content's SHA-256
+func hashedFilename(filename, contentPath string) (string, error) {
+	f, err := os.Open(contentPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(filename, ext), hex.EncodeToString(h.Sum(nil))[:8], ext), nil
+}
+
+// ingestFile adds the content at tempPath (which must be inside the upload
+// directory and is consumed) to the library as filename. When the name is
+// taken the policy decides what happens, and the outcome is described in the
+// returned warning. When nothing is added the error is errIngestSkipped
+func ingestFile(tempPath, filename, policy string) (int64, string, error) {
+	policy = resolveConflictPolicy(policy)
+
+	taken, existingID := filenameTaken(filename)
+	outcome := ""
+	if taken {
+		switch policy {
+		case "skip":
+			os.Remove(tempPath)
+			if existingID == 0 {
+				return 0, "", fmt.Errorf("a file named %s already exists on disk but not in the database", filename)
+			}
+			return existingID, fmt.Sprintf("%s already exists; kept file/%d unchanged", filename, existingID), errIngestSkipped
+
+		case "replace":
+			if existingID == 0 {
+				os.Remove(tempPath)
+				return 0, "", fmt.Errorf("a file named %s already exists on disk but not in the database", filename)
+			}
+			if err := replaceFileContent(int(existingID), tempPath); err != nil {
+				os.Remove(tempPath)
+				return 0, "", err
+			}
+			return existingID, fmt.Sprintf("%s already exists; replaced the content of file/%d", filename, existingID), nil
+
+		case "rename":
+			renamed := numberedFilename(filename)
+			outcome = fmt.Sprintf("%s already exists; saved as %s", filename, renamed)
+			filename = renamed
+
+		case "hash":
+			hashed, err := hashedFilename(filename, tempPath)
+			if err != nil {
+				os.Remove(tempPath)
+				return 0, "", fmt.Errorf("failed to hash file: %v", err)
+			}
+			// The same name and hash means the same content is already stored
+			if hashedTaken, hashedID := filenameTaken(hashed); hashedTaken && hashedID != 0 {
+				os.Remove(tempPath)
+				return hashedID, fmt.Sprintf("%s already exists; identical content kept as file/%d", filename, hashedID), errIngestSkipped
+			} else if hashedTaken {
+				hashed = numberedFilename(hashed)
+			}
+			outcome = fmt.Sprintf("%s already exists; saved as %s", filename, hashed)
+			filename = hashed
+		}
+	}
+
+	id, warningMsg, err := storeNewFile(tempPath, filename)
+	if err != nil {
+		return 0, "", err
+	}
+	if outcome != "" && warningMsg != "" {
+		warningMsg = outcome + "; " + warningMsg
+	} else if outcome != "" {
+		warningMsg = outcome
+	}
+	return id, warningMsg, nil
+}
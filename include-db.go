@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"strconv"
 	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -19,9 +20,89 @@ func InitDatabase(dbPath string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	if err := migrateTables(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := seedDefaults(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
 	return db, nil
 }
 
+// migrateTables adds columns introduced after a table was first created,
+// which CREATE TABLE IF NOT EXISTS leaves out of existing databases
+func migrateTables(db *sql.DB) error {
+	if err := addColumnIfMissing(db, "playlist_entries", "status", `TEXT NOT NULL DEFAULT 'imported'`); err != nil {
+		return err
+	}
+	if err := addColumnIfMissing(db, "file_subtitles", "origin", `TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+	return createTextIndex(db)
+}
+
+// createTextIndex sets up the FTS4 index over file_text, kept in step by
+// triggers, and fills it from any text indexed before it existed
+func createTextIndex(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE name = 'file_text_fts'`).Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+	_, err := db.Exec(`
+	CREATE VIRTUAL TABLE file_text_fts USING fts4(content="file_text", content, tokenize=unicode61);
+	CREATE TRIGGER IF NOT EXISTS file_text_ai AFTER INSERT ON file_text BEGIN
+		INSERT INTO file_text_fts(docid, content) VALUES (new.rowid, new.content);
+	END;
+	CREATE TRIGGER IF NOT EXISTS file_text_bu BEFORE UPDATE ON file_text BEGIN
+		DELETE FROM file_text_fts WHERE docid = old.rowid;
+	END;
+	CREATE TRIGGER IF NOT EXISTS file_text_au AFTER UPDATE ON file_text BEGIN
+		INSERT INTO file_text_fts(docid, content) VALUES (new.rowid, new.content);
+	END;
+	CREATE TRIGGER IF NOT EXISTS file_text_bd BEFORE DELETE ON file_text BEGIN
+		DELETE FROM file_text_fts WHERE docid = old.rowid;
+	END;
+	INSERT INTO file_text_fts(file_text_fts) VALUES ('rebuild');
+	`)
+	return err
+}
+
+// rebuildTextFTS refills the FTS4 index from file_text, needed after a
+// VACUUM because file_text rowids are not stable
+func rebuildTextFTS() error {
+	_, err := db.Exec(`INSERT INTO file_text_fts(file_text_fts) VALUES ('rebuild')`)
+	return err
+}
+
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition)
+	return err
+}
+
 // createTables creates all necessary database tables
 func createTables(db *sql.DB) error {
 	schema := `
@@ -57,6 +138,12 @@ func createTables(db *sql.DB) error {
 		content TEXT DEFAULT '',
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
+	CREATE TABLE IF NOT EXISTS notes_history (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		content    TEXT NOT NULL,
+		source     TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
 	CREATE TABLE IF NOT EXISTS settings (
 		key   TEXT PRIMARY KEY,
 		value TEXT NOT NULL DEFAULT ''
@@ -72,18 +159,204 @@ func createTables(db *sql.DB) error {
 		description TEXT NOT NULL DEFAULT '',
 		command     TEXT NOT NULL
 	);
+	CREATE TABLE IF NOT EXISTS filename_rules (
+		id      INTEGER PRIMARY KEY AUTOINCREMENT,
+		name    TEXT NOT NULL,
+		pattern TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS tag_rules (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		name      TEXT NOT NULL,
+		condition TEXT NOT NULL,
+		category  TEXT NOT NULL,
+		value     TEXT NOT NULL,
+		enabled   INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS file_sources (
+		file_id   INTEGER PRIMARY KEY,
+		kind      TEXT NOT NULL,
+		origin    TEXT NOT NULL DEFAULT '',
+		extractor TEXT NOT NULL DEFAULT '',
+		added_at  DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS playlists (
+		id           INTEGER PRIMARY KEY AUTOINCREMENT,
+		url          TEXT NOT NULL UNIQUE,
+		title        TEXT NOT NULL DEFAULT '',
+		last_checked DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS playlist_entries (
+		playlist_id INTEGER NOT NULL,
+		entry_key   TEXT NOT NULL,
+		position    INTEGER NOT NULL DEFAULT 0,
+		status      TEXT NOT NULL DEFAULT 'imported',
+		PRIMARY KEY (playlist_id, entry_key)
+	);
+	CREATE TABLE IF NOT EXISTS metadata_mappings (
+		id     INTEGER PRIMARY KEY AUTOINCREMENT,
+		source TEXT NOT NULL,
+		field  TEXT NOT NULL,
+		target TEXT NOT NULL,
+		name   TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE IF NOT EXISTS transcode_profiles (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		name          TEXT NOT NULL,
+		containers    TEXT NOT NULL DEFAULT '',
+		video_codecs  TEXT NOT NULL DEFAULT '',
+		audio_codecs  TEXT NOT NULL DEFAULT '',
+		video_encoder TEXT NOT NULL DEFAULT 'copy',
+		video_args    TEXT NOT NULL DEFAULT '',
+		audio_encoder TEXT NOT NULL DEFAULT 'copy',
+		max_height    INTEGER NOT NULL DEFAULT 0,
+		output_ext    TEXT NOT NULL DEFAULT '',
+		keep_original INTEGER NOT NULL DEFAULT 0,
+		enabled       INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE IF NOT EXISTS file_positions (
+		file_id    INTEGER PRIMARY KEY,
+		kind       TEXT NOT NULL,
+		position   REAL NOT NULL DEFAULT 0,
+		total      REAL NOT NULL DEFAULT 0,
+		finished   INTEGER NOT NULL DEFAULT 0,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS file_markers (
+		id         INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id    INTEGER NOT NULL,
+		time       REAL NOT NULL,
+		label      TEXT NOT NULL DEFAULT '',
+		tag_id     INTEGER,
+		source     TEXT NOT NULL DEFAULT 'user',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_file_markers_file ON file_markers(file_id, time);
+	CREATE TABLE IF NOT EXISTS file_subtitles (
+		id       INTEGER PRIMARY KEY AUTOINCREMENT,
+		file_id  INTEGER NOT NULL,
+		language TEXT NOT NULL DEFAULT '',
+		label    TEXT NOT NULL DEFAULT '',
+		source   TEXT NOT NULL DEFAULT 'embedded',
+		origin   TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_file_subtitles_file ON file_subtitles(file_id);
+	CREATE TABLE IF NOT EXISTS file_originals (
+		file_id INTEGER PRIMARY KEY,
+		path    TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS file_text (
+		file_id INTEGER NOT NULL,
+		source  TEXT NOT NULL,
+		content TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (file_id, source)
+	);
 	`
 
 	_, err := db.Exec(schema)
 	return err
 }
 
+// seedOnce runs the given statements the first time a marker is seen, so
+// defaults can be removed by the user without being recreated on restart
+func seedOnce(db *sql.DB, marker string, stmts ...string) error {
+	var exists int
+	err := db.QueryRow(`SELECT COUNT(*) FROM settings WHERE key = ?`, "seeded_"+marker).Scan(&exists)
+	if err != nil || exists > 0 {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO settings (key, value) VALUES (?, '1')`, "seeded_"+marker); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// seedDefaults inserts the default rows for newly introduced config tables
+func seedDefaults(db *sql.DB) error {
+	if err := seedOnce(db, "metadata_mappings", `
+		INSERT INTO metadata_mappings (source, field, target, name) VALUES
+			('ytdlp', 'uploader',    'tag',         'uploader'),
+			('ytdlp', 'tags',        'tag',         'keyword'),
+			('ytdlp', 'upload_date', 'property',    'upload_date'),
+			('ytdlp', 'description', 'description', '')
+	`); err != nil {
+		return err
+	}
+
+	if err := seedOnce(db, "audio_metadata_mappings", `
+		INSERT INTO metadata_mappings (source, field, target, name) VALUES
+			('audio', 'artist', 'property', 'artist'),
+			('audio', 'album',  'property', 'album'),
+			('audio', 'track',  'property', 'track'),
+			('audio', 'year',   'property', 'year')
+	`); err != nil {
+		return err
+	}
+
+	if err := seedOnce(db, "epub_metadata_mappings", `
+		INSERT INTO metadata_mappings (source, field, target, name) VALUES
+			('epub', 'author',       'tag',      'author'),
+			('epub', 'series',       'tag',      'series'),
+			('epub', 'series_index', 'property', 'series_index'),
+			('epub', 'language',     'property', 'language')
+	`); err != nil {
+		return err
+	}
+
+	if err := seedOnce(db, "comicinfo_metadata_mappings", `
+		INSERT INTO metadata_mappings (source, field, target, name) VALUES
+			('comicinfo', 'series',    'tag',         'series'),
+			('comicinfo', 'number',    'property',    'issue'),
+			('comicinfo', 'writer',    'tag',         'writer'),
+			('comicinfo', 'penciller', 'tag',         'artist'),
+			('comicinfo', 'publisher', 'tag',         'publisher'),
+			('comicinfo', 'year',      'property',    'year'),
+			('comicinfo', 'genre',     'tag',         'genre'),
+			('comicinfo', 'summary',   'description', '')
+	`); err != nil {
+		return err
+	}
+
+	// The first profile reproduces the old hard-wired HEVC re-encode; the
+	// others are disabled examples
+	return seedOnce(db, "transcode_profiles", `
+		INSERT INTO transcode_profiles
+			(name, containers, video_codecs, audio_codecs, video_encoder, video_args, audio_encoder, max_height, output_ext, keep_original, enabled) VALUES
+			('HEVC to H.264',           '',             'hevc',    '', 'libx264', '-profile:v baseline -preset fast -crf 23', 'aac',  0,    '',    0, 1),
+			('Remux MKV to MP4',        'mkv',          'h264',    '', 'copy',    '',                                        'aac',  0,    'mp4', 0, 0),
+			('AV1/VP9 to H.264',        '',             'av1,vp9', '', 'libx264', '-preset fast -crf 23',                    'aac',  0,    'mp4', 1, 0),
+			('Downscale above 1080p',   '',             '',        '', 'libx264', '-preset fast -crf 23',                    'copy', 1080, '',    1, 0),
+			('Normalise audio to AAC',  'mp4,m4v,mov',  '',        '', 'copy',    '',                                        'aac',  0,    '',    0, 0)
+	`)
+}
+
 func LoadConfig(db *sql.DB) (Config, error) {
 	cfg := Config{
-		GallerySize:  "400px",
-		ItemsPerPage: "100",
-		TagAliases:   []TagAliasGroup{},
-		SedRules:     []SedRule{},
+		GallerySize:       "400px",
+		ItemsPerPage:      "100",
+		ConflictPolicy:    "skip",
+		HLSCacheMB:        "4096",
+		IndexSubtitles:    true,
+		IndexEPUB:         true,
+		TextVersions:      "10",
+		NotesVersions:     "0",
+		TagAliases:        []TagAliasGroup{},
+		SedRules:          []SedRule{},
+		FilenameRules:     []FilenameRule{},
+		TagRules:          []TagRule{},
+		MetadataMappings:  []MetadataMapping{},
+		TranscodeProfiles: []TranscodeProfile{},
 	}
 
 	rows, err := db.Query(`SELECT key, value FROM settings`)
@@ -105,6 +378,28 @@ func LoadConfig(db *sql.DB) (Config, error) {
 			if value != "" {
 				cfg.ItemsPerPage = value
 			}
+		case "conflict_policy":
+			if value != "" {
+				cfg.ConflictPolicy = value
+			}
+		case "auto_finish_status":
+			cfg.AutoFinishStatus = value == "true"
+		case "index_subtitles":
+			cfg.IndexSubtitles = value == "true"
+		case "index_epub":
+			cfg.IndexEPUB = value == "true"
+		case "text_versions":
+			if value != "" {
+				cfg.TextVersions = value
+			}
+		case "notes_versions":
+			if value != "" {
+				cfg.NotesVersions = value
+			}
+		case "hls_cache_mb":
+			if value != "" {
+				cfg.HLSCacheMB = value
+			}
 		}
 	}
 	if err := rows.Err(); err != nil {
@@ -146,6 +441,74 @@ func LoadConfig(db *sql.DB) (Config, error) {
 		return cfg, err
 	}
 
+	filenameRows, err := db.Query(`SELECT name, pattern FROM filename_rules ORDER BY id`)
+	if err != nil {
+		return cfg, err
+	}
+	defer filenameRows.Close()
+	for filenameRows.Next() {
+		var rule FilenameRule
+		if err := filenameRows.Scan(&rule.Name, &rule.Pattern); err != nil {
+			return cfg, err
+		}
+		cfg.FilenameRules = append(cfg.FilenameRules, rule)
+	}
+	if err := filenameRows.Err(); err != nil {
+		return cfg, err
+	}
+
+	tagRuleRows, err := db.Query(`SELECT name, condition, category, value, enabled FROM tag_rules ORDER BY id`)
+	if err != nil {
+		return cfg, err
+	}
+	defer tagRuleRows.Close()
+	for tagRuleRows.Next() {
+		var rule TagRule
+		if err := tagRuleRows.Scan(&rule.Name, &rule.Condition, &rule.Category, &rule.Value, &rule.Enabled); err != nil {
+			return cfg, err
+		}
+		cfg.TagRules = append(cfg.TagRules, rule)
+	}
+	if err := tagRuleRows.Err(); err != nil {
+		return cfg, err
+	}
+
+	mappingRows, err := db.Query(`SELECT source, field, target, name FROM metadata_mappings ORDER BY id`)
+	if err != nil {
+		return cfg, err
+	}
+	defer mappingRows.Close()
+	for mappingRows.Next() {
+		var m MetadataMapping
+		if err := mappingRows.Scan(&m.Source, &m.Field, &m.Target, &m.Name); err != nil {
+			return cfg, err
+		}
+		cfg.MetadataMappings = append(cfg.MetadataMappings, m)
+	}
+	if err := mappingRows.Err(); err != nil {
+		return cfg, err
+	}
+
+	profileRows, err := db.Query(`
+		SELECT name, containers, video_codecs, audio_codecs, video_encoder, video_args,
+			audio_encoder, max_height, output_ext, keep_original, enabled
+		FROM transcode_profiles ORDER BY id`)
+	if err != nil {
+		return cfg, err
+	}
+	defer profileRows.Close()
+	for profileRows.Next() {
+		var p TranscodeProfile
+		if err := profileRows.Scan(&p.Name, &p.Containers, &p.VideoCodecs, &p.AudioCodecs, &p.VideoEncoder, &p.VideoArgs,
+			&p.AudioEncoder, &p.MaxHeight, &p.OutputExt, &p.KeepOriginal, &p.Enabled); err != nil {
+			return cfg, err
+		}
+		cfg.TranscodeProfiles = append(cfg.TranscodeProfiles, p)
+	}
+	if err := profileRows.Err(); err != nil {
+		return cfg, err
+	}
+
 	return cfg, nil
 }
 
@@ -159,6 +522,13 @@ func SaveConfig(db *sql.DB, cfg Config) error {
 	for _, kv := range [][2]string{
 		{"gallery_size", cfg.GallerySize},
 		{"items_per_page", cfg.ItemsPerPage},
+		{"conflict_policy", cfg.ConflictPolicy},
+		{"auto_finish_status", strconv.FormatBool(cfg.AutoFinishStatus)},
+		{"hls_cache_mb", cfg.HLSCacheMB},
+		{"index_subtitles", strconv.FormatBool(cfg.IndexSubtitles)},
+		{"index_epub", strconv.FormatBool(cfg.IndexEPUB)},
+		{"text_versions", cfg.TextVersions},
+		{"notes_versions", cfg.NotesVersions},
 	} {
 		if _, err := tx.Exec(`
 			INSERT INTO settings (key, value) VALUES (?, ?)
@@ -193,5 +563,56 @@ func SaveConfig(db *sql.DB, cfg Config) error {
 		}
 	}
 
+	if _, err := tx.Exec(`DELETE FROM filename_rules`); err != nil {
+		return err
+	}
+	for _, rule := range cfg.FilenameRules {
+		if _, err := tx.Exec(
+			`INSERT INTO filename_rules (name, pattern) VALUES (?, ?)`,
+			rule.Name, rule.Pattern,
+		); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM tag_rules`); err != nil {
+		return err
+	}
+	for _, rule := range cfg.TagRules {
+		if _, err := tx.Exec(
+			`INSERT INTO tag_rules (name, condition, category, value, enabled) VALUES (?, ?, ?, ?, ?)`,
+			rule.Name, rule.Condition, rule.Category, rule.Value, rule.Enabled,
+		); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM metadata_mappings`); err != nil {
+		return err
+	}
+	for _, m := range cfg.MetadataMappings {
+		if _, err := tx.Exec(
+			`INSERT INTO metadata_mappings (source, field, target, name) VALUES (?, ?, ?, ?)`,
+			m.Source, m.Field, m.Target, m.Name,
+		); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM transcode_profiles`); err != nil {
+		return err
+	}
+	for _, p := range cfg.TranscodeProfiles {
+		if _, err := tx.Exec(`
+			INSERT INTO transcode_profiles
+				(name, containers, video_codecs, audio_codecs, video_encoder, video_args, audio_encoder, max_height, output_ext, keep_original, enabled)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			p.Name, p.Containers, p.VideoCodecs, p.AudioCodecs, p.VideoEncoder, p.VideoArgs,
+			p.AudioEncoder, p.MaxHeight, p.OutputExt, p.KeepOriginal, p.Enabled,
+		); err != nil {
+			return err
+		}
+	}
+
 	return tx.Commit()
 }
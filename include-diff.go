@@ -0,0 +1,104 @@
+package main
+
+// maxDiffCells bounds the LCS table; larger changed regions are shown as a
+// block removal followed by a block addition
+const maxDiffCells = 4_000_000
+
+// diffLines compares two texts line by line. Lines common to both are found
+// with a longest-common-subsequence table after trimming the shared prefix
+// and suffix, which keeps typical edits cheap
+func diffLines(a, b []string) []DiffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var out []DiffLine
+	for i := 0; i < prefix; i++ {
+		out = append(out, DiffLine{Op: "same", OldLine: i + 1, NewLine: i + 1, Text: a[i]})
+	}
+
+	midA, midB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	oldNo, newNo := prefix+1, prefix+1
+	del := func(text string) {
+		out = append(out, DiffLine{Op: "del", OldLine: oldNo, Text: text})
+		oldNo++
+	}
+	add := func(text string) {
+		out = append(out, DiffLine{Op: "add", NewLine: newNo, Text: text})
+		newNo++
+	}
+
+	n, m := len(midA), len(midB)
+	if n*m > maxDiffCells {
+		for _, l := range midA {
+			del(l)
+		}
+		for _, l := range midB {
+			add(l)
+		}
+	} else {
+		// lcs[i*(m+1)+j] is the LCS length of midA[i:] and midB[j:]
+		lcs := make([]int32, (n+1)*(m+1))
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if midA[i] == midB[j] {
+					lcs[i*(m+1)+j] = lcs[(i+1)*(m+1)+j+1] + 1
+				} else {
+					lcs[i*(m+1)+j] = max(lcs[(i+1)*(m+1)+j], lcs[i*(m+1)+j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < n || j < m {
+			switch {
+			case i < n && j < m && midA[i] == midB[j]:
+				out = append(out, DiffLine{Op: "same", OldLine: oldNo, NewLine: newNo, Text: midA[i]})
+				oldNo++
+				newNo++
+				i++
+				j++
+			case i < n && (j == m || lcs[(i+1)*(m+1)+j] >= lcs[i*(m+1)+j+1]):
+				del(midA[i])
+				i++
+			default:
+				add(midB[j])
+				j++
+			}
+		}
+	}
+
+	for i := 0; i < suffix; i++ {
+		out = append(out, DiffLine{Op: "same", OldLine: oldNo + i, NewLine: newNo + i, Text: a[len(a)-suffix+i]})
+	}
+	return out
+}
+
+// diffHunks groups a diff into runs of changes with up to context unchanged
+// lines around each. A diff without changes has no hunks
+func diffHunks(lines []DiffLine, context int) [][]DiffLine {
+	var hunks [][]DiffLine
+	start, end := -1, -1
+	for i, l := range lines {
+		if l.Op == "same" {
+			continue
+		}
+		lo, hi := max(i-context, 0), min(i+context, len(lines)-1)
+		if start >= 0 && lo > end+1 {
+			hunks = append(hunks, lines[start:end+1])
+			start = -1
+		}
+		if start < 0 {
+			start = lo
+		}
+		end = hi
+	}
+	if start >= 0 {
+		hunks = append(hunks, lines[start:end+1])
+	}
+	return hunks
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DirImportOptions controls which files a directory import picks up and how
+// their folders are turned into tags
+type DirImportOptions struct {
+	Include         string // comma-separated globs, empty matches everything
+	Exclude         string // comma-separated globs
+	DepthCategories string // comma-separated categories for folder depth 1, 2, ...
+	DeleteSource    bool
+	ConflictPolicy  string
+}
+
+func dirImportOptionsFromForm(r *http.Request) DirImportOptions {
+	return DirImportOptions{
+		Include:         strings.TrimSpace(r.FormValue("include")),
+		Exclude:         strings.TrimSpace(r.FormValue("exclude")),
+		DepthCategories: strings.TrimSpace(r.FormValue("depth_categories")),
+		DeleteSource:    r.FormValue("delete_source") == "on",
+		ConflictPolicy:  resolveConflictPolicy(r.FormValue("conflict_policy")),
+	}
+}
+
+func splitGlobs(list string) []string {
+	var globs []string
+	for _, g := range strings.Split(list, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			globs = append(globs, g)
+		}
+	}
+	return globs
+}
+
+// matchesAnyGlob checks globs against the base name, or against the whole
+// relative path when the glob contains a slash
+func matchesAnyGlob(globs []string, relPath string) bool {
+	for _, g := range globs {
+		target := path.Base(relPath)
+		if strings.Contains(g, "/") {
+			target = relPath
+		}
+		if ok, _ := path.Match(g, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// depthTags maps folder components onto the configured categories by depth
+func depthTags(folders []string, categories string) []TagPair {
+	var tags []TagPair
+	for i, category := range strings.Split(categories, ",") {
+		category = strings.TrimSpace(category)
+		if i >= len(folders) {
+			break
+		}
+		if category != "" && folders[i] != "" {
+			tags = append(tags, TagPair{Category: category, Value: folders[i]})
+		}
+	}
+	return tags
+}
+
+// planDirImport walks root and decides the filename and tags for every file
+// that passes the include/exclude globs. Nothing is written
+func planDirImport(root string, opts DirImportOptions) ([]ImportPlanItem, error) {
+	include := splitGlobs(opts.Include)
+	exclude := splitGlobs(opts.Exclude)
+
+	for _, g := range append(append([]string(nil), include...), exclude...) {
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q", g)
+		}
+	}
+
+	var relPaths []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Warning: planDirImport: cannot read %s: %v", p, err)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, relErr := filepath.Rel(root, p)
+		if relErr != nil || rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if matchesAnyGlob(exclude, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		// Symlinks and other special files are never followed
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if matchesAnyGlob(exclude, rel) {
+			return nil
+		}
+		if len(include) > 0 && !matchesAnyGlob(include, rel) {
+			return nil
+		}
+		relPaths = append(relPaths, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Subtitles next to a video are imported as its tracks, not as files
+	videoStems := make(map[string]bool)
+	for _, rel := range relPaths {
+		if isVideoFile(rel) {
+			videoStems[strings.TrimSuffix(rel, path.Ext(rel))] = true
+		}
+	}
+	kept := relPaths[:0]
+	for _, rel := range relPaths {
+		if !isSidecarSubtitle(rel, videoStems) {
+			kept = append(kept, rel)
+		}
+	}
+	relPaths = kept
+
+	baseCounts := make(map[string]int)
+	for _, rel := range relPaths {
+		baseCounts[strings.ToLower(path.Base(rel))]++
+	}
+
+	var items []ImportPlanItem
+	for _, rel := range relPaths {
+		filename, folders := importFilename(rel, baseCounts)
+		item := ImportPlanItem{
+			Source:   filepath.Join(root, filepath.FromSlash(rel)),
+			RelPath:  rel,
+			Filename: filename,
+			Tags:     depthTags(folders, opts.DepthCategories),
+		}
+		if _, _, conflictID, err := checkFileConflictStrict(filename); err != nil {
+			item.Error = err.Error()
+		} else {
+			item.ExistingID = conflictID
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// importPlanItem adds one planned file to the library
+func importPlanItem(item ImportPlanItem, opts DirImportOptions) (int64, string, error) {
+	f, err := os.Open(item.Source)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open file: %v", err)
+	}
+
+	id, warningMsg, err := processUpload(f, item.Filename, opts.ConflictPolicy)
+	f.Close()
+	if errors.Is(err, errIngestSkipped) {
+		return id, warningMsg, nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	recordFileSource(id, "local", item.Source, "")
+	for _, tag := range item.Tags {
+		if err := addTagToFile(int(id), tag.Category, tag.Value); err != nil {
+			log.Printf("Warning: importPlanItem: failed to add tag %s:%s to file id=%d: %v", tag.Category, tag.Value, id, err)
+		}
+	}
+	applyTagRules(id)
+
+	var sidecars []string
+	if isVideoFile(item.Source) {
+		sidecars = importSidecarSubtitles(id, item.Source)
+	}
+
+	if opts.DeleteSource {
+		for _, p := range append([]string{item.Source}, sidecars...) {
+			if err := os.Remove(p); err != nil {
+				warningMsg = strings.TrimPrefix(fmt.Sprintf("%s; could not delete source file: %v", warningMsg, err), "; ")
+			}
+		}
+	}
+	return id, warningMsg, nil
+}
+
+// handleDirImport previews or queues the import of a whole directory tree
+func handleDirImport(w http.ResponseWriter, r *http.Request, root string) {
+	opts := dirImportOptionsFromForm(r)
+
+	items, err := planDirImport(root, opts)
+	if err != nil {
+		renderError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.FormValue("dry_run") == "on" {
+		data := DirImportPageData{Root: root, Options: opts, Items: items}
+		for _, item := range items {
+			if item.Error == "" && (item.ExistingID == 0 || opts.ConflictPolicy != "skip") {
+				data.New++
+			}
+		}
+		renderTemplate(w, "import-preview.html", buildPageData("Import Preview", data))
+		return
+	}
+
+	queued, skipped := 0, 0
+	for _, item := range items {
+		if item.Error != "" || (item.ExistingID != 0 && opts.ConflictPolicy == "skip") {
+			skipped++
+			continue
+		}
+		item := item
+		enqueueJob("import", item.RelPath, func() (int64, string, error) {
+			return importPlanItem(item, opts)
+		})
+		queued++
+	}
+
+	redirectWithWarning(w, r, "/jobs", fmt.Sprintf("Queued %d files from %s, skipped %d already in the library", queued, root, skipped))
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"archive/zip"
+	"container/list"
+	"os"
+	"sync"
+	"time"
+)
+
+// epubOpenBooks caps how many EPUBs are kept open and parsed at once
+const epubOpenBooks = 4
+
+// epubEntry is an opened and parsed EPUB in the book LRU. Like a cbzReader it
+// is only closed once it has been evicted and no request is still using it
+type epubEntry struct {
+	path    string
+	modTime time.Time
+	size    int64
+	zr      *zip.ReadCloser
+	book    *EPUBBook
+	refs    int
+	evicted bool
+}
+
+var epubCache = struct {
+	sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // most recently used at the front
+}{
+	entries: make(map[string]*list.Element),
+	lru:     list.New(),
+}
+
+// acquireEPUB returns the opened archive and parsed package document of an
+// EPUB, reusing a cached one unless the file changed. The archive is opened
+// and parsed without holding the cache lock. Callers must release the entry
+// with releaseEPUB
+func acquireEPUB(epubPath string) (*epubEntry, error) {
+	info, err := os.Stat(epubPath)
+	if err != nil {
+		return nil, err
+	}
+	if e := lookupEPUB(epubPath, info); e != nil {
+		return e, nil
+	}
+
+	zr, book, err := openEPUB(epubPath)
+	if err != nil {
+		return nil, err
+	}
+
+	epubCache.Lock()
+	defer epubCache.Unlock()
+	if el, ok := epubCache.entries[epubPath]; ok {
+		e := el.Value.(*epubEntry)
+		if e.modTime.Equal(info.ModTime()) && e.size == info.Size() {
+			// Another request opened the same book meanwhile
+			zr.Close()
+			epubCache.lru.MoveToFront(el)
+			e.refs++
+			return e, nil
+		}
+		evictEPUBLocked(el)
+	}
+	e := &epubEntry{path: epubPath, modTime: info.ModTime(), size: info.Size(), zr: zr, book: book, refs: 1}
+	epubCache.entries[epubPath] = epubCache.lru.PushFront(e)
+	for epubCache.lru.Len() > epubOpenBooks {
+		evictEPUBLocked(epubCache.lru.Back())
+	}
+	return e, nil
+}
+
+func lookupEPUB(epubPath string, info os.FileInfo) *epubEntry {
+	epubCache.Lock()
+	defer epubCache.Unlock()
+	el, ok := epubCache.entries[epubPath]
+	if !ok {
+		return nil
+	}
+	e := el.Value.(*epubEntry)
+	if !e.modTime.Equal(info.ModTime()) || e.size != info.Size() {
+		evictEPUBLocked(el)
+		return nil
+	}
+	epubCache.lru.MoveToFront(el)
+	e.refs++
+	return e
+}
+
+func releaseEPUB(e *epubEntry) {
+	epubCache.Lock()
+	defer epubCache.Unlock()
+	e.refs--
+	if e.evicted && e.refs == 0 {
+		e.zr.Close()
+	}
+}
+
+func evictEPUBLocked(el *list.Element) {
+	e := el.Value.(*epubEntry)
+	epubCache.lru.Remove(el)
+	delete(epubCache.entries, e.path)
+	e.evicted = true
+	if e.refs == 0 {
+		e.zr.Close()
+	}
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// epubDroppedElements are removed from chapters together with their content
+var epubDroppedElements = map[string]bool{
+	"script": true, "iframe": true, "frame": true, "frameset": true,
+	"object": true, "embed": true, "applet": true, "form": true, "base": true,
+}
+
+// epubContentPolicy keeps chapters from running scripts or loading anything
+// from outside the archive
+const epubContentPolicy = "default-src 'self' data:; script-src 'none'; object-src 'none'; style-src 'self' 'unsafe-inline'"
+
+// readZipMember returns the contents of a named archive member
+func readZipMember(zr *zip.Reader, name string) ([]byte, error) {
+	for _, f := range zr.File {
+		if f.Name == name {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			defer rc.Close()
+			return io.ReadAll(rc)
+		}
+	}
+	return nil, fmt.Errorf("%s not found in archive", name)
+}
+
+// parseEPUB reads the OPF package document (and the NCX table of contents,
+// when there is one) of an opened EPUB
+func parseEPUB(zr *zip.Reader) (*EPUBBook, error) {
+	containerXML, err := readZipMember(zr, "META-INF/container.xml")
+	if err != nil {
+		return nil, err
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(containerXML, &container); err != nil || len(container.Rootfiles) == 0 {
+		return nil, fmt.Errorf("invalid META-INF/container.xml")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+
+	opfXML, err := readZipMember(zr, opfPath)
+	if err != nil {
+		return nil, err
+	}
+	var opf struct {
+		Metadata struct {
+			Titles    []string `xml:"title"`
+			Creators  []string `xml:"creator"`
+			Languages []string `xml:"language"`
+			Meta      []struct {
+				Name     string `xml:"name,attr"`
+				Content  string `xml:"content,attr"`
+				Property string `xml:"property,attr"`
+				Refines  string `xml:"refines,attr"`
+				ID       string `xml:"id,attr"`
+				Value    string `xml:",chardata"`
+			} `xml:"meta"`
+		} `xml:"metadata"`
+		Manifest []struct {
+			ID         string `xml:"id,attr"`
+			Href       string `xml:"href,attr"`
+			MediaType  string `xml:"media-type,attr"`
+			Properties string `xml:"properties,attr"`
+		} `xml:"manifest>item"`
+		Spine struct {
+			Toc      string `xml:"toc,attr"`
+			ItemRefs []struct {
+				IDRef string `xml:"idref,attr"`
+			} `xml:"itemref"`
+		} `xml:"spine"`
+	}
+	if err := xml.Unmarshal(opfXML, &opf); err != nil {
+		return nil, fmt.Errorf("invalid package document %s: %v", opfPath, err)
+	}
+
+	book := &EPUBBook{}
+	if len(opf.Metadata.Titles) > 0 {
+		book.Title = strings.TrimSpace(opf.Metadata.Titles[0])
+	}
+	for _, c := range opf.Metadata.Creators {
+		if c = strings.TrimSpace(c); c != "" {
+			book.Authors = append(book.Authors, c)
+		}
+	}
+	if len(opf.Metadata.Languages) > 0 {
+		book.Language = strings.TrimSpace(opf.Metadata.Languages[0])
+	}
+
+	// Series come from calibre's meta tags (EPUB 2) or a refined
+	// belongs-to-collection (EPUB 3)
+	coverID := ""
+	collectionID := ""
+	for _, m := range opf.Metadata.Meta {
+		switch {
+		case m.Name == "calibre:series":
+			book.Series = strings.TrimSpace(m.Content)
+		case m.Name == "calibre:series_index":
+			book.SeriesIndex = strings.TrimSpace(m.Content)
+		case m.Name == "cover":
+			coverID = m.Content
+		case m.Property == "belongs-to-collection" && book.Series == "":
+			book.Series = strings.TrimSpace(m.Value)
+			collectionID = m.ID
+		}
+	}
+	for _, m := range opf.Metadata.Meta {
+		if m.Property == "group-position" && collectionID != "" && m.Refines == "#"+collectionID && book.SeriesIndex == "" {
+			book.SeriesIndex = strings.TrimSpace(m.Value)
+		}
+	}
+
+	// Manifest hrefs are relative to the OPF and URL-encoded
+	base := path.Dir(opfPath)
+	resolve := func(href string) string {
+		if unescaped, err := url.PathUnescape(href); err == nil {
+			href = unescaped
+		}
+		return path.Clean(path.Join(base, href))
+	}
+
+	items := make(map[string]string)
+	for _, item := range opf.Manifest {
+		full := resolve(item.Href)
+		items[item.ID] = full
+		isImage := strings.HasPrefix(item.MediaType, "image/")
+		switch {
+		case strings.Contains(" "+item.Properties+" ", " cover-image "):
+			book.Cover = full
+		case item.ID == coverID && isImage && book.Cover == "":
+			book.Cover = full
+		}
+	}
+	if book.Cover == "" {
+		for _, item := range opf.Manifest {
+			if strings.HasPrefix(item.MediaType, "image/") && strings.Contains(strings.ToLower(item.ID+item.Href), "cover") {
+				book.Cover = items[item.ID]
+				break
+			}
+		}
+	}
+
+	labels := epubTOCLabels(zr, items[opf.Spine.Toc])
+	for _, ref := range opf.Spine.ItemRefs {
+		full, ok := items[ref.IDRef]
+		if !ok {
+			continue
+		}
+		chapter := EPUBChapter{Index: len(book.Chapters), Path: full, Title: labels[full]}
+		if chapter.Title == "" {
+			chapter.Title = strings.TrimSuffix(path.Base(full), path.Ext(full))
+		}
+		book.Chapters = append(book.Chapters, chapter)
+	}
+	if len(book.Chapters) == 0 {
+		return nil, fmt.Errorf("EPUB has no chapters in its spine")
+	}
+	return book, nil
+}
+
+// epubTOCLabels maps chapter paths to their labels in an NCX table of contents
+func epubTOCLabels(zr *zip.Reader, ncxPath string) map[string]string {
+	labels := make(map[string]string)
+	if ncxPath == "" {
+		return labels
+	}
+	data, err := readZipMember(zr, ncxPath)
+	if err != nil {
+		return labels
+	}
+
+	type navPoint struct {
+		Label   string `xml:"navLabel>text"`
+		Content struct {
+			Src string `xml:"src,attr"`
+		} `xml:"content"`
+		Points []navPoint `xml:"navPoint"`
+	}
+	var ncx struct {
+		Points []navPoint `xml:"navMap>navPoint"`
+	}
+	if err := xml.Unmarshal(data, &ncx); err != nil {
+		return labels
+	}
+
+	base := path.Dir(ncxPath)
+	var walk func([]navPoint)
+	walk = func(points []navPoint) {
+		for _, p := range points {
+			src := strings.SplitN(p.Content.Src, "#", 2)[0]
+			if unescaped, err := url.PathUnescape(src); err == nil {
+				src = unescaped
+			}
+			full := path.Clean(path.Join(base, src))
+			if _, seen := labels[full]; !seen && strings.TrimSpace(p.Label) != "" {
+				labels[full] = strings.TrimSpace(p.Label)
+			}
+			walk(p.Points)
+		}
+	}
+	walk(ncx.Points)
+	return labels
+}
+
+// openEPUB opens an EPUB file and parses its package document
+func openEPUB(epubPath string) (*zip.ReadCloser, *EPUBBook, error) {
+	zr, err := zip.OpenReader(epubPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open EPUB: %v", err)
+	}
+	book, err := parseEPUB(&zr.Reader)
+	if err != nil {
+		zr.Close()
+		return nil, nil, err
+	}
+	return zr, book, nil
+}
+
+// epubFields exposes book metadata to the "epub" metadata mappings
+func epubFields(book *EPUBBook) map[string][]string {
+	fields := map[string][]string{"author": book.Authors}
+	for name, value := range map[string]string{
+		"title":        book.Title,
+		"language":     book.Language,
+		"series":       book.Series,
+		"series_index": book.SeriesIndex,
+	} {
+		if value != "" {
+			fields[name] = []string{value}
+		}
+	}
+	return fields
+}
+
+func computeEPUBProperties(fileID int64, filePath string) {
+	zr, book, err := openEPUB(filePath)
+	if err != nil {
+		log.Printf("Warning: could not read EPUB %s: %v", filePath, err)
+		return
+	}
+	zr.Close()
+
+	setProperty(fileID, "chapters", strconv.Itoa(len(book.Chapters)))
+	applyMetadata(fileID, mapMetadata("epub", epubFields(book), config.MetadataMappings))
+}
+
+// generateEPUBThumbnail scales the book's cover image into a thumbnail
+func generateEPUBThumbnail(epubPath, uploadDir, filename string) error {
+	zr, book, err := openEPUB(epubPath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	if book.Cover == "" {
+		return fmt.Errorf("EPUB has no cover image")
+	}
+	data, err := readZipMember(&zr.Reader, book.Cover)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to decode cover %s: %v", book.Cover, err)
+	}
+
+	thumbDir := filepath.Join(uploadDir, "thumbnails")
+	if err := os.MkdirAll(thumbDir, 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnails directory: %v", err)
+	}
+	outFile, err := os.Create(filepath.Join(thumbDir, filename+".jpg"))
+	if err != nil {
+		return fmt.Errorf("failed to create thumbnail file: %v", err)
+	}
+	defer outFile.Close()
+
+	if err := jpeg.Encode(outFile, resizeImage(img, 400, 600), &jpeg.Options{Quality: 85}); err != nil {
+		return fmt.Errorf("failed to encode JPEG: %v", err)
+	}
+	return nil
+}
+
+// unsafeURL reports whether a link or resource reference could run code
+func unsafeURL(value string) bool {
+	v := strings.ToLower(strings.Join(strings.Fields(value), ""))
+	return strings.HasPrefix(v, "javascript:") || strings.HasPrefix(v, "vbscript:") ||
+		(strings.HasPrefix(v, "data:") && !strings.HasPrefix(v, "data:image/"))
+}
+
+func xmlName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// sanitizeXHTML rewrites a chapter without scripts, embedded objects, event
+// handler attributes, script URLs or document type declarations. Tokens are copied without namespace
+// resolution so prefixes such as epub:type survive unchanged
+func sanitizeXHTML(data []byte) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+
+	var out bytes.Buffer
+	skipDepth := 0
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if skipDepth > 0 || epubDroppedElements[name] {
+				skipDepth++
+				continue
+			}
+			if name == "meta" && hasAttr(t.Attr, "http-equiv") {
+				skipDepth++
+				continue
+			}
+			out.WriteString("<" + xmlName(t.Name))
+			for _, a := range t.Attr {
+				attr := strings.ToLower(a.Name.Local)
+				if strings.HasPrefix(attr, "on") {
+					continue
+				}
+				if (attr == "href" || attr == "src" || attr == "srcset" || attr == "action" || attr == "formaction") && unsafeURL(a.Value) {
+					continue
+				}
+				out.WriteString(" " + xmlName(a.Name) + `="`)
+				out.WriteString(html.EscapeString(a.Value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			out.WriteString("</" + xmlName(t.Name) + ">")
+		case xml.CharData:
+			if skipDepth == 0 {
+				out.WriteString(html.EscapeString(string(t)))
+			}
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		case xml.Directive:
+			// A DOCTYPE can declare entities, so only a fixed one is kept
+			if skipDepth == 0 && strings.HasPrefix(strings.ToUpper(string(t)), "DOCTYPE") {
+				out.WriteString("<!DOCTYPE html>")
+			}
+		}
+	}
+	return out.Bytes(), nil
+}
+
+func hasAttr(attrs []xml.Attr, name string) bool {
+	for _, a := range attrs {
+		if strings.EqualFold(a.Name.Local, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// serveEPUBResource serves one archive member; chapters are sanitized first
+func serveEPUBResource(w http.ResponseWriter, zr *zip.Reader, name string) error {
+	data, err := readZipMember(zr, name)
+	if err != nil {
+		return err
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+	contentType := mime.TypeByExtension(ext)
+	switch ext {
+	case ".xhtml", ".html", ".htm", ".xml":
+		if data, err = sanitizeXHTML(data); err != nil {
+			return err
+		}
+		contentType = "application/xhtml+xml; charset=utf-8"
+	case ".css":
+		contentType = "text/css; charset=utf-8"
+	case ".svg":
+		// SVG can carry scripts of its own
+		if data, err = sanitizeXHTML(data); err != nil {
+			return err
+		}
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Security-Policy", epubContentPolicy)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, err = w.Write(data)
+	return err
+}
+
+// escapeArchivePath escapes each segment of an archive member path for use in a URL
+func escapeArchivePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// epubViewerHandler serves the EPUB reader: /epub/{id}/{chapter} shows a
+// chapter and /epub/{id}/res/{path} serves members of the archive
+func epubViewerHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/epub/"), "/", 3)
+	fileID := parts[0]
+
+	var f File
+	err := db.QueryRow("SELECT id, filename, path, COALESCE(description, '') FROM files WHERE id = ?", fileID).
+		Scan(&f.ID, &f.Filename, &f.Path, &f.Description)
+	if err != nil {
+		log.Printf("Error: epubViewerHandler: file not found for id=%s: %v", fileID, err)
+		renderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	epubPath := filepath.Join(config.UploadDir, f.Path)
+	entry, err := acquireEPUB(epubPath)
+	if err != nil {
+		log.Printf("Error: epubViewerHandler: failed to read EPUB at %s: %v", epubPath, err)
+		renderError(w, "Failed to read EPUB contents", http.StatusInternalServerError)
+		return
+	}
+	defer releaseEPUB(entry)
+	book := entry.book
+
+	if len(parts) == 3 && parts[1] == "res" {
+		if err := serveEPUBResource(w, &entry.zr.Reader, parts[2]); err != nil {
+			log.Printf("Warning: epubViewerHandler: failed to serve %s from %s: %v", parts[2], epubPath, err)
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	currentIndex := 0
+	if len(parts) >= 2 {
+		currentIndex, _ = strconv.Atoi(parts[1])
+	}
+	if currentIndex < 0 {
+		currentIndex = 0
+	}
+	if currentIndex >= len(book.Chapters) {
+		currentIndex = len(book.Chapters) - 1
+	}
+
+	viewData := EPUBViewData{
+		File:         f,
+		Book:         book,
+		CurrentIndex: currentIndex,
+		Chapter:      book.Chapters[currentIndex],
+		ChapterURL:   fmt.Sprintf("/epub/%d/res/%s", f.ID, escapeArchivePath(book.Chapters[currentIndex].Path)),
+		HasPrev:      currentIndex > 0,
+		HasNext:      currentIndex < len(book.Chapters)-1,
+	}
+
+	title := f.Filename
+	if book.Title != "" {
+		title = book.Title
+	}
+	renderTemplate(w, "epub_viewer.html", buildPageData(title, viewData))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// compileFilenameRule compiles a rule pattern and checks it has at least one named group
+func compileFilenameRule(rule FilenameRule) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("rule %q has an invalid pattern: %v", rule.Name, err)
+	}
+	for _, name := range re.SubexpNames() {
+		if name != "" {
+			return re, nil
+		}
+	}
+	return nil, fmt.Errorf("rule %q has no named capture groups, e.g. (?P<artist>...)", rule.Name)
+}
+
+// compileFilenameRules compiles every configured rule, skipping any that fail
+func compileFilenameRules(rules []FilenameRule) []*regexp.Regexp {
+	var compiled []*regexp.Regexp
+	for _, rule := range rules {
+		re, err := compileFilenameRule(rule)
+		if err != nil {
+			log.Printf("Warning: compileFilenameRules: %v", err)
+			continue
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled
+}
+
+// deriveFilenameTags maps the named groups of every matching rule to category:value pairs
+func deriveFilenameTags(filename string, rules []*regexp.Regexp) []TagPair {
+	var tags []TagPair
+	seen := make(map[TagPair]bool)
+
+	for _, re := range rules {
+		match := re.FindStringSubmatch(filename)
+		if match == nil {
+			continue
+		}
+		for i, category := range re.SubexpNames() {
+			if category == "" {
+				continue
+			}
+			value := strings.TrimSpace(match[i])
+			if value == "" {
+				continue
+			}
+			tag := TagPair{Category: category, Value: value}
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	return tags
+}
+
+// applyFilenameRules tags a single file using the configured filename rules
+func applyFilenameRules(fileID int64, filename string) int {
+	if len(config.FilenameRules) == 0 {
+		return 0
+	}
+
+	added := 0
+	for _, tag := range deriveFilenameTags(filename, compileFilenameRules(config.FilenameRules)) {
+		if err := addTagToFile(int(fileID), tag.Category, tag.Value); err != nil {
+			log.Printf("Warning: applyFilenameRules: failed to add tag %s:%s to file id=%d: %v", tag.Category, tag.Value, fileID, err)
+			continue
+		}
+		added++
+	}
+	return added
+}
+
+// previewFilenameRules lists the tags each existing file would gain from the filename rules
+func previewFilenameRules() ([]FilenameRuleMatch, error) {
+	rules := compileFilenameRules(config.FilenameRules)
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("no valid filename rules configured")
+	}
+
+	rows, err := db.Query(`SELECT id, filename FROM files ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	type fileRow struct {
+		id       int
+		filename string
+	}
+	var files []fileRow
+	for rows.Next() {
+		var f fileRow
+		if err := rows.Scan(&f.id, &f.filename); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var matches []FilenameRuleMatch
+	for _, f := range files {
+		derived := deriveFilenameTags(f.filename, rules)
+		if len(derived) == 0 {
+			continue
+		}
+
+		// getFileTagsByID errors when a file has no tags, which just means nothing to skip
+		existing, _ := getFileTagsByID(f.id)
+		have := make(map[TagPair]bool, len(existing))
+		for _, t := range existing {
+			have[TagPair{Category: t.cat, Value: t.val}] = true
+		}
+
+		var missing []TagPair
+		for _, tag := range derived {
+			if !have[tag] {
+				missing = append(missing, tag)
+			}
+		}
+		if len(missing) > 0 {
+			matches = append(matches, FilenameRuleMatch{FileID: f.id, Filename: f.filename, Tags: missing})
+		}
+	}
+
+	return matches, nil
+}
+
+func parseFilenameRulesFromForm(r *http.Request) ([]FilenameRule, error) {
+	var rules []FilenameRule
+	for i := 0; ; i++ {
+		name := strings.TrimSpace(r.FormValue(fmt.Sprintf("filename_rules[%d][name]", i)))
+		if name == "" {
+			break
+		}
+		rule := FilenameRule{
+			Name:    name,
+			Pattern: strings.TrimSpace(r.FormValue(fmt.Sprintf("filename_rules[%d][pattern]", i))),
+		}
+		if rule.Pattern == "" {
+			return nil, fmt.Errorf("rule %d is missing a pattern", i+1)
+		}
+		if _, err := compileFilenameRule(rule); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func handleSaveFilenameRules(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	rules, err := parseFilenameRulesFromForm(r)
+	if err != nil {
+		data := currentAdminState(r, orphanData, missingThumbnails)
+		data.Error = err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	config.FilenameRules = rules
+
+	if err := SaveConfig(db, config); err != nil {
+		log.Printf("Error: handleSaveFilenameRules: failed to save configuration: %v", err)
+		data := currentAdminState(r, orphanData, missingThumbnails)
+		data.Error = "Failed to save configuration: " + err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	data := currentAdminState(r, orphanData, missingThumbnails)
+	data.Success = "Filename rules saved successfully!"
+	renderAdminPage(w, r, data)
+}
+
+func handlePreviewFilenameRules(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	matches, err := previewFilenameRules()
+	data := currentAdminState(r, orphanData, missingThumbnails)
+	if err != nil {
+		data.Error = "Filename rule preview failed: " + err.Error()
+	} else {
+		data.FilenameMatches = matches
+		data.Success = fmt.Sprintf("%d files would gain tags from filename rules.", len(matches))
+	}
+	renderAdminPage(w, r, data)
+}
+
+func handleApplyFilenameRules(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	matches, err := previewFilenameRules()
+	data := currentAdminState(r, orphanData, missingThumbnails)
+	if err != nil {
+		data.Error = "Applying filename rules failed: " + err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	tagged, added := 0, 0
+	for _, m := range matches {
+		fileAdded := 0
+		for _, tag := range m.Tags {
+			if err := addTagToFile(m.FileID, tag.Category, tag.Value); err != nil {
+				log.Printf("Error: handleApplyFilenameRules: failed to add tag %s:%s to file id=%d: %v", tag.Category, tag.Value, m.FileID, err)
+				continue
+			}
+			fileAdded++
+		}
+		if fileAdded > 0 {
+			tagged++
+			added += fileAdded
+		}
+	}
+
+	data.Success = fmt.Sprintf("Added %d tags to %d files from filename rules.", added, tagged)
+	renderAdminPage(w, r, data)
+}
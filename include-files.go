@@ -23,6 +23,51 @@ func fileRouter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(parts) >= 4 && parts[3] == "refresh" {
+		fileRefreshHandler(w, r, parts)
+		return
+	}
+
+	if len(parts) >= 4 && parts[3] == "comicinfo" {
+		fileComicInfoHandler(w, r, parts)
+		return
+	}
+
+	if len(parts) >= 4 && parts[3] == "markers" {
+		fileMarkersHandler(w, r, parts)
+		return
+	}
+
+	if len(parts) >= 4 && parts[3] == "edit" {
+		fileEditHandler(w, r, parts)
+		return
+	}
+
+	if len(parts) >= 4 && parts[3] == "versions" {
+		fileVersionsHandler(w, r, parts)
+		return
+	}
+
+	if len(parts) >= 4 && parts[3] == "lines" {
+		fileLinesHandler(w, r, parts)
+		return
+	}
+
+	if len(parts) >= 4 && parts[3] == "grep" {
+		fileGrepHandler(w, r, parts)
+		return
+	}
+
+	if len(parts) >= 4 && parts[3] == "render" {
+		fileRenderHandler(w, r, parts)
+		return
+	}
+
+	if len(parts) >= 4 && parts[3] == "subtitles" {
+		fileSubtitlesHandler(w, r, parts)
+		return
+	}
+
 	if len(parts) >= 5 && parts[3] == "tag" && parts[4] == "delete" {
 		tagActionHandler(w, r, parts)
 		return
@@ -67,6 +112,36 @@ func fileDeleteHandler(w http.ResponseWriter, r *http.Request, parts []string) {
 		return
 	}
 
+	if _, err = tx.Exec("DELETE FROM file_sources WHERE file_id=?", fileID); err != nil {
+		log.Printf("Error: fileDeleteHandler: failed to delete file_sources for file id=%s: %v", fileID, err)
+		renderError(w, "Failed to delete file source", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err = tx.Exec("DELETE FROM file_positions WHERE file_id=?", fileID); err != nil {
+		log.Printf("Error: fileDeleteHandler: failed to delete file_positions for file id=%s: %v", fileID, err)
+		renderError(w, "Failed to delete file position", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err = tx.Exec("DELETE FROM file_markers WHERE file_id=?", fileID); err != nil {
+		log.Printf("Error: fileDeleteHandler: failed to delete file_markers for file id=%s: %v", fileID, err)
+		renderError(w, "Failed to delete file markers", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err = tx.Exec("DELETE FROM file_subtitles WHERE file_id=?", fileID); err != nil {
+		log.Printf("Error: fileDeleteHandler: failed to delete file_subtitles for file id=%s: %v", fileID, err)
+		renderError(w, "Failed to delete file subtitles", http.StatusInternalServerError)
+		return
+	}
+
+	if _, err = tx.Exec("DELETE FROM file_text WHERE file_id=?", fileID); err != nil {
+		log.Printf("Error: fileDeleteHandler: failed to delete file_text for file id=%s: %v", fileID, err)
+		renderError(w, "Failed to delete file text", http.StatusInternalServerError)
+		return
+	}
+
 	if _, err = tx.Exec("DELETE FROM files WHERE id=?", fileID); err != nil {
 		log.Printf("Error: fileDeleteHandler: failed to delete files record for file id=%s: %v", fileID, err)
 		renderError(w, "Failed to delete file record", http.StatusInternalServerError)
@@ -92,6 +167,19 @@ func fileDeleteHandler(w http.ResponseWriter, r *http.Request, parts []string) {
 		}
 	}
 
+	removeSprite(currentFile.Filename)
+	removeSubtitleFiles(currentFile.ID)
+	removeOriginal(int64(currentFile.ID))
+	os.RemoveAll(versionsDir(currentFile.ID))
+
+	// Delete cached page and image variants and HLS streams
+	for _, cache := range []string{"cbz", "img", "hls"} {
+		variants, _ := filepath.Glob(filepath.Join(config.UploadDir, "cache", cache, fmt.Sprintf("%d-*", currentFile.ID)))
+		for _, p := range variants {
+			os.RemoveAll(p)
+		}
+	}
+
 	http.Redirect(w, r, "/?deleted="+currentFile.Filename, http.StatusSeeOther)
 }
 
@@ -169,6 +257,7 @@ func fileRenameHandler(w http.ResponseWriter, r *http.Request, parts []string) {
 		renderError(w, "Failed to update database", http.StatusInternalServerError)
 		return
 	}
+	renameSprite(currentFilename, newFilename)
 
 	// Recompute properties in case the extension changed
 	if _, err := db.Exec("DELETE FROM file_properties WHERE file_id = ?", fileID); err != nil {
@@ -202,4 +291,99 @@ func getFileIDByName(filename string) (int64, error) {
 	var id int64
 	err := db.QueryRow("SELECT id FROM files WHERE filename = ?", filename).Scan(&id)
 	return id, err
-}
\ No newline at end of file
+}
+
+// replaceFileContent swaps the bytes of an existing file for those at tempPath,
+// keeping its ID, filename, tags and description. Computed properties are
+// refreshed; other properties (e.g. from metadata) are kept
+func replaceFileContent(fileID int, tempPath string) error {
+	var relPath string
+	if err := db.QueryRow("SELECT path FROM files WHERE id=?", fileID).Scan(&relPath); err != nil {
+		return fmt.Errorf("file not found: %v", err)
+	}
+	finalPath := filepath.Join(config.UploadDir, relPath)
+
+	// Keep the old content until the new content has been processed
+	backupPath := finalPath + ".bak"
+	if err := os.Rename(finalPath, backupPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to move old file aside: %v", err)
+	}
+	restore := func() {
+		if err := os.Rename(backupPath, finalPath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error: replaceFileContent: failed to restore %s: %v", finalPath, err)
+		}
+	}
+
+	workPath := finalPath + ".tmp"
+	if err := os.Rename(tempPath, workPath); err != nil {
+		restore()
+		return fmt.Errorf("failed to move new file into place: %v", err)
+	}
+
+	ext := strings.ToLower(filepath.Ext(finalPath))
+	switch ext {
+	case ".mp4", ".mov", ".avi", ".mkv", ".webm", ".m4v", ".cbz":
+		_, original, _, err := processVideoFile(workPath, finalPath, true)
+		if err != nil {
+			os.Remove(workPath)
+			restore()
+			return err
+		}
+		recordOriginal(int64(fileID), original)
+		if ext != ".cbz" {
+			queueSpriteJob(int64(fileID), filepath.Base(finalPath))
+			queueSubtitleJob(int64(fileID), filepath.Base(finalPath))
+		}
+	default:
+		if err := os.Rename(workPath, finalPath); err != nil {
+			os.Remove(workPath)
+			restore()
+			return fmt.Errorf("failed to move file: %v", err)
+		}
+		if isAudioFile(finalPath) {
+			if err := generateAudioThumbnail(finalPath, config.UploadDir, filepath.Base(finalPath)); err != nil {
+				log.Printf("Warning: replaceFileContent: could not generate audio thumbnail: %v", err)
+			}
+		} else if ext == ".epub" {
+			if err := generateEPUBThumbnail(finalPath, config.UploadDir, filepath.Base(finalPath)); err != nil {
+				log.Printf("Warning: replaceFileContent: could not generate EPUB thumbnail: %v", err)
+			}
+		} else if isImageFile(finalPath) {
+			if err := generateImageThumbnail(finalPath, config.UploadDir, filepath.Base(finalPath)); err != nil {
+				log.Printf("Warning: replaceFileContent: could not generate image thumbnail: %v", err)
+			}
+		}
+	}
+	os.Remove(backupPath)
+
+	refreshProperties(int64(fileID), finalPath)
+	indexFileContent(int64(fileID), finalPath)
+	return nil
+}
+
+// refreshProperties recomputes a file's properties. Properties that the
+// recompute does not produce are put back so metadata-derived values survive
+func refreshProperties(fileID int64, path string) {
+	rows, err := db.Query("SELECT key, value FROM file_properties WHERE file_id=?", fileID)
+	if err != nil {
+		log.Printf("Warning: refreshProperties: failed to read properties for file id=%d: %v", fileID, err)
+		return
+	}
+	old := make(map[string]string)
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err == nil {
+			old[k] = v
+		}
+	}
+	rows.Close()
+
+	if _, err := db.Exec("DELETE FROM file_properties WHERE file_id=?", fileID); err != nil {
+		log.Printf("Warning: refreshProperties: failed to clear properties for file id=%d: %v", fileID, err)
+		return
+	}
+	computeProperties(fileID, path)
+	for k, v := range old {
+		setProperty(fileID, k, v)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxIndexedTextSize caps the text files whose content is indexed
+const maxIndexedTextSize = 8 << 20
+
+// matchesPerFile limits the matched lines listed under each search result
+const matchesPerFile = 5
+
+// Elements that end a line when extracting EPUB chapter text
+var epubBlockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "tr": true, "h1": true, "h2": true, "h3": true,
+	"h4": true, "h5": true, "h6": true, "blockquote": true, "pre": true, "section": true, "dt": true, "dd": true,
+}
+
+// indexFileContent refreshes the search index for a file's contents: the
+// text of text files and, if enabled, the chapters of EPUB books. Other files
+// are left alone
+func indexFileContent(fileID int64, path string) {
+	var err error
+	switch {
+	case isTextFile(path):
+		err = indexTextFile(fileID, path)
+	case strings.EqualFold(filepath.Ext(path), ".epub"):
+		err = indexEPUBText(fileID, path)
+	}
+	if err != nil {
+		log.Printf("Warning: indexFileContent: failed to index file id=%d: %v", fileID, err)
+	}
+}
+
+func indexTextFile(fileID int64, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxIndexedTextSize {
+		log.Printf("Info: indexTextFile: %s is too large to index", path)
+		_, err := db.Exec(`DELETE FROM file_text WHERE file_id = ? AND source = 'text'`, fileID)
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !utf8.Valid(data) {
+		_, err := db.Exec(`DELETE FROM file_text WHERE file_id = ? AND source = 'text'`, fileID)
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO file_text (file_id, source, content) VALUES (?, 'text', ?)
+		ON CONFLICT(file_id, source) DO UPDATE SET content = excluded.content`,
+		fileID, strings.ReplaceAll(string(data), "\r\n", "\n"))
+	return err
+}
+
+// indexEPUBText stores each chapter's text under its own "epub:<index>"
+// source so matches can link to the chapter
+func indexEPUBText(fileID int64, path string) error {
+	if _, err := db.Exec(`DELETE FROM file_text WHERE file_id = ? AND source LIKE 'epub:%'`, fileID); err != nil {
+		return err
+	}
+	if !config.IndexEPUB {
+		return nil
+	}
+
+	zr, book, err := openEPUB(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, ch := range book.Chapters {
+		data, err := readZipMember(&zr.Reader, ch.Path)
+		if err != nil {
+			continue
+		}
+		text, err := epubChapterText(data)
+		if err != nil || text == "" {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO file_text (file_id, source, content) VALUES (?, ?, ?)`,
+			fileID, fmt.Sprintf("epub:%d", ch.Index), text); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// epubChapterText extracts the readable text of a chapter, one block element
+// per line
+func epubChapterText(data []byte) (string, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+
+	var lines []string
+	var line strings.Builder
+	endLine := func() {
+		if text := strings.Join(strings.Fields(line.String()), " "); text != "" {
+			lines = append(lines, text)
+		}
+		line.Reset()
+	}
+	skipDepth := 0
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if skipDepth > 0 || name == "head" || name == "script" || name == "style" {
+				skipDepth++
+			} else if epubBlockElements[name] {
+				endLine()
+			}
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+			} else if epubBlockElements[strings.ToLower(t.Name.Local)] {
+				endLine()
+			}
+		case xml.CharData:
+			if skipDepth == 0 {
+				line.Write(t)
+			}
+		}
+	}
+	endLine()
+	return strings.Join(lines, "\n"), nil
+}
+
+// rebuildTextIndex re-indexes the contents of every file, for libraries
+// that predate the index or after its settings change
+func rebuildTextIndex() (int, error) {
+	rows, err := db.Query(`SELECT id, path FROM files`)
+	if err != nil {
+		return 0, err
+	}
+	type entry struct {
+		id   int64
+		path string
+	}
+	var files []entry
+	for rows.Next() {
+		var e entry
+		if err := rows.Scan(&e.id, &e.path); err == nil {
+			files = append(files, e)
+		}
+	}
+	rows.Close()
+
+	for _, f := range files {
+		path := f.path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(config.UploadDir, path)
+		}
+		indexFileContent(f.id, path)
+		if isVideoFile(path) {
+			if err := indexSubtitleText(f.id); err != nil {
+				log.Printf("Warning: rebuildTextIndex: failed to index subtitles of file id=%d: %v", f.id, err)
+			}
+		}
+	}
+	return len(files), nil
+}
+
+// searchPatternRegexp turns a search query with * and ? wildcards into a
+// case-insensitive pattern for finding matched lines; spaces match any run
+// of punctuation, as the words of an indexed phrase may be split by it
+func searchPatternRegexp(query string) *regexp.Regexp {
+	words := strings.Fields(query)
+	for i, w := range words {
+		quoted := regexp.QuoteMeta(w)
+		words[i] = strings.ReplaceAll(strings.ReplaceAll(quoted, `\*`, `.*?`), `\?`, `.`)
+	}
+	return regexp.MustCompile(`(?i)` + strings.Join(words, `[^\pL\pN]+`))
+}
+
+// newTextMatch cuts a matched line down to the match and some context
+func newTextMatch(location, link, line string, loc []int) TextMatch {
+	const context = 60
+	before, after := line[:loc[0]], line[loc[1]:]
+	if len(before) > context {
+		before = "…" + strings.TrimLeft(trimToRuneStart(before[len(before)-context:]), " ")
+	}
+	if len(after) > context {
+		after = strings.TrimRight(strings.ToValidUTF8(after[:context], ""), " ") + "…"
+	}
+	return TextMatch{Location: location, URL: link, Before: before, Match: line[loc[0]:loc[1]], After: after}
+}
+
+// trimToRuneStart drops a partial UTF-8 sequence at the start of s
+func trimToRuneStart(s string) string {
+	for len(s) > 0 && !utf8.RuneStart(s[0]) {
+		s = s[1:]
+	}
+	return s
+}
+
+// findTextMatches lists the lines of a file's indexed text that match a
+// search query, each linking to where it appears
+func findTextMatches(fileID int, re *regexp.Regexp, ftsQuery string) []TextMatch {
+	rows, err := db.Query(`SELECT source, content FROM file_text WHERE file_id = ? AND rowid IN
+		(SELECT docid FROM file_text_fts WHERE file_text_fts MATCH ?)
+		ORDER BY source`, fileID, ftsQuery)
+	if err != nil {
+		log.Printf("Warning: findTextMatches: failed to query text of file id=%d: %v", fileID, err)
+		return nil
+	}
+	type indexed struct{ source, content string }
+	var texts []indexed
+	for rows.Next() {
+		var t indexed
+		if err := rows.Scan(&t.source, &t.content); err == nil {
+			texts = append(texts, t)
+		}
+	}
+	rows.Close()
+
+	var matches []TextMatch
+	for _, t := range texts {
+		if t.source == "subtitles" {
+			matches = append(matches, findSubtitleMatches(fileID, re, matchesPerFile-len(matches))...)
+		} else {
+			for n, line := range strings.Split(t.content, "\n") {
+				if len(matches) >= matchesPerFile {
+					break
+				}
+				loc := re.FindStringIndex(line)
+				if loc == nil || loc[0] == loc[1] {
+					continue
+				}
+				if chapter, ok := strings.CutPrefix(t.source, "epub:"); ok {
+					index, _ := strconv.Atoi(chapter)
+					matches = append(matches, newTextMatch(fmt.Sprintf("chapter %d, line %d", index+1, n+1),
+						fmt.Sprintf("/epub/%d/%d", fileID, index), line, loc))
+				} else {
+					matches = append(matches, newTextMatch(fmt.Sprintf("line %d", n+1),
+						fmt.Sprintf("/file/%d#l%d", fileID, n+1), line, loc))
+				}
+			}
+		}
+		if len(matches) >= matchesPerFile {
+			break
+		}
+	}
+	return matches
+}
+
+// findSubtitleMatches finds matching cues in a video's subtitle tracks and
+// links to the time they are shown
+func findSubtitleMatches(fileID int, re *regexp.Regexp, limit int) []TextMatch {
+	subs, err := getFileSubtitles(fileID)
+	if err != nil {
+		return nil
+	}
+	var matches []TextMatch
+	seen := make(map[string]bool)
+	for _, s := range subs {
+		data, err := os.ReadFile(subtitlePath(int64(fileID), int64(s.ID)))
+		if err != nil {
+			continue
+		}
+		for _, cue := range parseSubtitleCues(data) {
+			if len(matches) >= limit {
+				return matches
+			}
+			loc := re.FindStringIndex(cue.text)
+			key := fmt.Sprintf("%.3f %s", cue.start, cue.text)
+			if loc == nil || loc[0] == loc[1] || seen[key] {
+				continue
+			}
+			seen[key] = true
+			matches = append(matches, newTextMatch(formatClock(cue.start),
+				fmt.Sprintf("/file/%d#t=%.3f", fileID, cue.start), cue.text, loc))
+		}
+	}
+	return matches
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "encoding/json"
     "log"
     "net/http"
     "net/url"
@@ -29,6 +30,13 @@ func renderTemplate(w http.ResponseWriter, tmplName string, data PageData) {
 	}
 }
 
+// respondJSON writes body as a JSON response with the given status
+func respondJSON(w http.ResponseWriter, status int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
 func redirectWithWarning(w http.ResponseWriter, r *http.Request, baseURL, warningMsg string) {
 	redirectURL := baseURL
 	if warningMsg != "" {
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// sourceLanguage describes just enough of a language's lexical structure to
+// colour comments, strings, numbers and keywords
+type sourceLanguage struct {
+	lineComments []string
+	blockComment [2]string
+	strings      []string // opening and closing delimiters, longest first
+	rawStrings   []string // delimiters whose contents have no escapes
+	keywords     map[string]bool
+}
+
+func keywordSet(words string) map[string]bool {
+	set := make(map[string]bool)
+	for _, w := range strings.Fields(words) {
+		set[w] = true
+	}
+	return set
+}
+
+var (
+	cFamilyKeywords = "break case char const continue default do double else enum extern float for goto if " +
+		"int long register return short signed sizeof static struct switch typedef union unsigned void volatile while " +
+		"bool true false NULL nullptr class public private protected virtual template typename namespace using new delete " +
+		"this throw try catch final abstract extends implements import package interface instanceof super synchronized " +
+		"boolean byte null var let fn mut pub impl trait match mod use crate self Self loop where async await dyn ref move"
+
+	sourceLanguages = map[string]*sourceLanguage{
+		"go": {lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"}, strings: []string{`"`, `'`}, rawStrings: []string{"`"},
+			keywords: keywordSet("break case chan const continue default defer else fallthrough for func go goto if import " +
+				"interface map package range return select struct switch type var nil true false iota")},
+		"c": {lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"}, strings: []string{`"`, `'`},
+			keywords: keywordSet(cFamilyKeywords)},
+		"js": {lineComments: []string{"//"}, blockComment: [2]string{"/*", "*/"}, strings: []string{`"`, `'`, "`"},
+			keywords: keywordSet("async await break case catch class const continue debugger default delete do else export " +
+				"extends false finally for from function if import in instanceof let new null of return static super switch " +
+				"this throw true try typeof undefined var void while yield interface type enum implements readonly")},
+		"python": {lineComments: []string{"#"}, strings: []string{`"""`, `'''`, `"`, `'`},
+			keywords: keywordSet("and as assert async await break class continue def del elif else except False finally for " +
+				"from global if import in is lambda None nonlocal not or pass raise return True try while with yield self")},
+		"shell": {lineComments: []string{"#"}, strings: []string{`"`}, rawStrings: []string{`'`},
+			keywords: keywordSet("if then else elif fi for while until do done case esac function in return local export " +
+				"echo exit set unset shift source alias readonly declare")},
+		"ruby": {lineComments: []string{"#"}, strings: []string{`"`, `'`},
+			keywords: keywordSet("alias and begin break case class def defined? do else elsif end ensure false for if in module " +
+				"next nil not or redo rescue retry return self super then true undef unless until when while yield require")},
+		"php": {lineComments: []string{"//", "#"}, blockComment: [2]string{"/*", "*/"}, strings: []string{`"`, `'`},
+			keywords: keywordSet("abstract and array as break case catch class const continue declare default do echo else " +
+				"elseif empty extends final finally fn for foreach function global if implements include interface isset " +
+				"namespace new null private protected public require return static switch throw trait try use var while true false")},
+		"sql": {lineComments: []string{"--"}, blockComment: [2]string{"/*", "*/"}, strings: []string{`'`, `"`},
+			keywords: keywordSet("select from where and or not insert into values update set delete create table index view " +
+				"drop alter add primary key foreign references join left right inner outer on as group by order having limit " +
+				"offset distinct union all case when then else end null is in exists like between default integer text real " +
+				"SELECT FROM WHERE AND OR NOT INSERT INTO VALUES UPDATE SET DELETE CREATE TABLE INDEX VIEW DROP ALTER ADD " +
+				"PRIMARY KEY FOREIGN REFERENCES JOIN LEFT RIGHT INNER OUTER ON AS GROUP BY ORDER HAVING LIMIT OFFSET " +
+				"DISTINCT UNION ALL CASE WHEN THEN ELSE END NULL IS IN EXISTS LIKE BETWEEN DEFAULT INTEGER TEXT REAL")},
+		"lua": {lineComments: []string{"--"}, strings: []string{`"`, `'`},
+			keywords: keywordSet("and break do else elseif end false for function goto if in local nil not or repeat return " +
+				"then true until while")},
+		"css":    {blockComment: [2]string{"/*", "*/"}, strings: []string{`"`, `'`}, keywords: keywordSet("important")},
+		"markup": {blockComment: [2]string{"<!--", "-->"}, strings: []string{`"`, `'`}},
+		"config": {lineComments: []string{"#", ";"}, strings: []string{`"`, `'`}, keywords: keywordSet("true false null yes no on off")},
+		"json":   {strings: []string{`"`}, keywords: keywordSet("true false null")},
+	}
+
+	// Source file extensions and the language used to highlight them
+	sourceExts = map[string]string{
+		".go": "go", ".c": "c", ".h": "c", ".cpp": "c", ".cc": "c", ".hpp": "c", ".java": "c", ".cs": "c",
+		".rs": "c", ".kt": "c", ".swift": "c", ".js": "js", ".mjs": "js", ".ts": "js", ".jsx": "js", ".tsx": "js",
+		".py": "python", ".sh": "shell", ".bash": "shell", ".zsh": "shell", ".rb": "ruby", ".php": "php",
+		".sql": "sql", ".lua": "lua", ".css": "css", ".html": "markup", ".htm": "markup", ".xml": "markup",
+		".svg": "markup", ".json": "json", ".yaml": "config", ".yml": "config", ".toml": "config",
+		".ini": "config", ".conf": "config", ".cfg": "config",
+	}
+
+	// Aliases used in fenced code blocks
+	fenceLanguages = map[string]string{
+		"golang": "go", "cpp": "c", "c++": "c", "java": "c", "csharp": "c", "cs": "c", "rust": "c", "rs": "c",
+		"kotlin": "c", "swift": "c", "javascript": "js", "typescript": "js", "ts": "js", "jsx": "js", "tsx": "js",
+		"py": "python", "sh": "shell", "bash": "shell", "zsh": "shell", "console": "shell", "rb": "ruby",
+		"html": "markup", "xml": "markup", "svg": "markup", "yaml": "config", "yml": "config", "toml": "config",
+		"ini": "config",
+	}
+)
+
+// languageForFence resolves a fenced code block's info string to a language,
+// or nil if it isn't one we highlight
+func languageForFence(info string) *sourceLanguage {
+	name := strings.ToLower(strings.Fields(info + " x")[0])
+	if alias, ok := fenceLanguages[name]; ok {
+		name = alias
+	}
+	return sourceLanguages[name]
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// highlightLines colours source text and returns one escaped HTML string per
+// line. Spans are closed at line ends so each line stands on its own.
+// A nil language only escapes the text
+func highlightLines(src string, lang *sourceLanguage) []string {
+	var lines []string
+	var line strings.Builder
+	emit := func(class, text string) {
+		for i, part := range strings.Split(text, "\n") {
+			if i > 0 {
+				lines = append(lines, line.String())
+				line.Reset()
+			}
+			if part == "" {
+				continue
+			}
+			if class == "" {
+				line.WriteString(html.EscapeString(part))
+			} else {
+				fmt.Fprintf(&line, `<span class="hl-%s">%s</span>`, class, html.EscapeString(part))
+			}
+		}
+	}
+	if lang == nil {
+		emit("", src)
+		return append(lines, line.String())
+	}
+
+	i, plain := 0, 0
+	flush := func() {
+		emit("", src[plain:i])
+	}
+	for i < len(src) {
+		rest := src[i:]
+		start := i
+
+		if class, end := lang.match(rest); end > 0 {
+			flush()
+			emit(class, rest[:end])
+			i += end
+			plain = i
+			continue
+		}
+
+		c := src[i]
+		switch {
+		case c >= '0' && c <= '9' && (i == 0 || !isIdentChar(src[i-1])):
+			for i < len(src) && (isIdentChar(src[i]) || src[i] == '.') {
+				i++
+			}
+			emit("", src[plain:start])
+			emit("num", src[start:i])
+			plain = i
+		case isIdentStart(c):
+			for i < len(src) && isIdentChar(src[i]) {
+				i++
+			}
+			if lang.keywords[src[start:i]] {
+				emit("", src[plain:start])
+				emit("kw", src[start:i])
+				plain = i
+			}
+		default:
+			i++
+		}
+	}
+	flush()
+	return append(lines, line.String())
+}
+
+// match reports the class and length of a comment or string starting at the
+// beginning of s
+func (lang *sourceLanguage) match(s string) (string, int) {
+	for _, prefix := range lang.lineComments {
+		if strings.HasPrefix(s, prefix) {
+			if end := strings.IndexByte(s, '\n'); end >= 0 {
+				return "com", end
+			}
+			return "com", len(s)
+		}
+	}
+	if open, close := lang.blockComment[0], lang.blockComment[1]; open != "" && strings.HasPrefix(s, open) {
+		if end := strings.Index(s[len(open):], close); end >= 0 {
+			return "com", len(open) + end + len(close)
+		}
+		return "com", len(s)
+	}
+	for _, delim := range lang.rawStrings {
+		if strings.HasPrefix(s, delim) {
+			if end := strings.Index(s[len(delim):], delim); end >= 0 {
+				return "str", len(delim) + end + len(delim)
+			}
+			return "str", len(s)
+		}
+	}
+	for _, delim := range lang.strings {
+		if !strings.HasPrefix(s, delim) {
+			continue
+		}
+		// Single-character quotes end at the line; triple quotes may span lines
+		for j := len(delim); j < len(s); j++ {
+			switch {
+			case s[j] == '\\':
+				j++
+			case s[j] == '\n' && len(delim) == 1:
+				return "str", j
+			case strings.HasPrefix(s[j:], delim):
+				return "str", j + len(delim)
+			}
+		}
+		return "str", len(s)
+	}
+	return "", 0
+}
+
+// renderSourceHTML highlights a whole source file as numbered lines
+func renderSourceHTML(src string, lang *sourceLanguage) string {
+	var b strings.Builder
+	b.WriteString(`<pre class="code-view"><code>`)
+	for n, line := range highlightLines(strings.TrimSuffix(src, "\n"), lang) {
+		fmt.Fprintf(&b, `<span class="code-line" data-line="%d">%s</span>`+"\n", n+1, line)
+	}
+	b.WriteString(`</code></pre>`)
+	return b.String()
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// hlsSegmentSeconds is the target length of each HLS segment
+	hlsSegmentSeconds = 6
+	// hlsMaxStreams caps how many ffmpeg processes segment or stream at once
+	hlsMaxStreams = 2
+)
+
+var hlsFilePattern = regexp.MustCompile(`^(index\.m3u8|seg\d{5}\.ts|stream\.mp4)$`)
+
+// hlsSlots holds one token per running ffmpeg stream process
+var hlsSlots = make(chan struct{}, hlsMaxStreams)
+
+var errHLSBusy = errors.New("too many streams are being prepared, try again shortly")
+
+// Codecs and containers every supported browser plays from the original file
+var (
+	hlsNativeContainers = map[string]bool{".mp4": true, ".m4v": true, ".mov": true, ".webm": true}
+	hlsCopyVideo        = map[string]bool{"h264": true}
+	hlsCopyAudio        = map[string]bool{"aac": true, "mp3": true}
+	browserVideoCodecs  = map[string]bool{"h264": true, "vp8": true, "vp9": true, "av1": true}
+	browserAudioCodecs  = map[string]bool{"": true, "aac": true, "mp3": true, "opus": true, "vorbis": true, "flac": true}
+)
+
+// hlsSessions holds the running ffmpeg segmenters, keyed by cache directory
+var hlsSessions = struct {
+	sync.Mutex
+	running map[string]*hlsSession
+}{running: make(map[string]*hlsSession)}
+
+type hlsSession struct {
+	done chan struct{}
+	err  error
+}
+
+// needsHLS reports whether a video should be streamed through HLS because the
+// browser is unlikely to play the original's container or codecs
+func needsHLS(probe *MediaProbe, ext string) bool {
+	return !hlsNativeContainers[strings.ToLower(ext)] ||
+		!browserVideoCodecs[probe.VideoCodec] || !browserAudioCodecs[probe.AudioCodec]
+}
+
+// playbackProperty is the "playback" property of a video: "hls" when it is
+// streamed through HLS and "direct" when the browser plays the file itself
+func playbackProperty(probe *MediaProbe, ext string) string {
+	if needsHLS(probe, ext) {
+		return "hls"
+	}
+	return "direct"
+}
+
+// hlsCacheLimit returns the configured HLS cache size in bytes
+func hlsCacheLimit() int64 {
+	mb, err := strconv.ParseInt(config.HLSCacheMB, 10, 64)
+	if err != nil || mb <= 0 {
+		mb = 4096
+	}
+	return mb << 20
+}
+
+// hlsArgs builds the ffmpeg command that segments a file into dir
+func hlsArgs(src, dir string, probe *MediaProbe) []string {
+	args := append([]string{"-y", "-loglevel", "error", "-i", src}, streamCodecArgs(probe)...)
+	return append(args,
+		"-f", "hls", "-hls_time", strconv.Itoa(hlsSegmentSeconds), "-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(dir, "seg%05d.ts"),
+		filepath.Join(dir, "index.m3u8"))
+}
+
+// streamCodecArgs picks the streams and codecs of a browser stream. H.264 and
+// AAC/MP3 streams are copied; anything else is transcoded
+func streamCodecArgs(probe *MediaProbe) []string {
+	args := []string{"-map", "0:v:0", "-map", "0:a:0?", "-sn"}
+	if hlsCopyVideo[probe.VideoCodec] {
+		args = append(args, "-c:v", "copy")
+	} else {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+			"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds))
+	}
+	if hlsCopyAudio[probe.AudioCodec] {
+		args = append(args, "-c:a", "copy")
+	} else {
+		args = append(args, "-c:a", "aac", "-b:a", "160k", "-ac", "2")
+	}
+	return args
+}
+
+// startHLSSession segments a file into its cache directory in the background,
+// unless that is already under way. The file is probed without holding the
+// session lock, and errHLSBusy is returned when hlsMaxStreams are running
+func startHLSSession(fileID int, src, dir string) (*hlsSession, error) {
+	hlsSessions.Lock()
+	s, ok := hlsSessions.running[dir]
+	hlsSessions.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	probe, err := probeMedia(src)
+	if err != nil {
+		return nil, err
+	}
+	if probe.VideoCodec == "" {
+		return nil, fmt.Errorf("no video stream")
+	}
+
+	hlsSessions.Lock()
+	defer hlsSessions.Unlock()
+	// Another request may have started the session while probing
+	if s, ok := hlsSessions.running[dir]; ok {
+		return s, nil
+	}
+	select {
+	case hlsSlots <- struct{}{}:
+	default:
+		return nil, errHLSBusy
+	}
+
+	// Drop segments of older versions of the file
+	old, _ := filepath.Glob(filepath.Join(filepath.Dir(dir), fmt.Sprintf("%d-*", fileID)))
+	for _, p := range old {
+		if p != dir {
+			os.RemoveAll(p)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		<-hlsSlots
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	s = &hlsSession{done: make(chan struct{})}
+	hlsSessions.running[dir] = s
+	go func() {
+		var stderr bytes.Buffer
+		cmd := exec.Command("ffmpeg", hlsArgs(src, dir, probe)...)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			s.err = fmt.Errorf("ffmpeg failed: %v\nffmpeg output: %s", err, stderr.String())
+			log.Printf("Error: startHLSSession: segmenting file id=%d failed: %v", fileID, s.err)
+			os.RemoveAll(dir)
+		}
+
+		hlsSessions.Lock()
+		delete(hlsSessions.running, dir)
+		hlsSessions.Unlock()
+		<-hlsSlots
+		close(s.done)
+		pruneHLSCache()
+	}()
+	return s, nil
+}
+
+// pruneHLSCache removes the least recently used streams until the cache fits
+// its size limit. Streams still being written are kept
+func pruneHLSCache() {
+	root := filepath.Join(config.UploadDir, "cache", "hls")
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+
+	type stream struct {
+		path     string
+		size     int64
+		lastUsed time.Time
+	}
+	var streams []stream
+	var total int64
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		s := stream{path: filepath.Join(root, e.Name()), lastUsed: info.ModTime()}
+		files, _ := os.ReadDir(s.path)
+		for _, f := range files {
+			if fi, err := f.Info(); err == nil {
+				s.size += fi.Size()
+			}
+		}
+		total += s.size
+		streams = append(streams, s)
+	}
+
+	limit := hlsCacheLimit()
+	if total <= limit {
+		return
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].lastUsed.Before(streams[j].lastUsed) })
+
+	hlsSessions.Lock()
+	defer hlsSessions.Unlock()
+	for _, s := range streams {
+		if total <= limit {
+			break
+		}
+		if _, busy := hlsSessions.running[s.path]; busy {
+			continue
+		}
+		if err := os.RemoveAll(s.path); err != nil {
+			log.Printf("Warning: pruneHLSCache: failed to remove %s: %v", s.path, err)
+			continue
+		}
+		total -= s.size
+	}
+}
+
+// hlsHandler serves /hls/{id}/index.m3u8 and its segments. The first request
+// starts segmenting the file; the playlist grows as ffmpeg works through it
+// and is served once the first segment is ready. /hls/{id}/stream.mp4 is the
+// same stream as fragmented MP4 for browsers without HLS support
+func hlsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/hls/"), "/")
+	if len(parts) != 2 || !hlsFilePattern.MatchString(parts[1]) {
+		http.NotFound(w, r)
+		return
+	}
+	fileID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	var path string
+	if err := db.QueryRow("SELECT path FROM files WHERE id = ?", fileID).Scan(&path); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(config.UploadDir, path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	if parts[1] == "stream.mp4" {
+		serveFragmentedMP4(w, r, fileID, path)
+		return
+	}
+
+	dir := filepath.Join(config.UploadDir, "cache", "hls", fmt.Sprintf("%d-%x", fileID, info.ModTime().UnixNano()))
+	target := filepath.Join(dir, parts[1])
+
+	if parts[1] == "index.m3u8" {
+		playlist, err := os.ReadFile(target)
+		if err != nil || !bytes.Contains(playlist, []byte("#EXT-X-ENDLIST")) {
+			session, err := startHLSSession(fileID, path, dir)
+			if err == errHLSBusy {
+				w.Header().Set("Retry-After", "10")
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			if err != nil {
+				log.Printf("Error: hlsHandler: failed to start HLS for file id=%d: %v", fileID, err)
+				http.Error(w, "Failed to start stream: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !waitForHLSPlaylist(session, target) {
+				http.Error(w, "Stream did not start", http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+		w.Header().Set("Cache-Control", "private, max-age=86400")
+	}
+
+	// Mark the stream as recently used for the LRU
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	http.ServeFile(w, r, target)
+}
+
+// waitForHLSPlaylist waits until ffmpeg has written a playlist with at least
+// one segment, or gives up when it fails or takes too long
+func waitForHLSPlaylist(session *hlsSession, playlistPath string) bool {
+	deadline := time.After(60 * time.Second)
+	tick := time.NewTicker(200 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		if data, err := os.ReadFile(playlistPath); err == nil && bytes.Contains(data, []byte("#EXTINF")) {
+			return true
+		}
+		select {
+		case <-session.done:
+			data, err := os.ReadFile(playlistPath)
+			return session.err == nil && err == nil && bytes.Contains(data, []byte("#EXTINF"))
+		case <-deadline:
+			return false
+		case <-tick.C:
+		}
+	}
+}
+
+// serveFragmentedMP4 streams a file transcoded on the fly into fragmented MP4,
+// which browsers play progressively. Nothing is cached, and the player can
+// only seek within what it has received
+func serveFragmentedMP4(w http.ResponseWriter, r *http.Request, fileID int, src string) {
+	probe, err := probeMedia(src)
+	if err == nil && probe.VideoCodec == "" {
+		err = fmt.Errorf("no video stream")
+	}
+	if err != nil {
+		log.Printf("Error: serveFragmentedMP4: failed to probe file id=%d: %v", fileID, err)
+		http.Error(w, "Failed to start stream: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case hlsSlots <- struct{}{}:
+		defer func() { <-hlsSlots }()
+	default:
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, errHLSBusy.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	args := append([]string{"-loglevel", "error", "-i", src}, streamCodecArgs(probe)...)
+	args = append(args, "-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4", "pipe:1")
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(r.Context(), "ffmpeg", args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := cmd.Run(); err != nil && r.Context().Err() == nil {
+		log.Printf("Error: serveFragmentedMP4: streaming file id=%d failed: %v\nffmpeg output: %s", fileID, err, stderr.String())
+	}
+}
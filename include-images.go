@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var imageExts = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+}
+
+func isImageFile(filename string) bool {
+	return imageExts[strings.ToLower(filepath.Ext(filename))]
+}
+
+// exifOrientation reads the EXIF orientation (1-8) of a JPEG, returning 1
+// when the file has none
+func exifOrientation(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil || b != 0xFF {
+			return 1
+		}
+		marker, err := r.ReadByte()
+		for err == nil && marker == 0xFF {
+			marker, err = r.ReadByte()
+		}
+		// Metadata segments all come before the image data
+		if err != nil || marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil || length < 2 {
+			return 1
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 1
+		}
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+	}
+}
+
+// tiffOrientation finds the orientation tag (0x0112) in the first IFD of an
+// EXIF TIFF block
+func tiffOrientation(b []byte) int {
+	if len(b) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(b[4:8]))
+	if offset < 8 || offset+2 > len(b) {
+		return 1
+	}
+	count := int(order.Uint16(b[offset:]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(b) {
+			break
+		}
+		if order.Uint16(b[entry:]) == 0x0112 {
+			if v := int(order.Uint16(b[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates and mirrors an image so it displays upright for
+// the given EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // flipped vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated 90 clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated 90 counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// cropToAspect cuts the centre of an image to the aspect ratio of width x height
+func cropToAspect(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	target := float64(width) / float64(height)
+	cw, ch := bounds.Dx(), bounds.Dy()
+	if float64(cw)/float64(ch) > target {
+		cw = int(float64(ch)*target + 0.5)
+	} else {
+		ch = int(float64(cw)/target + 0.5)
+	}
+	if cw < 1 || ch < 1 {
+		return img
+	}
+
+	x0 := bounds.Min.X + (bounds.Dx()-cw)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-ch)/2
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(image.Rect(x0, y0, x0+cw, y0+ch))
+	}
+	return img
+}
+
+// fitImage scales a decoded image into width x height, either fitting it
+// inside (contain) or filling the box and cropping the overflow (cover).
+// A zero width or height leaves that side unbounded. Images are never
+// enlarged. Orientation is applied last so only the small result is rotated
+func fitImage(img image.Image, orientation, width, height int, cover bool) image.Image {
+	if orientation >= 5 {
+		width, height = height, width
+	}
+	if cover && width > 0 && height > 0 {
+		img = cropToAspect(img, width, height)
+	}
+
+	bounds := img.Bounds()
+	if width <= 0 {
+		width = bounds.Dx()
+	}
+	if height <= 0 {
+		height = bounds.Dy()
+	}
+	if bounds.Dx() > width || bounds.Dy() > height {
+		img = resizeImage(img, width, height)
+	}
+	return applyOrientation(img, orientation)
+}
+
+// decodeImageFile decodes an image along with its EXIF orientation
+func decodeImageFile(path string) (image.Image, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	img, format, err := image.Decode(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = exifOrientation(path)
+	}
+	return img, orientation, nil
+}
+
+// writeJPEG encodes an image onto a white background, so transparent areas
+// don't turn black, and moves it into place once fully written
+func writeJPEG(path string, img image.Image) error {
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*.jpg")
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(tmp, flat, &jpeg.Options{Quality: 85}); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to encode JPEG: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// generateImageThumbnail stores an upright copy of an image scaled to fit
+// 400x400 as its thumbnail
+func generateImageThumbnail(imagePath, uploadDir, filename string) error {
+	img, orientation, err := decodeImageFile(imagePath)
+	if err != nil {
+		// The standard library has no WebP decoder, but ffmpeg can read it
+		if strings.EqualFold(filepath.Ext(filename), ".webp") {
+			return generateThumbnailAtTime(imagePath, uploadDir, filename, "00:00:00")
+		}
+		return fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	thumbDir := filepath.Join(uploadDir, "thumbnails")
+	if err := os.MkdirAll(thumbDir, 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnails directory: %v", err)
+	}
+	return writeJPEG(filepath.Join(thumbDir, filename+".jpg"), fitImage(img, orientation, 400, 400, false))
+}
+
+// imageHandler serves /img/{id}?w=&h=&fit=, a resized JPEG of an image file.
+// fit=cover fills the whole box and needs both w and h; the default contain
+// fits the image inside it. Results are cached under cache/img
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	fileID, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(r.URL.Path, "/img/"), "/"))
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	var filename, path string
+	if err := db.QueryRow("SELECT filename, path FROM files WHERE id = ?", fileID).Scan(&filename, &path); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !isImageFile(filename) {
+		http.Error(w, "Not an image", http.StatusBadRequest)
+		return
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(config.UploadDir, path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	q := r.URL.Query()
+	width, height := snapVariantSize(q.Get("w")), snapVariantSize(q.Get("h"))
+	if width == 0 && height == 0 {
+		http.ServeFile(w, r, path)
+		return
+	}
+	fit := "contain"
+	if q.Get("fit") == "cover" && width > 0 && height > 0 {
+		fit = "cover"
+	}
+
+	etag := fmt.Sprintf(`"%x-%x-w%d-h%d-%s"`, info.ModTime().UnixNano(), info.Size(), width, height, fit)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	if match := r.Header.Get("If-None-Match"); match != "" && strings.Contains(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	dir := filepath.Join(config.UploadDir, "cache", "img")
+	variantPath := filepath.Join(dir, fmt.Sprintf("%d-%x-w%d-h%d-%s.jpg", fileID, info.ModTime().UnixNano(), width, height, fit))
+	if _, err := os.Stat(variantPath); err != nil {
+		if err := buildImageVariant(path, variantPath, fileID, info, width, height, fit == "cover"); err != nil {
+			// Fall back to the original rather than failing the request
+			log.Printf("Warning: imageHandler: failed to resize file id=%d: %v", fileID, err)
+			w.Header().Del("ETag")
+			http.ServeFile(w, r, path)
+			return
+		}
+	}
+	http.ServeFile(w, r, variantPath)
+}
+
+// buildImageVariant resizes an image into the variant cache, removing
+// variants left over from older versions of the file
+func buildImageVariant(imagePath, variantPath string, fileID int, info os.FileInfo, width, height int, cover bool) error {
+	img, orientation, err := decodeImageFile(imagePath)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(variantPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %v", err)
+	}
+	if err := writeJPEG(variantPath, fitImage(img, orientation, width, height, cover)); err != nil {
+		return err
+	}
+
+	removeStaleVariants(dir, fileID, info)
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxJobHistory bounds how many finished jobs are kept for the jobs page
+const maxJobHistory = 200
+
+// jobFunc does the work for one job; it returns the file it produced (if any)
+// and an optional message to show on the jobs page
+type jobFunc func() (int64, string, error)
+
+type jobEntry struct {
+	Job
+	run jobFunc
+}
+
+var jobQueue = struct {
+	sync.Mutex
+	jobs   []*jobEntry
+	nextID int
+	wake   chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+// enqueueJob adds work to the background queue and returns its ID
+func enqueueJob(kind, label string, run jobFunc) int {
+	jobQueue.Lock()
+	jobQueue.nextID++
+	entry := &jobEntry{
+		Job: Job{
+			ID:      jobQueue.nextID,
+			Kind:    kind,
+			Label:   label,
+			Status:  "queued",
+			Created: time.Now(),
+		},
+		run: run,
+	}
+	jobQueue.jobs = append(jobQueue.jobs, entry)
+	jobQueue.Unlock()
+
+	select {
+	case jobQueue.wake <- struct{}{}:
+	default:
+	}
+	return entry.ID
+}
+
+// nextQueuedJob marks the oldest queued job as running and returns it
+func nextQueuedJob() *jobEntry {
+	jobQueue.Lock()
+	defer jobQueue.Unlock()
+	for _, entry := range jobQueue.jobs {
+		if entry.Status == "queued" {
+			entry.Status = "running"
+			return entry
+		}
+	}
+	return nil
+}
+
+// finishJob records a job's outcome and trims old finished jobs
+func finishJob(entry *jobEntry, fileID int64, message string, err error) {
+	jobQueue.Lock()
+	defer jobQueue.Unlock()
+
+	entry.FileID = fileID
+	entry.Message = message
+	entry.Finished = time.Now()
+	if err != nil {
+		entry.Status = "failed"
+		entry.Message = err.Error()
+	} else {
+		entry.Status = "done"
+	}
+	entry.run = nil
+
+	for len(jobQueue.jobs) > maxJobHistory {
+		if s := jobQueue.jobs[0].Status; s == "queued" || s == "running" {
+			break
+		}
+		jobQueue.jobs = jobQueue.jobs[1:]
+	}
+}
+
+// startJobWorker processes queued jobs one at a time in the background
+func startJobWorker() {
+	go func() {
+		for {
+			entry := nextQueuedJob()
+			if entry == nil {
+				<-jobQueue.wake
+				continue
+			}
+
+			fileID, message, err := runJob(entry)
+			if err != nil {
+				log.Printf("Error: job %d (%s %s) failed: %v", entry.ID, entry.Kind, entry.Label, err)
+			}
+			finishJob(entry, fileID, message, err)
+		}
+	}()
+}
+
+// runJob shields the worker from a panicking job
+func runJob(entry *jobEntry) (fileID int64, message string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return entry.run()
+}
+
+// listJobs returns a snapshot of all known jobs, newest first
+func listJobs() []Job {
+	jobQueue.Lock()
+	defer jobQueue.Unlock()
+
+	jobs := make([]Job, 0, len(jobQueue.jobs))
+	for i := len(jobQueue.jobs) - 1; i >= 0; i-- {
+		jobs = append(jobs, jobQueue.jobs[i].Job)
+	}
+	return jobs
+}
+
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	playlists, err := listPlaylists()
+	if err != nil {
+		log.Printf("Warning: jobsHandler: failed to list playlists: %v", err)
+	}
+
+	jobs := listJobs()
+	active := 0
+	for _, j := range jobs {
+		if j.Status == "queued" || j.Status == "running" {
+			active++
+		}
+	}
+
+	pageData := buildPageData("Jobs", JobsPageData{Notice: r.URL.Query().Get("warning"), Jobs: jobs, Active: active, Playlists: playlists})
+	renderTemplate(w, "jobs.html", pageData)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// largeTextSize is the size above which the text viewer pages through a
+	// file with /lines instead of downloading it whole
+	largeTextSize = 4 << 20
+	// lineIndexStride is how many lines apart the indexed offsets are
+	lineIndexStride = 1024
+	// lineIndexEntries caps how many files' line indexes are cached
+	lineIndexEntries = 16
+	// maxLinesPerRequest caps the lines one /lines request returns
+	maxLinesPerRequest = 2000
+	// maxGrepMatches caps the matches one /grep request returns
+	maxGrepMatches = 500
+	// maxLineBytes truncates very long lines, such as minified files
+	maxLineBytes = 64 << 10
+)
+
+// lineIndex records the byte offset of every lineIndexStride-th line of a
+// file, valid while its modification time and size are unchanged
+type lineIndex struct {
+	path    string
+	modTime time.Time
+	size    int64
+	lines   int
+	offsets []int64 // offsets[k] is where line k*lineIndexStride+1 starts
+}
+
+// lineIndexBuild is an index being built, which other requests for the
+// same file version wait on instead of reading the file again
+type lineIndexBuild struct {
+	modTime time.Time
+	size    int64
+	done    chan struct{}
+	idx     *lineIndex
+	err     error
+}
+
+var lineIndexCache = struct {
+	sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List // most recently used at the front
+	building map[string]*lineIndexBuild
+}{
+	entries:  make(map[string]*list.Element),
+	lru:      list.New(),
+	building: make(map[string]*lineIndexBuild),
+}
+
+// getLineIndex returns the line index of a file, building it when the file
+// is not cached or has changed on disk
+func getLineIndex(path string) (*lineIndex, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lineIndexCache.Lock()
+	if el, ok := lineIndexCache.entries[path]; ok {
+		idx := el.Value.(*lineIndex)
+		if idx.modTime.Equal(info.ModTime()) && idx.size == info.Size() {
+			lineIndexCache.lru.MoveToFront(el)
+			lineIndexCache.Unlock()
+			return idx, nil
+		}
+		lineIndexCache.lru.Remove(el)
+		delete(lineIndexCache.entries, path)
+	}
+	if b, ok := lineIndexCache.building[path]; ok && b.modTime.Equal(info.ModTime()) && b.size == info.Size() {
+		lineIndexCache.Unlock()
+		<-b.done
+		return b.idx, b.err
+	}
+	b := &lineIndexBuild{modTime: info.ModTime(), size: info.Size(), done: make(chan struct{})}
+	lineIndexCache.building[path] = b
+	lineIndexCache.Unlock()
+
+	b.idx, b.err = buildLineIndex(path, info)
+
+	lineIndexCache.Lock()
+	if lineIndexCache.building[path] == b {
+		delete(lineIndexCache.building, path)
+	}
+	if b.err == nil {
+		if el, ok := lineIndexCache.entries[path]; ok {
+			lineIndexCache.lru.Remove(el)
+		}
+		lineIndexCache.entries[path] = lineIndexCache.lru.PushFront(b.idx)
+		for lineIndexCache.lru.Len() > lineIndexEntries {
+			el := lineIndexCache.lru.Back()
+			lineIndexCache.lru.Remove(el)
+			delete(lineIndexCache.entries, el.Value.(*lineIndex).path)
+		}
+	}
+	lineIndexCache.Unlock()
+	close(b.done)
+	return b.idx, b.err
+}
+
+func buildLineIndex(path string, info os.FileInfo) (*lineIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	idx := &lineIndex{path: path, modTime: info.ModTime(), size: info.Size(), offsets: []int64{0}}
+	buf := make([]byte, 1<<20)
+	var pos int64
+	newlines := 0
+	lastByte := byte('\n')
+	for {
+		n, err := f.Read(buf)
+		chunk := buf[:n]
+		for {
+			i := bytes.IndexByte(chunk, '\n')
+			if i < 0 {
+				break
+			}
+			newlines++
+			if newlines%lineIndexStride == 0 {
+				idx.offsets = append(idx.offsets, pos+int64(n-len(chunk)+i+1))
+			}
+			chunk = chunk[i+1:]
+		}
+		if n > 0 {
+			lastByte = buf[n-1]
+		}
+		pos += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A final line without a newline still counts; a trailing newline does
+	// not start another line
+	idx.lines = newlines
+	if lastByte != '\n' {
+		idx.lines++
+	}
+	if len(idx.offsets) > 1 && idx.offsets[len(idx.offsets)-1] == pos {
+		idx.offsets = idx.offsets[:len(idx.offsets)-1]
+	}
+	return idx, nil
+}
+
+// openAtLine opens a file positioned at the start of line n (1-based)
+func openAtLine(idx *lineIndex, n int) (*os.File, *bufio.Reader, error) {
+	f, err := os.Open(idx.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	k := min((n-1)/lineIndexStride, len(idx.offsets)-1)
+	if _, err := f.Seek(idx.offsets[k], io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	br := bufio.NewReaderSize(f, 256<<10)
+	for line := k*lineIndexStride + 1; line < n; line++ {
+		if _, err := readTextLine(br); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	return f, br, nil
+}
+
+// readTextLine reads one line without its line ending, keeping at most
+// maxLineBytes of it
+func readTextLine(br *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(line) < maxLineBytes {
+			line = append(line, chunk[:min(len(chunk), maxLineBytes-len(line))]...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(chunk) > 0 {
+			err = nil
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	return strings.ToValidUTF8(string(line), "�"), nil
+}
+
+// textFileForLines looks up a text file for the /lines and /grep endpoints
+// and returns its line index
+func textFileForLines(parts []string) (File, *lineIndex, int, error) {
+	var f File
+	err := db.QueryRow("SELECT id, filename, path FROM files WHERE id = ?", parts[2]).Scan(&f.ID, &f.Filename, &f.Path)
+	if err != nil {
+		return f, nil, http.StatusNotFound, fmt.Errorf("file not found")
+	}
+	if !isTextFile(f.Filename) {
+		return f, nil, http.StatusBadRequest, fmt.Errorf("only text files can be read by line")
+	}
+	idx, err := getLineIndex(filepath.Join(config.UploadDir, f.Path))
+	if err != nil {
+		log.Printf("Error: textFileForLines: failed to index lines of file id=%d: %v", f.ID, err)
+		return f, nil, http.StatusInternalServerError, err
+	}
+	return f, idx, http.StatusOK, nil
+}
+
+// fileLinesHandler serves /file/{id}/lines?from=&to=, the 1-based inclusive
+// range of a text file's lines, so large files can be paged through
+func fileLinesHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	_, idx, status, err := textFileForLines(parts)
+	if err != nil {
+		respondJSON(w, status, map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+
+	from, _ := strconv.Atoi(r.URL.Query().Get("from"))
+	from = max(from, 1)
+	to, err := strconv.Atoi(r.URL.Query().Get("to"))
+	if err != nil {
+		to = from + 499
+	}
+	to = min(to, from+maxLinesPerRequest-1, idx.lines)
+
+	lines := []string{}
+	if from <= to {
+		f, br, err := openAtLine(idx, from)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "error": err.Error()})
+			return
+		}
+		defer f.Close()
+		for n := from; n <= to; n++ {
+			line, err := readTextLine(br)
+			if err != nil {
+				break
+			}
+			lines = append(lines, line)
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"from":    from,
+		"to":      from + len(lines) - 1,
+		"total":   idx.lines,
+		"size":    idx.size,
+		"lines":   lines,
+	})
+}
+
+// fileGrepHandler serves /file/{id}/grep?q=&from=&limit=, the lines of a text
+// file matching q (with the * and ? wildcards of search) from line from on.
+// When the limit is reached, next is the line to continue from
+func fileGrepHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	_, idx, status, err := textFileForLines(parts)
+	if err != nil {
+		respondJSON(w, status, map[string]interface{}{"success": false, "error": err.Error()})
+		return
+	}
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "error": "Missing search query"})
+		return
+	}
+	from, _ := strconv.Atoi(r.URL.Query().Get("from"))
+	from = max(from, 1)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	limit = min(limit, maxGrepMatches)
+
+	type grepMatch struct {
+		Line   int    `json:"line"`
+		Before string `json:"before"`
+		Match  string `json:"match"`
+		After  string `json:"after"`
+	}
+	matches := []grepMatch{}
+	next := 0
+	if from <= idx.lines {
+		file, br, err := openAtLine(idx, from)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, map[string]interface{}{"success": false, "error": err.Error()})
+			return
+		}
+		defer file.Close()
+
+		re := searchPatternRegexp(query)
+		for n := from; n <= idx.lines; n++ {
+			if r.Context().Err() != nil {
+				return
+			}
+			line, err := readTextLine(br)
+			if err != nil {
+				break
+			}
+			loc := re.FindStringIndex(line)
+			if loc == nil || loc[0] == loc[1] {
+				continue
+			}
+			if len(matches) == limit {
+				next = n
+				break
+			}
+			m := newTextMatch("", "", line, loc)
+			matches = append(matches, grepMatch{Line: n, Before: m.Before, Match: m.Match, After: m.After})
+		}
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "matches": matches, "next": next, "total": idx.lines})
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A small Markdown renderer covering CommonMark's common blocks plus GitHub
+// tables, task lists and strikethrough. Raw HTML in the source is escaped
+// rather than passed through, and links are limited to safe schemes, so the
+// output can be inserted into the page as-is. Block elements carry the
+// source line they start on in data-line for line jumps
+
+var (
+	mdHeading     = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdRule        = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdFence       = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`]*)$")
+	mdListItem    = regexp.MustCompile(`^( {0,3})([-*+]|\d{1,9}[.)])([ \t]+|$)`)
+	mdTableDelim  = regexp.MustCompile(`^ {0,3}\|?[ \t]*:?-+:?[ \t]*(\|[ \t]*:?-+:?[ \t]*)*\|?[ \t]*$`)
+	mdSetext      = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	mdTask        = regexp.MustCompile(`^\[([ xX])\][ \t]+`)
+	mdHeadingSlug = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// renderMarkdown converts a Markdown document to sanitised HTML
+func renderMarkdown(src string) string {
+	src = strings.ReplaceAll(strings.ReplaceAll(src, "\r\n", "\n"), "\t", "    ")
+	var b strings.Builder
+	renderMarkdownBlocks(&b, strings.Split(src, "\n"), 1, false)
+	return b.String()
+}
+
+// renderMarkdownBlocks renders lines whose first line is source line first.
+// In tight lists paragraphs are written without <p>
+func renderMarkdownBlocks(b *strings.Builder, lines []string, first int, tight bool) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		lineNo := first + i
+
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			indent, fence := len(m[1]), m[2]
+			var code []string
+			i++
+			for i < len(lines) {
+				trimmed := strings.TrimSpace(lines[i])
+				if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+					i++
+					break
+				}
+				code = append(code, trimLeadingSpaces(lines[i], indent))
+				i++
+			}
+			lang := languageForFence(m[3])
+			fmt.Fprintf(b, `<pre class="code-view" data-line="%d"><code>`, lineNo)
+			for n, hl := range highlightLines(strings.Join(code, "\n"), lang) {
+				fmt.Fprintf(b, `<span class="code-line" data-line="%d">%s</span>`+"\n", lineNo+1+n, hl)
+			}
+			b.WriteString("</code></pre>\n")
+
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			writeMarkdownHeading(b, len(m[1]), m[2], lineNo)
+			i++
+
+		case mdRule.MatchString(line):
+			fmt.Fprintf(b, "<hr data-line=\"%d\">\n", lineNo)
+			i++
+
+		case strings.HasPrefix(strings.TrimLeft(line, " "), ">"):
+			var quoted []string
+			for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+				l := strings.TrimLeft(lines[i], " ")
+				if strings.HasPrefix(l, ">") {
+					l = strings.TrimPrefix(strings.TrimPrefix(l, ">"), " ")
+				}
+				quoted = append(quoted, l)
+				i++
+			}
+			fmt.Fprintf(b, "<blockquote data-line=\"%d\">\n", lineNo)
+			renderMarkdownBlocks(b, quoted, lineNo, false)
+			b.WriteString("</blockquote>\n")
+
+		case mdListItem.MatchString(line):
+			i = renderMarkdownList(b, lines, i, first)
+
+		case strings.HasPrefix(line, "    "):
+			var code []string
+			for i < len(lines) && (strings.HasPrefix(lines[i], "    ") || strings.TrimSpace(lines[i]) == "") {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+				i++
+			}
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			fmt.Fprintf(b, `<pre class="code-view" data-line="%d"><code>`, lineNo)
+			for n, hl := range highlightLines(strings.Join(code, "\n"), nil) {
+				fmt.Fprintf(b, `<span class="code-line" data-line="%d">%s</span>`+"\n", lineNo+n, hl)
+			}
+			b.WriteString("</code></pre>\n")
+
+		case i+1 < len(lines) && strings.Contains(line, "|") && mdTableDelim.MatchString(lines[i+1]) &&
+			strings.Contains(lines[i+1], "-"):
+			i = renderMarkdownTable(b, lines, i, first)
+
+		default:
+			var para []string
+			for i < len(lines) && strings.TrimSpace(lines[i]) != "" {
+				if len(para) > 0 && mdSetext.MatchString(lines[i]) {
+					level := 2
+					if strings.Contains(lines[i], "=") {
+						level = 1
+					}
+					writeMarkdownHeading(b, level, strings.Join(para, "\n"), lineNo)
+					para = nil
+					i++
+					break
+				}
+				if len(para) > 0 && startsMarkdownBlock(lines[i]) {
+					break
+				}
+				para = append(para, strings.TrimLeft(lines[i], " "))
+				i++
+			}
+			if len(para) == 0 {
+				continue
+			}
+			if tight {
+				fmt.Fprintf(b, "%s\n", renderMarkdownInline(strings.Join(para, "\n")))
+			} else {
+				fmt.Fprintf(b, "<p data-line=\"%d\">%s</p>\n", lineNo, renderMarkdownInline(strings.Join(para, "\n")))
+			}
+		}
+	}
+}
+
+// startsMarkdownBlock reports whether a line interrupts a paragraph
+func startsMarkdownBlock(line string) bool {
+	return mdFence.MatchString(line) || mdHeading.MatchString(line) || mdRule.MatchString(line) ||
+		strings.HasPrefix(strings.TrimLeft(line, " "), ">") || mdListItem.MatchString(line)
+}
+
+func trimLeadingSpaces(s string, n int) string {
+	for n > 0 && strings.HasPrefix(s, " ") {
+		s = s[1:]
+		n--
+	}
+	return s
+}
+
+func writeMarkdownHeading(b *strings.Builder, level int, text string, lineNo int) {
+	slug := strings.Trim(mdHeadingSlug.ReplaceAllString(strings.ToLower(text), "-"), "-")
+	fmt.Fprintf(b, "<h%d id=\"%s\" data-line=\"%d\">%s</h%d>\n", level, slug, lineNo, renderMarkdownInline(text), level)
+}
+
+// renderMarkdownList renders the list starting at lines[start] and returns
+// the index of the first line after it. Lines indented under an item belong
+// to it and may hold nested lists
+func renderMarkdownList(b *strings.Builder, lines []string, start, first int) int {
+	m := mdListItem.FindStringSubmatch(lines[start])
+	ordered := m[2][0] >= '0' && m[2][0] <= '9'
+	marker := m[2][len(m[2])-1:]
+
+	if ordered {
+		if n := strings.TrimLeft(m[2][:len(m[2])-1], "0"); n != "" && n != "1" {
+			fmt.Fprintf(b, "<ol start=\"%s\" data-line=\"%d\">\n", n, first+start)
+		} else {
+			fmt.Fprintf(b, "<ol data-line=\"%d\">\n", first+start)
+		}
+	} else {
+		fmt.Fprintf(b, "<ul data-line=\"%d\">\n", first+start)
+	}
+
+	// continues reports whether a line starts another item of this list
+	continues := func(line string) bool {
+		m := mdListItem.FindStringSubmatch(line)
+		return m != nil && m[2][len(m[2])-1:] == marker && (m[2][0] >= '0' && m[2][0] <= '9') == ordered
+	}
+
+	type item struct {
+		line  int
+		lines []string
+	}
+	var items []item
+	loose := false
+	i := start
+	for i < len(lines) {
+		if !continues(lines[i]) {
+			break
+		}
+		m := mdListItem.FindStringSubmatch(lines[i])
+		width := len(m[0])
+		if m[3] == "" || len(m[3]) > 4 {
+			width = len(m[1]) + len(m[2]) + 1
+		}
+		it := item{line: first + i, lines: []string{lines[i][min(width, len(lines[i])):]}}
+		i++
+
+		for i < len(lines) {
+			l := lines[i]
+			if strings.TrimSpace(l) == "" {
+				// A blank line continues the item only if indented content follows
+				j := i
+				for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+					j++
+				}
+				if j < len(lines) && len(lines[j])-len(strings.TrimLeft(lines[j], " ")) >= width {
+					loose = true
+					for ; i < j; i++ {
+						it.lines = append(it.lines, "")
+					}
+					continue
+				}
+				if j < len(lines) && continues(lines[j]) {
+					loose = true
+				}
+				break
+			}
+			indent := len(l) - len(strings.TrimLeft(l, " "))
+			if indent >= width {
+				it.lines = append(it.lines, l[width:])
+			} else if !startsMarkdownBlock(l) && !mdListItem.MatchString(l) {
+				// Lazy continuation of the item's paragraph
+				it.lines = append(it.lines, strings.TrimLeft(l, " "))
+			} else {
+				break
+			}
+			i++
+		}
+		items = append(items, it)
+
+		// Skip blank lines between items
+		for i < len(lines) && strings.TrimSpace(lines[i]) == "" {
+			j := i
+			for j < len(lines) && strings.TrimSpace(lines[j]) == "" {
+				j++
+			}
+			if j < len(lines) && continues(lines[j]) {
+				i = j
+			} else {
+				break
+			}
+		}
+	}
+
+	for _, it := range items {
+		content := it.lines
+		checkbox := ""
+		if tm := mdTask.FindStringSubmatch(content[0]); tm != nil {
+			checked := ""
+			if tm[1] != " " {
+				checked = " checked"
+			}
+			checkbox = fmt.Sprintf(`<input type="checkbox" disabled%s> `, checked)
+			content = append([]string{content[0][len(tm[0]):]}, content[1:]...)
+		}
+		fmt.Fprintf(b, "<li data-line=\"%d\">%s", it.line, checkbox)
+		renderMarkdownBlocks(b, content, it.line, !loose)
+		b.WriteString("</li>\n")
+	}
+
+	if ordered {
+		b.WriteString("</ol>\n")
+	} else {
+		b.WriteString("</ul>\n")
+	}
+	return i
+}
+
+// renderMarkdownTable renders a GitHub table whose header is lines[start]
+// and returns the index of the first line after it
+func renderMarkdownTable(b *strings.Builder, lines []string, start, first int) int {
+	splitRow := func(row string) []string {
+		row = strings.TrimSpace(row)
+		row = strings.TrimSuffix(strings.TrimPrefix(row, "|"), "|")
+		var cells []string
+		var cell strings.Builder
+		inCode := false
+		for i := 0; i < len(row); i++ {
+			switch {
+			case row[i] == '\\' && i+1 < len(row) && row[i+1] == '|':
+				cell.WriteByte('|')
+				i++
+			case row[i] == '`':
+				inCode = !inCode
+				cell.WriteByte('`')
+			case row[i] == '|' && !inCode:
+				cells = append(cells, strings.TrimSpace(cell.String()))
+				cell.Reset()
+			default:
+				cell.WriteByte(row[i])
+			}
+		}
+		return append(cells, strings.TrimSpace(cell.String()))
+	}
+
+	var aligns []string
+	for _, d := range splitRow(lines[start+1]) {
+		switch {
+		case strings.HasPrefix(d, ":") && strings.HasSuffix(d, ":"):
+			aligns = append(aligns, "center")
+		case strings.HasSuffix(d, ":"):
+			aligns = append(aligns, "right")
+		case strings.HasPrefix(d, ":"):
+			aligns = append(aligns, "left")
+		default:
+			aligns = append(aligns, "")
+		}
+	}
+	writeRow := func(cells []string, tag string, lineNo int) {
+		fmt.Fprintf(b, "<tr data-line=\"%d\">", lineNo)
+		for c := range aligns {
+			text := ""
+			if c < len(cells) {
+				text = cells[c]
+			}
+			if aligns[c] != "" {
+				fmt.Fprintf(b, "<%s style=\"text-align:%s\">%s</%s>", tag, aligns[c], renderMarkdownInline(text), tag)
+			} else {
+				fmt.Fprintf(b, "<%s>%s</%s>", tag, renderMarkdownInline(text), tag)
+			}
+		}
+		b.WriteString("</tr>\n")
+	}
+
+	fmt.Fprintf(b, "<table data-line=\"%d\">\n<thead>\n", first+start)
+	writeRow(splitRow(lines[start]), "th", first+start)
+	b.WriteString("</thead>\n<tbody>\n")
+	i := start + 2
+	for i < len(lines) && strings.TrimSpace(lines[i]) != "" && !startsMarkdownBlock(lines[i]) {
+		writeRow(splitRow(lines[i]), "td", first+i)
+		i++
+	}
+	b.WriteString("</tbody>\n</table>\n")
+	return i
+}
+
+// safeMarkdownURL returns the URL escaped for an attribute, or "" when its
+// scheme could run script or isn't allowed for the element
+func safeMarkdownURL(raw string, image bool) string {
+	raw = strings.TrimSpace(raw)
+	if colon := strings.IndexByte(raw, ':'); colon >= 0 && !strings.ContainsAny(raw[:colon], "/?#") {
+		scheme := strings.ToLower(raw[:colon])
+		if scheme != "http" && scheme != "https" && (image || scheme != "mailto") {
+			return ""
+		}
+	}
+	return html.EscapeString(raw)
+}
+
+const (
+	// maxMarkdownNesting caps how deeply emphasis nests; deeper delimiters
+	// are written as they are
+	maxMarkdownNesting = 32
+	// maxMarkdownLink caps the length of a link, so an unclosed bracket
+	// is not followed to the end of the block
+	maxMarkdownLink = 2048
+)
+
+// markdownDelimiters are the emphasis delimiter runs: "*" and "_" for <em>,
+// doubled for <strong>, and "~~" for <del>
+var markdownDelimiters = []string{"*", "**", "_", "__", "~~"}
+
+// markdownInline is a block's text with the positions of every delimiter run
+// that could close emphasis, found in one pass so an opener looks up its
+// closer instead of scanning the rest of the block
+type markdownInline struct {
+	s       string
+	closers map[string][]int // ascending positions by delimiter
+}
+
+// renderMarkdownInline renders emphasis, code spans, links and images within
+// a block. Everything else is escaped
+func renderMarkdownInline(s string) string {
+	p := markdownInline{s: s, closers: make(map[string][]int)}
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		if c != '*' && c != '_' && c != '~' {
+			continue
+		}
+		for _, delim := range markdownDelimiters {
+			if delim[0] == c && p.canClose(j, delim) {
+				p.closers[delim] = append(p.closers[delim], j)
+			}
+		}
+	}
+	var b strings.Builder
+	p.render(&b, 0, len(s), 0)
+	return b.String()
+}
+
+// canClose reports whether the delimiter run at s[j] could close emphasis
+func (p *markdownInline) canClose(j int, delim string) bool {
+	s, c, run := p.s, delim[0], len(delim)
+	if !strings.HasPrefix(s[j:], delim) || s[j-1] == '\\' || s[j-1] == ' ' || s[j-1] == '\n' {
+		return false
+	}
+	// A single delimiter must not be half of a double one
+	if run == 1 && (s[j-1] == c || j+1 < len(s) && s[j+1] == c) {
+		return false
+	}
+	// Intraword underscores, as in snake_case, are literal
+	return c != '_' || j+run >= len(s) || !isIdentChar(s[j+run])
+}
+
+// render writes s[from:to], treating to as the end of the text
+func (p *markdownInline) render(b *strings.Builder, from, to, depth int) {
+	s := p.s[:to]
+	for i := from; i < len(s); {
+		c := s[i]
+		rest := s[i:]
+
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!|~<>\"'", s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			continue
+
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br>\n")
+			i += 2
+			continue
+
+		case c == ' ' && strings.HasPrefix(rest, "  \n"):
+			b.WriteString("<br>\n")
+			i += 3
+			continue
+
+		case c == '`':
+			run := len(rest) - len(strings.TrimLeft(rest, "`"))
+			fence := rest[:run]
+			if end := strings.Index(rest[run:], fence); end >= 0 {
+				code := rest[run : run+end]
+				if t := strings.TrimSpace(code); t != "" {
+					code = t
+				}
+				b.WriteString("<code>" + html.EscapeString(strings.ReplaceAll(code, "\n", " ")) + "</code>")
+				i += run + end + run
+			} else {
+				b.WriteString(fence)
+				i += run
+			}
+			continue
+
+		case c == '!' && strings.HasPrefix(rest, "!["):
+			if text, dest, n := parseMarkdownLink(rest[1:]); n > 0 {
+				if src := safeMarkdownURL(dest, true); src != "" {
+					fmt.Fprintf(b, `<img src="%s" alt="%s" loading="lazy">`, src, html.EscapeString(text))
+				} else {
+					b.WriteString(html.EscapeString(text))
+				}
+				i += 1 + n
+				continue
+			}
+
+		case c == '[':
+			if text, dest, n := parseMarkdownLink(rest); n > 0 {
+				if href := safeMarkdownURL(dest, false); href != "" {
+					fmt.Fprintf(b, `<a href="%s" rel="nofollow noopener">%s</a>`, href, renderMarkdownInline(text))
+				} else {
+					b.WriteString(renderMarkdownInline(text))
+				}
+				i += n
+				continue
+			}
+
+		case c == '<':
+			// Autolinks hold no spaces, so the search stops at the first one
+			if end := strings.IndexAny(rest[1:], " <>\n") + 1; end > 0 && rest[end] == '>' {
+				target := rest[1:end]
+				if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+					href := html.EscapeString(target)
+					fmt.Fprintf(b, `<a href="%s" rel="nofollow noopener">%s</a>`, href, href)
+					i += end + 1
+					continue
+				}
+			}
+
+		case c == '*' || c == '_' || c == '~':
+			if n, ok := p.emphasis(b, i, to, depth); ok {
+				i = n
+				continue
+			}
+		}
+
+		b.WriteString(html.EscapeString(s[i : i+1]))
+		i++
+	}
+}
+
+// emphasis writes the emphasis opening at s[i] and closed before to, and
+// returns the index after its closing delimiter, or false if it isn't closed
+func (p *markdownInline) emphasis(b *strings.Builder, i, to, depth int) (int, bool) {
+	s := p.s
+	c := s[i]
+	run := 1
+	if i+1 < to && s[i+1] == c {
+		run = 2
+	}
+	if c == '~' && run != 2 || depth >= maxMarkdownNesting {
+		return 0, false
+	}
+	// Intraword underscores, as in snake_case, are literal
+	if c == '_' && i > 0 && isIdentChar(s[i-1]) {
+		return 0, false
+	}
+	open := i + run
+	if open >= to || s[open] == ' ' || s[open] == '\n' {
+		return 0, false
+	}
+
+	closers := p.closers[s[i:open]]
+	k := sort.SearchInts(closers, open+1)
+	if k == len(closers) || closers[k]+run > to {
+		return 0, false
+	}
+	end := closers[k]
+	tag := map[int]string{1: "em", 2: "strong"}[run]
+	if c == '~' {
+		tag = "del"
+	}
+	fmt.Fprintf(b, "<%s>", tag)
+	p.render(b, open, end, depth+1)
+	fmt.Fprintf(b, "</%s>", tag)
+	return end + run, true
+}
+
+// parseMarkdownLink reads "[text](destination "title")" at the start of s and
+// returns the text, destination and length consumed, or 0 if s isn't a link
+func parseMarkdownLink(s string) (string, string, int) {
+	if len(s) > maxMarkdownLink {
+		s = s[:maxMarkdownLink]
+	}
+	depth := 0
+	closeText := -1
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth == 0 {
+				closeText = i
+			}
+		}
+		if closeText >= 0 {
+			break
+		}
+	}
+	if closeText < 0 || closeText+1 >= len(s) || s[closeText+1] != '(' {
+		return "", "", 0
+	}
+	// The destination may hold balanced parentheses
+	end, depth := -1, 1
+	for i := closeText + 2; i < len(s) && end < 0; i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				end = i - closeText - 2
+			}
+		}
+	}
+	if end < 0 {
+		return "", "", 0
+	}
+	dest := strings.TrimSpace(s[closeText+2 : closeText+2+end])
+	// Drop an optional title
+	if sp := strings.IndexAny(dest, " \n"); sp >= 0 {
+		dest = dest[:sp]
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+	return s[1:closeText], dest, closeText + 2 + end + 1
+}
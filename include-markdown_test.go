@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderMarkdownSafety(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"javascript link", "[x](javascript:alert(1))", `<p data-line="1">x</p>` + "\n"},
+		{"mixed case scheme", "[x](JavaScript:alert(1))", `<p data-line="1">x</p>` + "\n"},
+		{"leading space scheme", "[x]( javascript:alert(1))", `<p data-line="1">x</p>` + "\n"},
+		{"data image", "![i](data:image/png;base64,AAA)", `<p data-line="1">i</p>` + "\n"},
+		{"mailto image", "![i](mailto:a@b.c)", `<p data-line="1">i</p>` + "\n"},
+		{"javascript autolink", "<javascript:alert(1)>", `<p data-line="1">&lt;javascript:alert(1)&gt;</p>` + "\n"},
+		{"raw html", "<script>alert(1)</script>", `<p data-line="1">&lt;script&gt;alert(1)&lt;/script&gt;</p>` + "\n"},
+		{"quote in href", `[x]("onmouseover=alert(1))`, `<p data-line="1"><a href="&#34;onmouseover=alert(1)" rel="nofollow noopener">x</a></p>` + "\n"},
+		{"quote in alt", `![a"b](https://e.com/i.png)`, `<p data-line="1"><img src="https://e.com/i.png" alt="a&#34;b" loading="lazy"></p>` + "\n"},
+		{"html in code", "`<b>`", `<p data-line="1"><code>&lt;b&gt;</code></p>` + "\n"},
+		{"html in table", "| <b> |\n|---|\n| x |", "<table data-line=\"1\">\n<thead>\n<tr data-line=\"1\"><th>&lt;b&gt;</th></tr>\n</thead>\n<tbody>\n<tr data-line=\"3\"><td>x</td></tr>\n</tbody>\n</table>\n"},
+		{"https link", "[x](https://e.com/a?b=1&c=2)", `<p data-line="1"><a href="https://e.com/a?b=1&amp;c=2" rel="nofollow noopener">x</a></p>` + "\n"},
+		{"mailto link", "[m](mailto:a@b.c)", `<p data-line="1"><a href="mailto:a@b.c" rel="nofollow noopener">m</a></p>` + "\n"},
+		{"relative link", "[r](notes/a.md)", `<p data-line="1"><a href="notes/a.md" rel="nofollow noopener">r</a></p>` + "\n"},
+		{"autolink", "<https://e.com/a>", `<p data-line="1"><a href="https://e.com/a" rel="nofollow noopener">https://e.com/a</a></p>` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderMarkdown(tt.src); got != tt.want {
+				t.Errorf("renderMarkdown(%q)\n got %q\nwant %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdownEmphasis(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"*em*", "<em>em</em>"},
+		{"_em_", "<em>em</em>"},
+		{"**strong**", "<strong>strong</strong>"},
+		{"__strong__", "<strong>strong</strong>"},
+		{"~~del~~", "<del>del</del>"},
+		{"~single~", "~single~"},
+		{"a*b*c", "a<em>b</em>c"},
+		{"snake_case_name", "snake_case_name"},
+		{"*a **b** c*", "<em>a <strong>b</strong> c</em>"},
+		{"**a *b* c**", "<strong>a <em>b</em> c</strong>"},
+		{"*a [b](https://e.com) c*", `<em>a <a href="https://e.com" rel="nofollow noopener">b</a> c</em>`},
+		{"*unclosed", "*unclosed"},
+		{"a * b * c", "a * b * c"},
+		{`\*literal\*`, "*literal*"},
+		{"`*code*`", "<code>*code*</code>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			want := `<p data-line="1">` + tt.want + "</p>\n"
+			if got := renderMarkdown(tt.src); got != want {
+				t.Errorf("renderMarkdown(%q)\n got %q\nwant %q", tt.src, got, want)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdownLists(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"bullets", "- a\n- b", "<ul data-line=\"1\">\n<li data-line=\"1\">a\n</li>\n<li data-line=\"2\">b\n</li>\n</ul>\n"},
+		{"ordered", "1. one\n2. two", "<ol data-line=\"1\">\n<li data-line=\"1\">one\n</li>\n<li data-line=\"2\">two\n</li>\n</ol>\n"},
+		{"tasks", "- [x] done\n- [ ] todo", "<ul data-line=\"1\">\n<li data-line=\"1\"><input type=\"checkbox\" disabled checked> done\n</li>\n<li data-line=\"2\"><input type=\"checkbox\" disabled> todo\n</li>\n</ul>\n"},
+		{"loose", "- a\n\n- b", "<ul data-line=\"1\">\n<li data-line=\"1\"><p data-line=\"1\">a</p>\n</li>\n<li data-line=\"3\"><p data-line=\"3\">b</p>\n</li>\n</ul>\n"},
+		{"nested", "- a\n  - b", "<ul data-line=\"1\">\n<li data-line=\"1\">a\n<ul data-line=\"2\">\n<li data-line=\"2\">b\n</li>\n</ul>\n</li>\n</ul>\n"},
+		{"emphasis in item", "- *a*", "<ul data-line=\"1\">\n<li data-line=\"1\"><em>a</em>\n</li>\n</ul>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderMarkdown(tt.src); got != tt.want {
+				t.Errorf("renderMarkdown(%q)\n got %q\nwant %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderMarkdownTables(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{"aligned", "| a | b | c |\n|:--|:-:|--:|\n| 1 | *2* | 3 |", "<table data-line=\"1\">\n<thead>\n<tr data-line=\"1\"><th style=\"text-align:left\">a</th><th style=\"text-align:center\">b</th><th style=\"text-align:right\">c</th></tr>\n</thead>\n<tbody>\n<tr data-line=\"3\"><td style=\"text-align:left\">1</td><td style=\"text-align:center\"><em>2</em></td><td style=\"text-align:right\">3</td></tr>\n</tbody>\n</table>\n"},
+		{"no outer pipes", "a | b\n--- | ---\n1 | 2", "<table data-line=\"1\">\n<thead>\n<tr data-line=\"1\"><th>a</th><th>b</th></tr>\n</thead>\n<tbody>\n<tr data-line=\"3\"><td>1</td><td>2</td></tr>\n</tbody>\n</table>\n"},
+		{"escaped pipe", "| a |\n|---|\n| x \\| y |", "<table data-line=\"1\">\n<thead>\n<tr data-line=\"1\"><th>a</th></tr>\n</thead>\n<tbody>\n<tr data-line=\"3\"><td>x | y</td></tr>\n</tbody>\n</table>\n"},
+		{"no delimiter row", "| a |\n| b |", "<p data-line=\"1\">| a |\n| b |</p>\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderMarkdown(tt.src); got != tt.want {
+				t.Errorf("renderMarkdown(%q)\n got %q\nwant %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+// Unclosed delimiters and brackets used to be followed to the end of the
+// block from every occurrence, which took seconds for these inputs
+func TestRenderMarkdownUnclosedIsLinear(t *testing.T) {
+	for _, unit := range []string{"*a ", "_a ", "~~a ", "**a ", "*a_ ", "[a ", "[a](b ", "<a ", "a **b _c ~~d "} {
+		src := strings.Repeat(unit, (200<<10)/len(unit))
+		if got := renderMarkdown(src); !strings.HasPrefix(got, "<p") {
+			t.Errorf("renderMarkdown(%q...) = %q...", unit, got[:min(len(got), 40)])
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// parseClock reads a marker time given as seconds ("83.5") or as a clock
+// ("1:23", "1:02:03.5")
+func parseClock(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty time")
+	}
+	var seconds float64
+	for _, part := range strings.Split(s, ":") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+// getFileMarkers returns a file's markers and chapters in playback order
+func getFileMarkers(fileID int) ([]Marker, error) {
+	return queryMarkers(`WHERE m.file_id = ? ORDER BY m.time, m.id`, fileID)
+}
+
+// queryMarkers loads markers with their file and optional tag. where is
+// appended after the joins and may filter, order and limit
+func queryMarkers(where string, args ...interface{}) ([]Marker, error) {
+	rows, err := db.Query(`
+		SELECT m.id, m.file_id, f.filename, m.time, m.label, m.source,
+			COALESCE(c.name, ''), COALESCE(t.value, '')
+		FROM file_markers m
+		JOIN files f ON f.id = m.file_id
+		LEFT JOIN tags t ON t.id = m.tag_id
+		LEFT JOIN categories c ON c.id = t.category_id
+		`+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var markers []Marker
+	for rows.Next() {
+		var m Marker
+		if err := rows.Scan(&m.ID, &m.FileID, &m.Filename, &m.Time, &m.Label, &m.Source, &m.Category, &m.Value); err != nil {
+			return nil, err
+		}
+		m.EscapedFilename = url.PathEscape(m.Filename)
+		m.Clock = formatClock(m.Time)
+		markers = append(markers, m)
+	}
+	return markers, rows.Err()
+}
+
+// addMarker stores a marker. tag is an optional "category:value" that is
+// created if it doesn't exist yet
+func addMarker(fileID int, seconds float64, label, tag, source string) error {
+	var tagID interface{}
+	if tag = strings.TrimSpace(tag); tag != "" {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return fmt.Errorf("tag must be written as category:value")
+		}
+		_, id, err := getOrCreateCategoryAndTag(parts[0], parts[1])
+		if err != nil {
+			return fmt.Errorf("failed to create tag: %v", err)
+		}
+		tagID = id
+	}
+
+	if label = strings.TrimSpace(label); label == "" {
+		label = "Marker at " + formatClock(seconds)
+	}
+	_, err := db.Exec(`INSERT INTO file_markers (file_id, time, label, tag_id, source) VALUES (?, ?, ?, ?, ?)`,
+		fileID, seconds, label, tagID, source)
+	return err
+}
+
+// importChapters replaces a file's chapter markers with the chapters embedded
+// in the media, as reported by ffprobe. Markers added by hand are kept
+func importChapters(fileID int64, path string) (int, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_chapters", path).Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to probe chapters: %v", err)
+	}
+
+	var probe struct {
+		Chapters []struct {
+			StartTime string            `json:"start_time"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"chapters"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return 0, fmt.Errorf("invalid ffprobe output: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM file_markers WHERE file_id = ? AND source = 'chapter'`, fileID); err != nil {
+		return 0, err
+	}
+	for i, ch := range probe.Chapters {
+		start, err := strconv.ParseFloat(ch.StartTime, 64)
+		if err != nil {
+			continue
+		}
+		title := ""
+		for k, v := range ch.Tags {
+			if strings.EqualFold(k, "title") {
+				title = strings.TrimSpace(v)
+			}
+		}
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		if _, err := tx.Exec(`INSERT INTO file_markers (file_id, time, label, source) VALUES (?, ?, ?, 'chapter')`,
+			fileID, start, title); err != nil {
+			return 0, err
+		}
+	}
+	return len(probe.Chapters), tx.Commit()
+}
+
+// fileMarkersHandler adds or deletes a marker, or re-imports embedded
+// chapters, for /file/{id}/markers
+func fileMarkersHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+		return
+	}
+	redirect := func(kind, msg string) {
+		http.Redirect(w, r, "/file/"+parts[2]+"?"+kind+"="+url.QueryEscape(msg), http.StatusSeeOther)
+	}
+
+	var f File
+	err := db.QueryRow("SELECT id, filename, path FROM files WHERE id = ?", parts[2]).Scan(&f.ID, &f.Filename, &f.Path)
+	if err != nil {
+		renderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "add":
+		seconds, err := parseClock(r.FormValue("time"))
+		if err != nil {
+			redirect("error", "Invalid marker time: "+err.Error())
+			return
+		}
+		if err := addMarker(f.ID, seconds, r.FormValue("label"), r.FormValue("tag"), "user"); err != nil {
+			log.Printf("Error: fileMarkersHandler: failed to add marker to file id=%d: %v", f.ID, err)
+			redirect("error", "Failed to add marker: "+err.Error())
+			return
+		}
+		redirect("success", "Marker added at "+formatClock(seconds))
+
+	case "delete":
+		if _, err := db.Exec(`DELETE FROM file_markers WHERE id = ? AND file_id = ?`, r.FormValue("marker_id"), f.ID); err != nil {
+			log.Printf("Error: fileMarkersHandler: failed to delete marker %s of file id=%d: %v", r.FormValue("marker_id"), f.ID, err)
+			redirect("error", "Failed to delete marker")
+			return
+		}
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+
+	case "import_chapters":
+		n, err := importChapters(int64(f.ID), filepath.Join(config.UploadDir, f.Path))
+		if err != nil {
+			log.Printf("Error: fileMarkersHandler: failed to import chapters for file id=%d: %v", f.ID, err)
+			redirect("error", "Failed to import chapters: "+err.Error())
+			return
+		}
+		if n == 0 {
+			redirect("warning", "No embedded chapters found")
+			return
+		}
+		redirect("success", fmt.Sprintf("Imported %d chapters", n))
+
+	default:
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+	}
+}
+
+// markersHandler lists markers across the library. ?q= matches labels, file
+// names and tags; ?tag=category:value lists markers with that tag
+func markersHandler(w http.ResponseWriter, r *http.Request) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	tag := strings.TrimSpace(r.URL.Query().Get("tag"))
+
+	where := "WHERE 1=1"
+	var args []interface{}
+	if query != "" {
+		like := "%" + query + "%"
+		where += ` AND (m.label LIKE ? OR f.filename LIKE ? OR t.value LIKE ? OR (c.name || ':' || t.value) LIKE ?)`
+		args = append(args, like, like, like, like)
+	}
+	if cat, val, ok := strings.Cut(tag, ":"); ok {
+		where += ` AND c.name = ? AND t.value = ?`
+		args = append(args, strings.TrimSpace(cat), strings.TrimSpace(val))
+	}
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM file_markers m
+		JOIN files f ON f.id = m.file_id
+		LEFT JOIN tags t ON t.id = m.tag_id
+		LEFT JOIN categories c ON c.id = t.category_id ` + where
+	if err := db.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		log.Printf("Error: markersHandler: failed to count markers: %v", err)
+		renderError(w, "Failed to list markers", http.StatusInternalServerError)
+		return
+	}
+
+	page := pageFromRequest(r)
+	perPage := perPageFromConfig(100)
+	markers, err := queryMarkers(where+` ORDER BY f.filename, m.time LIMIT ? OFFSET ?`,
+		append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		log.Printf("Error: markersHandler: failed to list markers: %v", err)
+		renderError(w, "Failed to list markers", http.StatusInternalServerError)
+		return
+	}
+
+	pageData := buildPageDataWithPagination("Markers", MarkersPageData{
+		Query:   query,
+		Tag:     tag,
+		Markers: markers,
+		Total:   total,
+	}, page, total, perPage, r)
+	renderTemplate(w, "markers.html", pageData)
+}
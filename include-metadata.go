@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// metadataSources lists the metadata providers mappings can be defined for
+var metadataSources = []string{"ytdlp", "audio", "epub", "comicinfo"}
+
+var metadataTargets = map[string]bool{"tag": true, "property": true, "description": true}
+
+// maxMetadataDescription caps the bytes of a description taken from metadata
+const maxMetadataDescription = 2048
+
+var compactDatePattern = regexp.MustCompile(`^\d{8}$`)
+
+// parseYtdlpInfo decodes a yt-dlp info JSON, unwrapping playlists to their first entry
+func parseYtdlpInfo(data []byte) (map[string]interface{}, error) {
+	var info map[string]interface{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("invalid info JSON: %v", err)
+	}
+	if info["_type"] == "playlist" {
+		entries, _ := info["entries"].([]interface{})
+		if len(entries) == 0 {
+			return nil, fmt.Errorf("playlist info JSON has no entries")
+		}
+		entry, ok := entries[0].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("playlist info JSON has an invalid first entry")
+		}
+		return entry, nil
+	}
+	return info, nil
+}
+
+// metadataScalar renders a JSON scalar as a string, dropping objects and nulls
+func metadataScalar(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return t, true
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(t), true
+	}
+	return "", false
+}
+
+// ytdlpFields flattens an info JSON into field -> values. Lists become multiple
+// values and yt-dlp's YYYYMMDD dates are rewritten as YYYY-MM-DD
+func ytdlpFields(info map[string]interface{}) map[string][]string {
+	fields := make(map[string][]string)
+	for key, raw := range info {
+		var values []string
+		if list, ok := raw.([]interface{}); ok {
+			for _, item := range list {
+				if s, ok := metadataScalar(item); ok {
+					values = append(values, s)
+				}
+			}
+		} else if s, ok := metadataScalar(raw); ok {
+			values = append(values, s)
+		}
+		for i, v := range values {
+			if strings.HasSuffix(key, "_date") && compactDatePattern.MatchString(v) {
+				values[i] = v[:4] + "-" + v[4:6] + "-" + v[6:]
+			}
+		}
+		if len(values) > 0 {
+			fields[key] = values
+		}
+	}
+	return fields
+}
+
+// mapMetadata applies the mappings configured for source to a set of fields
+func mapMetadata(source string, fields map[string][]string, mappings []MetadataMapping) MetadataResult {
+	var res MetadataResult
+	seen := make(map[TagPair]bool)
+	var descriptions []string
+
+	for _, m := range mappings {
+		if m.Source != source {
+			continue
+		}
+		var values []string
+		for _, v := range fields[m.Field] {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		switch m.Target {
+		case "tag":
+			for _, v := range values {
+				tag := TagPair{Category: m.Name, Value: v}
+				if !seen[tag] {
+					seen[tag] = true
+					res.Tags = append(res.Tags, tag)
+				}
+			}
+		case "property":
+			res.Properties = append(res.Properties, TagPair{Category: m.Name, Value: strings.Join(values, ", ")})
+		case "description":
+			descriptions = append(descriptions, strings.Join(values, "\n"))
+		}
+	}
+
+	res.Description = strings.Join(descriptions, "\n\n")
+	return res
+}
+
+// applyMetadata writes a mapping result to a file. The description is only
+// filled in when the file does not already have one
+func applyMetadata(fileID int64, res MetadataResult) {
+	for _, tag := range res.Tags {
+		if err := addTagToFile(int(fileID), tag.Category, tag.Value); err != nil {
+			log.Printf("Warning: applyMetadata: failed to add tag %s:%s to file id=%d: %v", tag.Category, tag.Value, fileID, err)
+		}
+	}
+	for _, prop := range res.Properties {
+		setProperty(fileID, prop.Category, prop.Value)
+	}
+	if res.Description != "" {
+		description := res.Description
+		if len(description) > maxMetadataDescription {
+			// Cut at a character boundary so the stored text stays valid UTF-8
+			n := maxMetadataDescription
+			for n > 0 && !utf8.RuneStart(description[n]) {
+				n--
+			}
+			description = description[:n]
+		}
+		if _, err := db.Exec(`UPDATE files SET description = ? WHERE id = ? AND COALESCE(description, '') = ''`, description, fileID); err != nil {
+			log.Printf("Warning: applyMetadata: failed to set description for file id=%d: %v", fileID, err)
+		}
+	}
+}
+
+// applyYtdlpInfoFile maps a downloaded .info.json onto a file and records its source
+func applyYtdlpInfoFile(fileID int64, infoPath, videoURL string) error {
+	data, err := os.ReadFile(infoPath)
+	if err != nil {
+		return err
+	}
+	info, err := parseYtdlpInfo(data)
+	if err != nil {
+		return err
+	}
+
+	// Prefer the canonical page URL, then the URL yt-dlp was given, so the
+	// source can be re-fetched later
+	origin := videoURL
+	for _, key := range []string{"original_url", "webpage_url"} {
+		if u, ok := info[key].(string); ok && u != "" {
+			origin = u
+		}
+	}
+	var extractor string
+	if key, ok := info["extractor_key"].(string); ok {
+		if id, ok := metadataScalar(info["id"]); ok {
+			extractor = key + ":" + id
+		}
+	}
+	recordFileSource(fileID, "ytdlp", origin, extractor)
+
+	applyMetadata(fileID, mapMetadata("ytdlp", ytdlpFields(info), config.MetadataMappings))
+	return nil
+}
+
+func parseMetadataMappingsFromForm(r *http.Request) ([]MetadataMapping, error) {
+	known := make(map[string]bool)
+	for _, s := range metadataSources {
+		known[s] = true
+	}
+
+	var mappings []MetadataMapping
+	for i := 0; ; i++ {
+		field := strings.TrimSpace(r.FormValue(fmt.Sprintf("metadata_mappings[%d][field]", i)))
+		if field == "" {
+			break
+		}
+		m := MetadataMapping{
+			Source: strings.TrimSpace(r.FormValue(fmt.Sprintf("metadata_mappings[%d][source]", i))),
+			Field:  field,
+			Target: strings.TrimSpace(r.FormValue(fmt.Sprintf("metadata_mappings[%d][target]", i))),
+			Name:   strings.TrimSpace(r.FormValue(fmt.Sprintf("metadata_mappings[%d][name]", i))),
+		}
+		if !known[m.Source] {
+			return nil, fmt.Errorf("mapping %d has an unknown source %q", i+1, m.Source)
+		}
+		if !metadataTargets[m.Target] {
+			return nil, fmt.Errorf("mapping %d has an unknown target %q", i+1, m.Target)
+		}
+		if m.Target != "description" && m.Name == "" {
+			return nil, fmt.Errorf("mapping %d needs a category or property name", i+1)
+		}
+		if m.Target == "description" {
+			m.Name = ""
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+func handleSaveMetadataMappings(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	mappings, err := parseMetadataMappingsFromForm(r)
+	if err != nil {
+		data := currentAdminState(r, orphanData, missingThumbnails)
+		data.Error = err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	config.MetadataMappings = mappings
+
+	if err := SaveConfig(db, config); err != nil {
+		log.Printf("Error: handleSaveMetadataMappings: failed to save configuration: %v", err)
+		data := currentAdminState(r, orphanData, missingThumbnails)
+		data.Error = "Failed to save configuration: " + err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	data := currentAdminState(r, orphanData, missingThumbnails)
+	data.Success = "Metadata mappings saved successfully!"
+	renderAdminPage(w, r, data)
+}
+
+// handleTestMetadataMappings runs the saved mappings over a pasted info JSON
+// so they can be checked without downloading anything
+func handleTestMetadataMappings(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	data := currentAdminState(r, orphanData, missingThumbnails)
+	data.MetadataTestInput = r.FormValue("info_json")
+
+	info, err := parseYtdlpInfo([]byte(data.MetadataTestInput))
+	if err != nil {
+		data.Error = err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	fields := ytdlpFields(info)
+	res := mapMetadata("ytdlp", fields, config.MetadataMappings)
+	data.MetadataTest = &res
+
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data.Success = fmt.Sprintf("Mapped %d tags and %d properties. Available fields: %s", len(res.Tags), len(res.Properties), strings.Join(names, ", "))
+	renderAdminPage(w, r, data)
+}
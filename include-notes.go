@@ -24,20 +24,105 @@ func GetNotes(db *sql.DB) (string, error) {
 	return content, err
 }
 
-// SaveNotes saves the notes content to database with sorting and deduplication
-func SaveNotes(db *sql.DB, content string) error {
+// notesVersionLimit returns how many previous versions the notes history
+// keeps besides the current notes; 0 keeps every version
+func notesVersionLimit() int {
+	n, err := strconv.Atoi(config.NotesVersions)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// SaveNotes saves the notes content to database with sorting and deduplication,
+// recording it in the notes history under source when it changed and, if a
+// limit is set, dropping the oldest previous versions beyond it
+func SaveNotes(db *sql.DB, content, source string) error {
 	// Process: deduplicate and sort
 	processed := ProcessNotes(content)
 
-	_, err := db.Exec(`
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	var versions int
+	if err := tx.QueryRow(`SELECT COALESCE((SELECT content FROM notes WHERE id = 1), ''),
+		(SELECT COUNT(*) FROM notes_history)`).Scan(&previous, &versions); err != nil {
+		return err
+	}
+	// Notes written before the history existed become its first version, so
+	// the first save can be undone too
+	if versions == 0 && previous != "" {
+		if _, err := tx.Exec(`INSERT INTO notes_history (content, source) VALUES (?, 'before history')`, previous); err != nil {
+			return err
+		}
+	}
+	if processed != previous {
+		if _, err := tx.Exec(`INSERT INTO notes_history (content, source) VALUES (?, ?)`, processed, source); err != nil {
+			return err
+		}
+	}
+	// The newest history entry is the current notes, so it is kept on top
+	// of the limit
+	if limit := notesVersionLimit(); limit > 0 {
+		if _, err := tx.Exec(`DELETE FROM notes_history WHERE id NOT IN
+			(SELECT id FROM notes_history ORDER BY id DESC LIMIT ?)`, limit+1); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`
 		INSERT INTO notes (id, content, updated_at)
 		VALUES (1, ?, datetime('now'))
 		ON CONFLICT(id) DO UPDATE SET
 			content = excluded.content,
 			updated_at = excluded.updated_at
 	`, processed)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
-	return err
+// getNotesHistory lists the notes history, newest first
+func getNotesHistory() ([]NoteVersion, error) {
+	rows, err := db.Query(`
+		SELECT id, COALESCE(datetime(created_at, 'localtime'), ''), source,
+			CASE WHEN content = '' THEN 0 ELSE length(content) - length(replace(content, char(10), '')) + 1 END
+		FROM notes_history
+		ORDER BY id DESC
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []NoteVersion
+	for rows.Next() {
+		var v NoteVersion
+		if err := rows.Scan(&v.ID, &v.Time, &v.Source, &v.Lines); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// notesVersionDiff returns the changes a version of the notes made to the
+// version before it
+func notesVersionDiff(id int) ([][]DiffLine, error) {
+	var content, previous string
+	err := db.QueryRow(`
+		SELECT content, COALESCE((SELECT content FROM notes_history WHERE id < h.id ORDER BY id DESC LIMIT 1), '')
+		FROM notes_history h WHERE id = ?
+	`, id).Scan(&content, &previous)
+	if err != nil {
+		return nil, err
+	}
+	return diffHunks(diffLines(splitTextLines([]byte(previous)), splitTextLines([]byte(content))), 3), nil
 }
 
 // ProcessNotes deduplicates and sorts lines alphabetically
@@ -207,16 +292,37 @@ func notesViewHandler(w http.ResponseWriter, r *http.Request) {
 
 	analysis := analyzeNotes(content)
 
+	history, err := getNotesHistory()
+	if err != nil {
+		log.Printf("Warning: notesViewHandler: failed to load notes history: %v", err)
+	}
+
+	var diffID int
+	var hunks [][]DiffLine
+	if id, err := strconv.Atoi(r.URL.Query().Get("diff")); err == nil {
+		if hunks, err = notesVersionDiff(id); err != nil {
+			log.Printf("Warning: notesViewHandler: failed to diff notes version %d: %v", id, err)
+		} else {
+			diffID = id
+		}
+	}
+
 	notesData := struct {
 		Content    string
 		Stats      map[string]int
 		Categories []string
 		SedRules   []SedRule
+		History    []NoteVersion
+		DiffID     int
+		Hunks      [][]DiffLine
 	}{
 		Content:    content,
 		Stats:      analysis.Stats,
 		Categories: analysis.Categories,
 		SedRules:   config.SedRules,
+		History:    history,
+		DiffID:     diffID,
+		Hunks:      hunks,
 	}
 
 	pageData := buildPageData("Notes", notesData)
@@ -236,8 +342,14 @@ func notesSaveHandler(w http.ResponseWriter, r *http.Request) {
 
 	content := r.FormValue("content")
 
+	// The editor reports the sed rules applied since the notes were loaded
+	source := "save"
+	if sed := r.FormValue("sed"); sed != "" {
+		source = "save after sed: " + sed
+	}
+
 	// Process (deduplicate and sort) before saving
-	if err := SaveNotes(db, content); err != nil {
+	if err := SaveNotes(db, content, source); err != nil {
 		log.Printf("Error: notesSaveHandler: failed to save notes: %v", err)
 		http.Error(w, "Failed to save notes", http.StatusInternalServerError)
 		return
@@ -342,6 +454,7 @@ func notesApplySedHandler(w http.ResponseWriter, r *http.Request) {
 	response := map[string]interface{}{
 		"success": true,
 		"content": result,
+		"rule":    rule.Name,
 		"stats":   analyzeNotes(result).Stats,
 	}
 	log.Printf("Info: notesApplySedHandler: sed rule success, returning %d bytes", len(result))
@@ -411,8 +524,10 @@ func notesImportHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Option to merge or replace
 	mergeMode := r.FormValue("merge") == "true"
+	source := "import (replace)"
 
 	if mergeMode {
+		source = "import (merge)"
 		// Merge with existing content
 		existingContent, err := GetNotes(db)
 		if err != nil {
@@ -422,7 +537,7 @@ func notesImportHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Save (will auto-process)
-	if err := SaveNotes(db, content); err != nil {
+	if err := SaveNotes(db, content, source); err != nil {
 		log.Printf("Error: notesImportHandler: failed to save imported notes: %v", err)
 		http.Error(w, "Failed to save notes", http.StatusInternalServerError)
 		return
@@ -430,3 +545,33 @@ func notesImportHandler(w http.ResponseWriter, r *http.Request) {
 
 	http.Redirect(w, r, "/notes", http.StatusSeeOther)
 }
+
+// notesRestoreHandler makes a version from the notes history current again.
+// The restore is itself recorded, so it can be undone
+func notesRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+	var content, saved string
+	err = db.QueryRow(`SELECT content, COALESCE(datetime(created_at, 'localtime'), '') FROM notes_history WHERE id = ?`, id).
+		Scan(&content, &saved)
+	if err != nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	if err := SaveNotes(db, content, "restore of "+saved); err != nil {
+		log.Printf("Error: notesRestoreHandler: failed to restore notes version %d: %v", id, err)
+		http.Error(w, "Failed to save notes", http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/notes", http.StatusSeeOther)
+}
@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 func pageFromRequest(r *http.Request) int {
@@ -80,8 +81,55 @@ func calculatePagination(page, total, perPage int) *Pagination {
 	}
 }
 
+// searchSQLPattern turns a search query with * and ? wildcards into a
+// lower-case LIKE pattern
+func searchSQLPattern(query string) string {
+	return "%" + strings.ReplaceAll(strings.ReplaceAll(strings.ToLower(query), "*", "%"), "?", "_") + "%"
+}
+
+// searchFTSQuery turns a search query into an FTS4 MATCH expression for the
+// indexed text: runs of words become phrases, and a word followed by * or ?
+// becomes a prefix. The index matches whole words, so unlike the LIKE
+// pattern a query cannot match the middle of a word
+func searchFTSQuery(query string) string {
+	var phrases, words []string
+	var word strings.Builder
+	endWord := func(prefix bool) {
+		if word.Len() == 0 {
+			return
+		}
+		w := word.String()
+		if prefix {
+			w += "*"
+		}
+		words = append(words, w)
+		word.Reset()
+	}
+	endPhrase := func() {
+		if len(words) > 0 {
+			phrases = append(phrases, `"`+strings.Join(words, " ")+`"`)
+			words = nil
+		}
+	}
+	for _, r := range strings.ToLower(query) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(r)
+		case r == '*' || r == '?':
+			endWord(true)
+			endPhrase()
+		default:
+			endWord(false)
+		}
+	}
+	endWord(false)
+	endPhrase()
+	return strings.Join(phrases, " ")
+}
+
 func getSearchResultsPaginated(query string, page, perPage int) ([]File, int, error) {
-	sqlPattern := "%" + strings.ReplaceAll(strings.ReplaceAll(strings.ToLower(query), "*", "%"), "?", "_") + "%"
+	sqlPattern := searchSQLPattern(query)
+	ftsQuery := searchFTSQuery(query)
 
 	var total int
 	err := db.QueryRow(`
@@ -90,7 +138,9 @@ func getSearchResultsPaginated(query string, page, perPage int) ([]File, int, er
 		LEFT JOIN file_tags ft ON ft.file_id = f.id
 		LEFT JOIN tags t ON t.id = ft.tag_id
 		WHERE LOWER(f.filename) LIKE ? OR LOWER(f.description) LIKE ? OR LOWER(t.value) LIKE ?
-	`, sqlPattern, sqlPattern, sqlPattern).Scan(&total)
+			OR f.id IN (SELECT file_id FROM file_text WHERE rowid IN
+				(SELECT docid FROM file_text_fts WHERE file_text_fts MATCH ?))
+	`, sqlPattern, sqlPattern, sqlPattern, ftsQuery).Scan(&total)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -109,11 +159,13 @@ func getSearchResultsPaginated(query string, page, perPage int) ([]File, int, er
 			LEFT JOIN file_tags ft2 ON ft2.file_id = f2.id
 			LEFT JOIN tags t2 ON t2.id = ft2.tag_id
 			WHERE LOWER(f2.filename) LIKE ? OR LOWER(f2.description) LIKE ? OR LOWER(t2.value) LIKE ?
+				OR f2.id IN (SELECT file_id FROM file_text WHERE rowid IN
+					(SELECT docid FROM file_text_fts WHERE file_text_fts MATCH ?))
 			ORDER BY f2.filename
 			LIMIT ? OFFSET ?
 		)
 		ORDER BY f.filename
-	`, sqlPattern, sqlPattern, sqlPattern, perPage, offset)
+	`, sqlPattern, sqlPattern, sqlPattern, ftsQuery, perPage, offset)
 	if err != nil {
 		return nil, 0, err
 	}
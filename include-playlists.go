@@ -0,0 +1,329 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// playlistEntry is one item of a flat yt-dlp playlist listing
+type playlistEntry struct {
+	Position int
+	ID       string
+	URL      string
+	Title    string
+	Key      string // extractor:id, matches file_sources.extractor
+}
+
+// fetchPlaylist lists a playlist or channel without downloading anything
+func fetchPlaylist(playlistURL string) (string, []playlistEntry, error) {
+	out, err := exec.Command("yt-dlp", "--flat-playlist", "-J", playlistURL).Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to list playlist: %v", err)
+	}
+
+	var listing struct {
+		Type    string `json:"_type"`
+		Title   string `json:"title"`
+		Entries []struct {
+			ID    string `json:"id"`
+			URL   string `json:"url"`
+			Title string `json:"title"`
+			IEKey string `json:"ie_key"`
+		} `json:"entries"`
+	}
+	if err := json.Unmarshal(out, &listing); err != nil {
+		return "", nil, fmt.Errorf("invalid playlist listing: %v", err)
+	}
+	if listing.Type != "playlist" {
+		return "", nil, fmt.Errorf("URL is not a playlist or channel")
+	}
+
+	var entries []playlistEntry
+	for i, e := range listing.Entries {
+		if e.ID == "" || e.URL == "" {
+			continue
+		}
+		entries = append(entries, playlistEntry{
+			Position: i + 1,
+			ID:       e.ID,
+			URL:      e.URL,
+			Title:    e.Title,
+			Key:      e.IEKey + ":" + e.ID,
+		})
+	}
+	return strings.TrimSpace(listing.Title), entries, nil
+}
+
+// parsePlaylistRange parses a selection like "1-10,15,20-" into a position
+// filter. An empty selection matches everything
+func parsePlaylistRange(spec string) (func(int) bool, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return func(int) bool { return true }, nil
+	}
+
+	type span struct{ lo, hi int }
+	var spans []span
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi := 1, int(^uint(0)>>1)
+		var err error
+		if i := strings.Index(part, "-"); i >= 0 {
+			if s := strings.TrimSpace(part[:i]); s != "" {
+				if lo, err = strconv.Atoi(s); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			}
+			if s := strings.TrimSpace(part[i+1:]); s != "" {
+				if hi, err = strconv.Atoi(s); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			}
+		} else {
+			if lo, err = strconv.Atoi(part); err != nil {
+				return nil, fmt.Errorf("invalid position %q", part)
+			}
+			hi = lo
+		}
+		if lo < 1 || hi < lo {
+			return nil, fmt.Errorf("invalid range %q", part)
+		}
+		spans = append(spans, span{lo, hi})
+	}
+
+	return func(pos int) bool {
+		for _, s := range spans {
+			if pos >= s.lo && pos <= s.hi {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// findFileBySource returns the file previously downloaded for a remote item
+func findFileBySource(key, origin string) (int64, bool) {
+	var id int64
+	err := db.QueryRow(`
+		SELECT s.file_id FROM file_sources s
+		JOIN files f ON f.id = s.file_id
+		WHERE (s.extractor != '' AND s.extractor = ?) OR s.origin = ?
+		LIMIT 1`, key, origin).Scan(&id)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Warning: findFileBySource: lookup failed for %s: %v", key, err)
+		}
+		return 0, false
+	}
+	return id, true
+}
+
+// savePlaylist stores a playlist so it can be re-checked later
+func savePlaylist(playlistURL, title string) (int, error) {
+	_, err := db.Exec(`
+		INSERT INTO playlists (url, title) VALUES (?, ?)
+		ON CONFLICT(url) DO UPDATE SET title = excluded.title`, playlistURL, title)
+	if err != nil {
+		return 0, err
+	}
+	var id int
+	err = db.QueryRow(`SELECT id FROM playlists WHERE url = ?`, playlistURL).Scan(&id)
+	return id, err
+}
+
+// markPlaylistEntry records an entry as "imported" or as "skipped" because
+// it was outside the selected range, so re-checks leave it alone. A skipped
+// entry never replaces an imported one
+func markPlaylistEntry(playlistID int, e playlistEntry, status string) {
+	_, err := db.Exec(`
+		INSERT INTO playlist_entries (playlist_id, entry_key, position, status) VALUES (?, ?, ?, ?)
+		ON CONFLICT(playlist_id, entry_key) DO UPDATE SET position = excluded.position, status = excluded.status
+		WHERE excluded.status = 'imported'`,
+		playlistID, e.Key, e.Position, status)
+	if err != nil {
+		log.Printf("Warning: markPlaylistEntry: failed to record %s for playlist %d: %v", e.Key, playlistID, err)
+	}
+}
+
+// knownPlaylistEntries returns the status of every recorded entry by key
+func knownPlaylistEntries(playlistID int) (map[string]string, error) {
+	rows, err := db.Query(`SELECT entry_key, status FROM playlist_entries WHERE playlist_id = ?`, playlistID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	known := make(map[string]string)
+	for rows.Next() {
+		var key, status string
+		if err := rows.Scan(&key, &status); err != nil {
+			return nil, err
+		}
+		known[key] = status
+	}
+	return known, rows.Err()
+}
+
+// enqueuePlaylistEntry queues the download of one entry, tagging the result
+// with the playlist name and its position in the playlist. The entry is only
+// marked as imported once it is in the library, so failed downloads are
+// retried by the next re-check
+func enqueuePlaylistEntry(playlistID int, playlistTitle string, e playlistEntry, policy string) {
+	label := e.Title
+	if label == "" {
+		label = e.URL
+	}
+	enqueueJob("playlist", fmt.Sprintf("%s #%d: %s", playlistTitle, e.Position, label), func() (int64, string, error) {
+		id, existing := findFileBySource(e.Key, e.URL)
+		message := ""
+		if existing {
+			message = "already in library"
+		} else {
+			var err error
+			id, message, err = downloadYtdlpVideo(e.URL, policy)
+			if errors.Is(err, errIngestSkipped) {
+				// Another file has the name; leave it alone and let an explicit
+				// range retry the entry
+				markPlaylistEntry(playlistID, e, "skipped")
+				return id, message, nil
+			}
+			if err != nil {
+				return 0, "", err
+			}
+		}
+
+		if playlistTitle != "" {
+			if err := addTagToFile(int(id), "playlist", playlistTitle); err != nil {
+				log.Printf("Warning: playlist job: failed to tag file id=%d: %v", id, err)
+			}
+		}
+		setProperty(id, "playlist_index", strconv.Itoa(e.Position))
+		applyTagRules(id)
+		markPlaylistEntry(playlistID, e, "imported")
+		return id, message, nil
+	})
+}
+
+// queuePlaylist lists a playlist and queues its entries. Without a selection
+// (a whole playlist or a re-check) only entries never recorded are queued.
+// An explicit selection queues every entry in it, including ones skipped by
+// an earlier selection; entries already in the library are not downloaded
+// again. Unselected new entries are recorded as skipped, so a later re-check
+// only picks up entries added to the playlist since
+func queuePlaylist(playlistURL, selection, policy string) (string, int, error) {
+	inRange, err := parsePlaylistRange(selection)
+	if err != nil {
+		return "", 0, err
+	}
+
+	title, entries, err := fetchPlaylist(playlistURL)
+	if err != nil {
+		return "", 0, err
+	}
+	if title == "" {
+		title = playlistURL
+	}
+
+	playlistID, err := savePlaylist(playlistURL, title)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to save playlist: %v", err)
+	}
+	known, err := knownPlaylistEntries(playlistID)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to load playlist entries: %v", err)
+	}
+
+	explicit := strings.TrimSpace(selection) != ""
+	queued := 0
+	for _, e := range entries {
+		_, recorded := known[e.Key]
+		switch {
+		case explicit && inRange(e.Position), !explicit && !recorded:
+			enqueuePlaylistEntry(playlistID, title, e, policy)
+			queued++
+		case !recorded:
+			markPlaylistEntry(playlistID, e, "skipped")
+		}
+	}
+
+	if _, err := db.Exec(`UPDATE playlists SET last_checked = CURRENT_TIMESTAMP WHERE id = ?`, playlistID); err != nil {
+		log.Printf("Warning: queuePlaylist: failed to update last_checked for playlist %d: %v", playlistID, err)
+	}
+	return title, queued, nil
+}
+
+func listPlaylists() ([]Playlist, error) {
+	rows, err := db.Query(`
+		SELECT p.id, p.url, p.title, COALESCE(p.last_checked, ''), COUNT(CASE WHEN e.status = 'imported' THEN 1 END)
+		FROM playlists p
+		LEFT JOIN playlist_entries e ON e.playlist_id = p.id
+		GROUP BY p.id
+		ORDER BY p.title`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var playlists []Playlist
+	for rows.Next() {
+		var p Playlist
+		if err := rows.Scan(&p.ID, &p.URL, &p.Title, &p.LastChecked, &p.Entries); err != nil {
+			return nil, err
+		}
+		playlists = append(playlists, p)
+	}
+	return playlists, rows.Err()
+}
+
+func ytdlpPlaylistHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/add", http.StatusSeeOther)
+		return
+	}
+
+	playlistURL := strings.TrimSpace(r.FormValue("url"))
+	if parsed, err := url.ParseRequestURI(playlistURL); err != nil || !(parsed.Scheme == "http" || parsed.Scheme == "https") {
+		renderError(w, "Invalid playlist URL", http.StatusBadRequest)
+		return
+	}
+
+	title, queued, err := queuePlaylist(playlistURL, r.FormValue("items"), r.FormValue("conflict_policy"))
+	if err != nil {
+		renderError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	redirectWithWarning(w, r, "/jobs", fmt.Sprintf("Queued %d new entries from %s", queued, title))
+}
+
+func playlistRecheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+		return
+	}
+
+	var playlistURL string
+	if err := db.QueryRow(`SELECT url FROM playlists WHERE id = ?`, r.FormValue("id")).Scan(&playlistURL); err != nil {
+		renderError(w, "Playlist not found", http.StatusNotFound)
+		return
+	}
+
+	title, queued, err := queuePlaylist(playlistURL, "", "")
+	if err != nil {
+		renderError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	redirectWithWarning(w, r, "/jobs", fmt.Sprintf("Queued %d new entries from %s", queued, title))
+}
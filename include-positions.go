@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// positionKinds are the units a position can be stored in: a CBZ page index,
+// a media timestamp in seconds or a text line number
+var positionKinds = map[string]bool{"page": true, "time": true, "line": true}
+
+// positionReachedEnd reports whether a position counts as finished. Media is
+// finished within the last 5% (at most 30 seconds) to allow for credits
+func positionReachedEnd(kind string, position, total float64) bool {
+	if total <= 0 {
+		return false
+	}
+	switch kind {
+	case "page":
+		return position >= total-1
+	case "time":
+		return position >= total-math.Min(30, total*0.05)
+	case "line":
+		return position >= total
+	}
+	return false
+}
+
+func getFilePosition(fileID int) *FilePosition {
+	p := FilePosition{FileID: fileID}
+	var finished int
+	err := db.QueryRow(`SELECT kind, position, total, finished, COALESCE(updated_at, '') FROM file_positions WHERE file_id = ?`, fileID).
+		Scan(&p.Kind, &p.Position, &p.Total, &finished, &p.UpdatedAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Warning: getFilePosition: failed to read position for file id=%d: %v", fileID, err)
+		}
+		return nil
+	}
+	p.Finished = finished != 0
+	return &p
+}
+
+// saveFilePosition records where a file was left. Once finished a file stays
+// finished, so re-reading from the start keeps it out of the continue list.
+// Reaching the end tags the file status:finished when enabled in settings
+func saveFilePosition(fileID int, kind string, position, total float64) error {
+	if !positionKinds[kind] {
+		return fmt.Errorf("unknown position kind %q", kind)
+	}
+	if position < 0 || total < 0 || math.IsNaN(position) || math.IsNaN(total) {
+		return fmt.Errorf("invalid position")
+	}
+	var exists int
+	if err := db.QueryRow(`SELECT 1 FROM files WHERE id = ?`, fileID).Scan(&exists); err != nil {
+		return fmt.Errorf("file not found")
+	}
+
+	previous := getFilePosition(fileID)
+	finished := positionReachedEnd(kind, position, total)
+	if previous != nil && previous.Finished {
+		finished = true
+	}
+
+	_, err := db.Exec(`
+		INSERT INTO file_positions (file_id, kind, position, total, finished, updated_at)
+		VALUES (?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(file_id) DO UPDATE SET
+			kind = excluded.kind, position = excluded.position, total = excluded.total,
+			finished = excluded.finished, updated_at = excluded.updated_at
+	`, fileID, kind, position, total, finished)
+	if err != nil {
+		return err
+	}
+
+	if finished && (previous == nil || !previous.Finished) && config.AutoFinishStatus {
+		if err := addTagToFile(fileID, "status", "finished"); err != nil {
+			log.Printf("Warning: saveFilePosition: failed to tag file id=%d as finished: %v", fileID, err)
+		}
+	}
+	return nil
+}
+
+// positionHandler stores a position reported by the viewers, or forgets it
+// with action=clear
+func positionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileID, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(r.URL.Path, "/position/"), "/"))
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	if r.FormValue("action") == "clear" {
+		if _, err := db.Exec(`DELETE FROM file_positions WHERE file_id = ?`, fileID); err != nil {
+			log.Printf("Error: positionHandler: failed to clear position for file id=%d: %v", fileID, err)
+			http.Redirect(w, r, "/continue?error="+url.QueryEscape("Failed to clear position"), http.StatusSeeOther)
+			return
+		}
+		redirect := r.FormValue("redirect")
+		if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") {
+			redirect = "/continue"
+		}
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+		return
+	}
+
+	position, errPos := strconv.ParseFloat(r.FormValue("position"), 64)
+	total, errTotal := strconv.ParseFloat(r.FormValue("total"), 64)
+	if errPos != nil || errTotal != nil {
+		http.Error(w, "Invalid position", http.StatusBadRequest)
+		return
+	}
+
+	if err := saveFilePosition(fileID, r.FormValue("kind"), position, total); err != nil {
+		log.Printf("Error: positionHandler: failed to save position for file id=%d: %v", fileID, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// positionEntries lists files with a stored position, most recent first
+func positionEntries(finished bool) ([]PositionEntry, error) {
+	rows, err := db.Query(`
+		SELECT f.id, f.filename, f.path, p.kind, p.position, p.total, COALESCE(p.updated_at, '')
+		FROM file_positions p
+		JOIN files f ON f.id = p.file_id
+		WHERE p.finished = ?
+		ORDER BY p.updated_at DESC, f.id DESC
+	`, finished)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []PositionEntry
+	for rows.Next() {
+		var e PositionEntry
+		if err := rows.Scan(&e.File.ID, &e.File.Filename, &e.File.Path,
+			&e.Position.Kind, &e.Position.Position, &e.Position.Total, &e.Position.UpdatedAt); err != nil {
+			return nil, err
+		}
+		e.File.EscapedFilename = url.PathEscape(e.File.Filename)
+		e.Position.FileID = e.File.ID
+		e.Position.Finished = finished
+
+		e.ResumeURL = fmt.Sprintf("/file/%d", e.File.ID)
+		done := e.Position.Position
+		switch e.Position.Kind {
+		case "page":
+			done++
+			e.Label = fmt.Sprintf("page %d of %.0f", int(e.Position.Position)+1, e.Position.Total)
+			e.ResumeURL = fmt.Sprintf("/cbz/%d/%d", e.File.ID, int(e.Position.Position))
+		case "time":
+			e.Label = fmt.Sprintf("%s of %s", formatClock(e.Position.Position), formatClock(e.Position.Total))
+		case "line":
+			e.Label = fmt.Sprintf("line %.0f of %.0f", e.Position.Position, e.Position.Total)
+		}
+		if e.Position.Total > 0 {
+			e.Percent = int(math.Min(100, done/e.Position.Total*100))
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// formatClock renders seconds as h:mm:ss or m:ss
+func formatClock(seconds float64) string {
+	s := int(seconds)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+func renderPositions(w http.ResponseWriter, r *http.Request, view string, finished bool) {
+	entries, err := positionEntries(finished)
+	if err != nil {
+		log.Printf("Error: renderPositions: failed to list %s files: %v", view, err)
+		renderError(w, "Failed to list files", http.StatusInternalServerError)
+		return
+	}
+
+	title := "Continue"
+	if finished {
+		title = "Finished"
+	}
+	renderTemplate(w, "positions.html", buildPageData(title, PositionsPageData{
+		View:    view,
+		Entries: entries,
+		Error:   r.URL.Query().Get("error"),
+	}))
+}
+
+// continueHandler lists files that were started but not finished
+func continueHandler(w http.ResponseWriter, r *http.Request) {
+	renderPositions(w, r, "continue", false)
+}
+
+// finishedHandler lists files that were read or watched to the end
+func finishedHandler(w http.ResponseWriter, r *http.Request) {
+	renderPositions(w, r, "finished", true)
+}
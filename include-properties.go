@@ -9,9 +9,7 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
 	"strings"
 )
 
@@ -25,7 +23,17 @@ func computeProperties(fileID int64, filePath string) {
 		computeImageProperties(fileID, filePath)
 	case ".mp4", ".mov", ".avi", ".mkv", ".webm", ".m4v":
 		computeVideoProperties(fileID, filePath)
+	case ".cbz":
+		computeCBZProperties(fileID, filePath)
+	case ".epub":
+		computeEPUBProperties(fileID, filePath)
+	default:
+		if isAudioFile(filePath) {
+			computeAudioProperties(fileID, filePath)
+		}
 	}
+
+	applyTagRules(fileID)
 }
 
 func setProperty(fileID int64, key, value string) {
@@ -84,36 +92,33 @@ func computeImageProperties(fileID int64, filePath string) {
 }
 
 func computeVideoProperties(fileID int64, filePath string) {
-	cmd := exec.Command("ffprobe",
-		"-v", "error",
-		"-show_entries", "format=duration",
-		"-of", "default=nokey=1:noprint_wrappers=1",
-		filePath,
-	)
-	out, err := cmd.Output()
+	probe, err := probeMedia(filePath)
 	if err != nil {
 		log.Printf("Warning: ffprobe failed for %s: %v", filePath, err)
 		return
 	}
 
-	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
-	if err != nil {
-		log.Printf("Warning: could not parse duration for %s: %v", filePath, err)
+	// Recorded so the file page knows whether to stream without probing
+	setProperty(fileID, "playback", playbackProperty(probe, filepath.Ext(filePath)))
+
+	if probe.Duration <= 0 {
+		log.Printf("Warning: could not parse duration for %s", filePath)
 		return
 	}
+	setProperty(fileID, "duration", durationBucket(probe.Duration))
+}
 
-	var bucket string
+func durationBucket(seconds float64) string {
 	switch {
 	case seconds < 60:
-		bucket = "tiny"
+		return "tiny"
 	case seconds < 300:
-		bucket = "short"
+		return "short"
 	case seconds < 2700:
-		bucket = "moderate"
+		return "moderate"
 	default:
-		bucket = "long"
+		return "long"
 	}
-	setProperty(fileID, "duration", bucket)
 }
 
 func computeMissingProperties() (int, error) {
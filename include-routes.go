@@ -11,21 +11,34 @@ func RegisterRoutes() {
 	http.HandleFunc("/add", uploadHandler)
 	http.HandleFunc("/add-yt", ytdlpHandler)
 	http.HandleFunc("/add-local", localFileHandler)
+	http.HandleFunc("/add-yt-playlist", ytdlpPlaylistHandler)
 	http.HandleFunc("/admin", adminHandler)
 	http.HandleFunc("/bulk-tag", bulkTagHandler)
 	http.HandleFunc("/cbz/", cbzViewerHandler)
+	http.HandleFunc("/cbz-builder", cbzBuilderHandler)
+	http.HandleFunc("/continue", continueHandler)
+	http.HandleFunc("/epub/", epubViewerHandler)
 	http.HandleFunc("/file/", fileRouter)
+	http.HandleFunc("/finished", finishedHandler)
+	http.HandleFunc("/hls/", hlsHandler)
+	http.HandleFunc("/img/", imageHandler)
+	http.HandleFunc("/jobs", jobsHandler)
+	http.HandleFunc("/markers", markersHandler)
 	http.HandleFunc("/notes", notesViewHandler)
 	http.HandleFunc("/notes/apply-sed", notesApplySedHandler)
 	http.HandleFunc("/notes/export", notesExportHandler)
 	http.HandleFunc("/notes/filter", notesFilterHandler)
 	http.HandleFunc("/notes/import", notesImportHandler)
 	http.HandleFunc("/notes/preview", notesPreviewHandler)
+	http.HandleFunc("/notes/restore", notesRestoreHandler)
 	http.HandleFunc("/notes/save", notesSaveHandler)
 	http.HandleFunc("/notes/stats", notesStatsHandler)
+	http.HandleFunc("/playlists/recheck", playlistRecheckHandler)
+	http.HandleFunc("/position/", positionHandler)
 	http.HandleFunc("/properties", propertiesIndexHandler)
 	http.HandleFunc("/property/", propertyFilterHandler)
 	http.HandleFunc("/search/", searchHandler)
+	http.HandleFunc("/source/", sourceFilterHandler)
 	http.HandleFunc("/tag/", tagFilterHandler)
 	http.HandleFunc("/tags", tagsHandler)
 	http.HandleFunc("/thumbnails/generate", generateThumbnailHandler)
@@ -22,6 +22,11 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 			renderError(w, "Search failed: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		re := searchPatternRegexp(query)
+		ftsQuery := searchFTSQuery(query)
+		for i := range files {
+			files[i].Matches = findTextMatches(files[i].ID, re, ftsQuery)
+		}
 		searchTitle = fmt.Sprintf("Search Results for: %s", query)
 	} else {
 		searchTitle = "Search Files"
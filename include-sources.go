@@ -0,0 +1,277 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// getFileSource returns where a file came from, or nil when it is unknown
+func getFileSource(fileID int) *FileSource {
+	var s FileSource
+	err := db.QueryRow(`SELECT kind, origin, extractor, COALESCE(added_at, '') FROM file_sources WHERE file_id = ?`, fileID).
+		Scan(&s.Kind, &s.Origin, &s.Extractor, &s.AddedAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Warning: getFileSource: failed to look up source for file id=%d: %v", fileID, err)
+		}
+		return nil
+	}
+	s.Domain = sourceDomain(s.Origin)
+	s.Refreshable = s.Kind == "url" || s.Kind == "ytdlp" || s.Kind == "local"
+	return &s
+}
+
+// sourceDomain extracts the host of a remote origin without any "www." prefix
+func sourceDomain(origin string) string {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+// domainMatches reports whether host is domain or one of its subdomains
+func domainMatches(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// sourceDomainCounts tallies files per remote source domain
+func sourceDomainCounts() ([]TagDisplay, error) {
+	rows, err := db.Query(`SELECT s.origin FROM file_sources s JOIN files f ON f.id = s.file_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var origin string
+		if err := rows.Scan(&origin); err != nil {
+			return nil, err
+		}
+		if domain := sourceDomain(origin); domain != "" {
+			counts[domain]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var domains []TagDisplay
+	for domain, count := range counts {
+		domains = append(domains, TagDisplay{Value: domain, Count: count})
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Value < domains[j].Value })
+	return domains, nil
+}
+
+// fileIDsForDomain lists files whose origin is on a domain, newest first
+func fileIDsForDomain(domain string) ([]int, error) {
+	rows, err := db.Query(`SELECT s.file_id, s.origin FROM file_sources s JOIN files f ON f.id = s.file_id ORDER BY s.file_id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		var origin string
+		if err := rows.Scan(&id, &origin); err != nil {
+			return nil, err
+		}
+		if host := sourceDomain(origin); host != "" && domainMatches(host, domain) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+func sourceFilterHandler(w http.ResponseWriter, r *http.Request) {
+	domain := strings.ToLower(strings.Trim(strings.TrimPrefix(r.URL.Path, "/source/"), "/"))
+	domain = strings.TrimPrefix(domain, "www.")
+
+	if domain == "" {
+		domains, err := sourceDomainCounts()
+		if err != nil {
+			log.Printf("Error: sourceFilterHandler: failed to count source domains: %v", err)
+			renderError(w, "Failed to list sources", http.StatusInternalServerError)
+			return
+		}
+		renderTemplate(w, "sources.html", buildPageData("Sources", domains))
+		return
+	}
+
+	ids, err := fileIDsForDomain(domain)
+	if err != nil {
+		log.Printf("Error: sourceFilterHandler: failed to find files for %s: %v", domain, err)
+		renderError(w, "Failed to fetch files", http.StatusInternalServerError)
+		return
+	}
+
+	page := pageFromRequest(r)
+	perPage := perPageFromConfig(50)
+	total := len(ids)
+
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+
+	var files []File
+	if pageIDs := ids[start:end]; len(pageIDs) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(pageIDs)), ",")
+		args := make([]interface{}, len(pageIDs))
+		for i, id := range pageIDs {
+			args[i] = id
+		}
+		files, err = queryFilesWithTags(
+			`SELECT f.id, f.filename, f.path, COALESCE(f.description, '') as description FROM files f
+			WHERE f.id IN (`+placeholders+`) ORDER BY f.id DESC`,
+			args...,
+		)
+		if err != nil {
+			log.Printf("Error: sourceFilterHandler: failed to fetch files for %s: %v", domain, err)
+			renderError(w, "Failed to fetch files", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	breadcrumbs := []Breadcrumb{
+		{Name: "home", URL: "/"},
+		{Name: "sources", URL: "/source/"},
+		{Name: domain, URL: r.URL.Path},
+	}
+
+	pageData := buildPageDataWithPagination("source: "+domain, ListData{
+		Tagged:      files,
+		Breadcrumbs: breadcrumbs,
+	}, page, total, perPage, r)
+	pageData.Breadcrumbs = breadcrumbs
+
+	renderTemplate(w, "list.html", pageData)
+}
+
+// sourceHTTPClient fetches refreshed copies from a URL source. The overall
+// timeout allows for large files; a server that never answers fails fast
+var sourceHTTPClient = &http.Client{
+	Timeout: 30 * time.Minute,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		TLSHandshakeTimeout:   15 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// fetchFromSource downloads a fresh copy of a file's content into dir
+func fetchFromSource(src *FileSource, dir string) (string, error) {
+	tempPath := filepath.Join(dir, "refresh.tmp")
+
+	switch src.Kind {
+	case "url":
+		resp, err := sourceHTTPClient.Get(src.Origin)
+		if err != nil {
+			return "", fmt.Errorf("failed to download file: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("failed to download file: %s", resp.Status)
+		}
+		return tempPath, copyToFile(resp.Body, tempPath)
+
+	case "local":
+		f, err := os.Open(src.Origin)
+		if err != nil {
+			return "", fmt.Errorf("failed to open source file: %v", err)
+		}
+		defer f.Close()
+		return tempPath, copyToFile(f, tempPath)
+
+	case "ytdlp":
+		outTemplate := filepath.Join(dir, "refresh.%(ext)s")
+		cmd := exec.Command("yt-dlp", "--playlist-items", "1", "-f", "mp4", "-o", outTemplate, src.Origin)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return "", fmt.Errorf("failed to download video: %v", err)
+		}
+		all, _ := filepath.Glob(filepath.Join(dir, "refresh.*"))
+		var matches []string
+		for _, m := range all {
+			if !strings.HasSuffix(m, ".json") && !strings.HasSuffix(m, ".part") {
+				matches = append(matches, m)
+			}
+		}
+		if len(matches) != 1 {
+			return "", fmt.Errorf("yt-dlp did not produce a single file")
+		}
+		return matches[0], nil
+	}
+
+	return "", fmt.Errorf("files added by %s cannot be refreshed", src.Kind)
+}
+
+func copyToFile(src io.Reader, path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to copy file data: %v", err)
+	}
+	return out.Close()
+}
+
+func fileRefreshHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+		return
+	}
+
+	fileID, err := strconv.Atoi(parts[2])
+	if err != nil {
+		renderError(w, "Invalid file ID", http.StatusBadRequest)
+		return
+	}
+
+	src := getFileSource(fileID)
+	if src == nil || !src.Refreshable {
+		http.Redirect(w, r, "/file/"+parts[2]+"?error="+url.QueryEscape("This file has no source it can be refreshed from"), http.StatusSeeOther)
+		return
+	}
+
+	dir, err := os.MkdirTemp(config.UploadDir, ".refresh-")
+	if err != nil {
+		renderError(w, "Failed to create temp directory", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tempPath, err := fetchFromSource(src, dir)
+	if err == nil {
+		err = replaceFileContent(fileID, tempPath)
+	}
+	if err != nil {
+		log.Printf("Error: fileRefreshHandler: failed to refresh file id=%d from %s: %v", fileID, src.Origin, err)
+		http.Redirect(w, r, "/file/"+parts[2]+"?error="+url.QueryEscape("Refresh failed: "+err.Error()), http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/file/"+parts[2]+"?success="+url.QueryEscape("File content refreshed from "+src.Origin), http.StatusSeeOther)
+}
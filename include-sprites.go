@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Sprite sheets hold up to spriteFrames evenly spaced frames, spriteColumns
+// to a row, each spriteTileWidth pixels wide
+const (
+	spriteFrames    = 64
+	spriteColumns   = 8
+	spriteTileWidth = 160
+)
+
+// spriteJobs tracks files with a sprite job queued or running, so repeated
+// requests don't pile up duplicate work
+var spriteJobs = struct {
+	sync.Mutex
+	pending map[int64]bool
+}{pending: make(map[int64]bool)}
+
+var videoExts = map[string]bool{
+	".mp4": true, ".webm": true, ".mov": true, ".avi": true, ".mkv": true, ".m4v": true,
+}
+
+func isVideoFile(filename string) bool {
+	return videoExts[strings.ToLower(filepath.Ext(filename))]
+}
+
+// spritePaths returns where a video's sprite sheet and WebVTT track are kept
+func spritePaths(uploadDir, filename string) (sheet, vtt string) {
+	dir := filepath.Join(uploadDir, "sprites")
+	return filepath.Join(dir, filename+".jpg"), filepath.Join(dir, filename+".vtt")
+}
+
+// vttTimestamp formats seconds as a WebVTT hh:mm:ss.mmm cue time
+func vttTimestamp(seconds float64) string {
+	ms := int(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// generateSprite renders a grid of evenly spaced frames with ffmpeg and a
+// WebVTT track whose cues point at each frame's tile in the sheet
+func generateSprite(videoPath, uploadDir, filename string) error {
+	probe, err := probeMedia(videoPath)
+	if err != nil {
+		return err
+	}
+	if probe.VideoCodec == "" || probe.Duration <= 0 {
+		return fmt.Errorf("no video stream or unknown duration")
+	}
+
+	// Short clips get one frame per second rather than near-identical tiles
+	frames := spriteFrames
+	if probe.Duration < float64(frames) {
+		frames = int(math.Max(1, math.Floor(probe.Duration)))
+	}
+	columns := spriteColumns
+	if frames < columns {
+		columns = frames
+	}
+	rows := (frames + columns - 1) / columns
+	interval := probe.Duration / float64(frames)
+
+	sheetPath, vttPath := spritePaths(uploadDir, filename)
+	if err := os.MkdirAll(filepath.Dir(sheetPath), 0755); err != nil {
+		return fmt.Errorf("failed to create sprites directory: %v", err)
+	}
+
+	// Each tile is taken from the middle of the span its cue covers
+	tmpSheet := sheetPath + ".tmp.jpg"
+	var stderr bytes.Buffer
+	cmd := exec.Command("ffmpeg", "-y", "-loglevel", "error",
+		"-ss", fmt.Sprintf("%.3f", interval/2), "-i", videoPath, "-an", "-sn",
+		"-vf", fmt.Sprintf("fps=%f,scale=%d:-2,tile=%dx%d", 1/interval, spriteTileWidth, columns, rows),
+		"-frames:v", "1", "-q:v", "4", tmpSheet)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(tmpSheet)
+		return fmt.Errorf("failed to generate sprite sheet: %v\nffmpeg output: %s", err, stderr.String())
+	}
+
+	// The tile height follows the video's aspect ratio, so read it back
+	// from the sheet
+	f, err := os.Open(tmpSheet)
+	if err != nil {
+		return err
+	}
+	sheet, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		os.Remove(tmpSheet)
+		return fmt.Errorf("failed to read sprite sheet: %v", err)
+	}
+	tileW, tileH := sheet.Width/columns, sheet.Height/rows
+	if tileW == 0 || tileH == 0 {
+		os.Remove(tmpSheet)
+		return fmt.Errorf("sprite sheet is empty")
+	}
+
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n\n")
+	sheetName := url.PathEscape(filepath.Base(sheetPath))
+	for i := 0; i < frames; i++ {
+		end := math.Min(float64(i+1)*interval, probe.Duration)
+		fmt.Fprintf(&vtt, "%s --> %s\n%s#xywh=%d,%d,%d,%d\n\n",
+			vttTimestamp(float64(i)*interval), vttTimestamp(end), sheetName,
+			i%columns*tileW, i/columns*tileH, tileW, tileH)
+	}
+
+	tmpVTT := vttPath + ".tmp"
+	if err := os.WriteFile(tmpVTT, []byte(vtt.String()), 0644); err != nil {
+		os.Remove(tmpSheet)
+		return err
+	}
+	if err := os.Rename(tmpSheet, sheetPath); err != nil {
+		os.Remove(tmpSheet)
+		os.Remove(tmpVTT)
+		return err
+	}
+	// The track is written last; its presence marks a complete sprite
+	return os.Rename(tmpVTT, vttPath)
+}
+
+// queueSpriteJob generates a video's sprite sheet in the background. The file
+// is looked up when the job runs so renames in the meantime are picked up.
+// It reports false when a job for the file is already pending
+func queueSpriteJob(fileID int64, label string) bool {
+	spriteJobs.Lock()
+	if spriteJobs.pending[fileID] {
+		spriteJobs.Unlock()
+		return false
+	}
+	spriteJobs.pending[fileID] = true
+	spriteJobs.Unlock()
+
+	enqueueJob("sprite", label, func() (int64, string, error) {
+		defer func() {
+			spriteJobs.Lock()
+			delete(spriteJobs.pending, fileID)
+			spriteJobs.Unlock()
+		}()
+
+		var filename, path string
+		if err := db.QueryRow("SELECT filename, path FROM files WHERE id = ?", fileID).Scan(&filename, &path); err != nil {
+			return 0, "", fmt.Errorf("file not found: %v", err)
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(config.UploadDir, path)
+		}
+		if err := generateSprite(path, config.UploadDir, filename); err != nil {
+			return fileID, "", err
+		}
+		return fileID, "Sprite sheet generated", nil
+	})
+	return true
+}
+
+// getMissingSpriteVideos lists videos without a sprite sheet
+func getMissingSpriteVideos() ([]VideoFile, error) {
+	allVideos, err := getVideoFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []VideoFile
+	for _, v := range allVideos {
+		if v.IsAudio || v.IsImage {
+			continue
+		}
+		_, vttPath := spritePaths(config.UploadDir, v.Filename)
+		if _, err := os.Stat(vttPath); err != nil {
+			missing = append(missing, v)
+		}
+	}
+	return missing, nil
+}
+
+// removeSprite deletes a video's sprite sheet and track
+func removeSprite(filename string) {
+	sheetPath, vttPath := spritePaths(config.UploadDir, filename)
+	for _, p := range []string{sheetPath, vttPath} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: removeSprite: failed to delete %s: %v", p, err)
+		}
+	}
+}
+
+// renameSprite moves a video's sprite sheet and track to a new filename,
+// rewriting the track since its cues reference the sheet by name
+func renameSprite(oldFilename, newFilename string) {
+	oldSheet, oldVTT := spritePaths(config.UploadDir, oldFilename)
+	newSheet, newVTT := spritePaths(config.UploadDir, newFilename)
+	data, err := os.ReadFile(oldVTT)
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(oldSheet, newSheet)
+	if err == nil {
+		track := strings.ReplaceAll(string(data), url.PathEscape(filepath.Base(oldSheet))+"#", url.PathEscape(filepath.Base(newSheet))+"#")
+		err = os.WriteFile(newVTT, []byte(track), 0644)
+	}
+	if err != nil {
+		log.Printf("Warning: renameSprite: failed to move sprite for %s to %s: %v", oldFilename, newFilename, err)
+		return
+	}
+	os.Remove(oldVTT)
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Subtitle codecs ffmpeg can convert to WebVTT. Bitmap formats such as PGS
+// and VobSub would need OCR and are skipped
+var textSubtitleCodecs = map[string]bool{
+	"subrip": true, "srt": true, "ass": true, "ssa": true, "webvtt": true, "mov_text": true, "text": true,
+}
+
+var subtitleExts = map[string]bool{".srt": true, ".vtt": true}
+
+var (
+	srtTimingComma = regexp.MustCompile(`(\d{2}:\d{2}:\d{2}),(\d{3})`)
+	cueMarkup      = regexp.MustCompile(`<[^>]*>|\{\\[^}]*\}`)
+)
+
+// subtitlePath returns where a subtitle track is kept. Tracks are named by
+// file and track ID so renaming the video doesn't touch them
+func subtitlePath(fileID, subtitleID int64) string {
+	return filepath.Join(config.UploadDir, "subtitles", fmt.Sprintf("%d-%d.vtt", fileID, subtitleID))
+}
+
+// getFileSubtitles returns a file's subtitle tracks, embedded ones first
+func getFileSubtitles(fileID int) ([]Subtitle, error) {
+	rows, err := db.Query(`SELECT id, file_id, language, label, source FROM file_subtitles
+		WHERE file_id = ? ORDER BY source = 'sidecar', id`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subtitle
+	for rows.Next() {
+		var s Subtitle
+		if err := rows.Scan(&s.ID, &s.FileID, &s.Language, &s.Label, &s.Source); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// subtitleLabel picks a track label from its title or language
+func subtitleLabel(title, language string, n int) string {
+	switch {
+	case strings.TrimSpace(title) != "":
+		return strings.TrimSpace(title)
+	case language != "":
+		return language
+	}
+	return fmt.Sprintf("Track %d", n)
+}
+
+// addSubtitle records a track and writes its WebVTT content. origin is the
+// sidecar file a track was read from, empty for embedded tracks
+func addSubtitle(fileID int64, language, label, source, origin string, vtt []byte) error {
+	res, err := db.Exec(`INSERT INTO file_subtitles (file_id, language, label, source, origin) VALUES (?, ?, ?, ?, ?)`,
+		fileID, language, label, source, origin)
+	if err != nil {
+		return err
+	}
+	subID, _ := res.LastInsertId()
+	dest := subtitlePath(fileID, subID)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err == nil {
+		err = os.WriteFile(dest, vtt, 0644)
+	}
+	if err != nil {
+		db.Exec(`DELETE FROM file_subtitles WHERE id = ?`, subID)
+		return fmt.Errorf("failed to write subtitle track: %v", err)
+	}
+	return nil
+}
+
+// deleteSubtitles removes a file's tracks from the given source
+func deleteSubtitles(fileID int64, source string) error {
+	rows, err := db.Query(`SELECT id FROM file_subtitles WHERE file_id = ? AND source = ?`, fileID, source)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := os.Remove(subtitlePath(fileID, id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: deleteSubtitles: failed to delete track %d of file id=%d: %v", id, fileID, err)
+		}
+		if _, err := db.Exec(`DELETE FROM file_subtitles WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSubtitleFiles deletes every track on disk for a file whose rows have
+// already been removed
+func removeSubtitleFiles(fileID int) {
+	tracks, _ := filepath.Glob(filepath.Join(config.UploadDir, "subtitles", fmt.Sprintf("%d-*.vtt", fileID)))
+	for _, p := range tracks {
+		if err := os.Remove(p); err != nil {
+			log.Printf("Warning: removeSubtitleFiles: failed to delete %s: %v", p, err)
+		}
+	}
+}
+
+// extractEmbeddedSubtitles replaces a file's embedded tracks with the text
+// subtitle streams ffprobe finds in it, converted to WebVTT
+func extractEmbeddedSubtitles(fileID int64, videoPath string) (int, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-select_streams", "s", "-show_streams", videoPath).Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to probe subtitle streams: %v", err)
+	}
+	var probe struct {
+		Streams []struct {
+			Index     int               `json:"index"`
+			CodecName string            `json:"codec_name"`
+			Tags      map[string]string `json:"tags"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return 0, fmt.Errorf("invalid ffprobe output: %v", err)
+	}
+
+	if err := deleteSubtitles(fileID, "embedded"); err != nil {
+		return 0, err
+	}
+
+	extracted := 0
+	for i, s := range probe.Streams {
+		if !textSubtitleCodecs[s.CodecName] {
+			log.Printf("Info: extractEmbeddedSubtitles: skipping %s subtitle stream %d of file id=%d", s.CodecName, s.Index, fileID)
+			continue
+		}
+		var title, language string
+		for k, v := range s.Tags {
+			switch strings.ToLower(k) {
+			case "title":
+				title = v
+			case "language":
+				if v != "und" {
+					language = v
+				}
+			}
+		}
+
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("ffmpeg", "-loglevel", "error", "-i", videoPath, "-map", fmt.Sprintf("0:%d", s.Index), "-f", "webvtt", "-")
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			log.Printf("Warning: extractEmbeddedSubtitles: failed to extract stream %d of file id=%d: %v\nffmpeg output: %s", s.Index, fileID, err, stderr.String())
+			continue
+		}
+		if err := addSubtitle(fileID, language, subtitleLabel(title, language, i+1), "embedded", "", stdout.Bytes()); err != nil {
+			return extracted, err
+		}
+		extracted++
+	}
+
+	if err := indexSubtitleText(fileID); err != nil {
+		log.Printf("Warning: extractEmbeddedSubtitles: failed to index subtitles of file id=%d: %v", fileID, err)
+	}
+	return extracted, nil
+}
+
+// queueSubtitleJob extracts a video's embedded subtitles in the background,
+// since ffmpeg has to read through the whole file
+func queueSubtitleJob(fileID int64, label string) {
+	enqueueJob("subtitles", label, func() (int64, string, error) {
+		var path string
+		if err := db.QueryRow("SELECT path FROM files WHERE id = ?", fileID).Scan(&path); err != nil {
+			return 0, "", fmt.Errorf("file not found: %v", err)
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(config.UploadDir, path)
+		}
+		n, err := extractEmbeddedSubtitles(fileID, path)
+		if err != nil {
+			return fileID, "", err
+		}
+		return fileID, fmt.Sprintf("Extracted %d subtitle tracks", n), nil
+	})
+}
+
+// srtToVTT converts SubRip subtitles to WebVTT. The cue layout is the same
+// apart from the header and the decimal separator in timings
+func srtToVTT(data []byte) []byte {
+	text := strings.TrimPrefix(string(data), "\ufeff")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.Contains(line, "-->") {
+			lines[i] = srtTimingComma.ReplaceAllString(line, "$1.$2")
+		}
+	}
+	return []byte("WEBVTT\n\n" + strings.TrimSpace(strings.Join(lines, "\n")) + "\n")
+}
+
+// sidecarSubtitles lists the .srt and .vtt files next to a video that share
+// its name, such as "movie.srt" or "movie.en.forced.vtt". The part between
+// the name and the extension is returned as the track's tag
+func sidecarSubtitles(videoPath string) map[string]string {
+	dir := filepath.Dir(videoPath)
+	stem := strings.TrimSuffix(filepath.Base(videoPath), filepath.Ext(videoPath))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	found := make(map[string]string)
+	for _, e := range entries {
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if !e.Type().IsRegular() || !subtitleExts[strings.ToLower(ext)] {
+			continue
+		}
+		base := strings.TrimSuffix(name, ext)
+		if base == stem {
+			found[filepath.Join(dir, name)] = ""
+		} else if strings.HasPrefix(base, stem+".") {
+			found[filepath.Join(dir, name)] = strings.TrimPrefix(base, stem+".")
+		}
+	}
+	return found
+}
+
+// sidecarOrigins returns the sidecar files a video's tracks were read from
+func sidecarOrigins(fileID int64) map[string]bool {
+	origins := make(map[string]bool)
+	rows, err := db.Query(`SELECT origin FROM file_subtitles WHERE file_id = ? AND source = 'sidecar' AND origin != ''`, fileID)
+	if err != nil {
+		log.Printf("Warning: sidecarOrigins: failed to read tracks of file id=%d: %v", fileID, err)
+		return origins
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var origin string
+		if rows.Scan(&origin) == nil {
+			origins[origin] = true
+		}
+	}
+	return origins
+}
+
+// importSidecarSubtitles adds the subtitle files found next to an imported
+// video as tracks and returns the paths whose tracks are in the library.
+// Files imported for the video before are not added again
+func importSidecarSubtitles(fileID int64, videoPath string) []string {
+	found := sidecarSubtitles(videoPath)
+	paths := make([]string, 0, len(found))
+	for p := range found {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	known := sidecarOrigins(fileID)
+	var imported []string
+	added := 0
+	for _, p := range paths {
+		if known[p] {
+			imported = append(imported, p)
+			continue
+		}
+		tag := found[p]
+		data, err := os.ReadFile(p)
+		if err != nil {
+			log.Printf("Warning: importSidecarSubtitles: failed to read %s: %v", p, err)
+			continue
+		}
+		if strings.EqualFold(filepath.Ext(p), ".srt") {
+			data = srtToVTT(data)
+		}
+
+		// The first part of the tag is usually a language code
+		language, _, _ := strings.Cut(tag, ".")
+		if len(language) != 2 && len(language) != 3 {
+			language = ""
+		}
+		label := strings.ReplaceAll(tag, ".", " ")
+		if label == "" {
+			label = strings.TrimPrefix(strings.ToLower(filepath.Ext(p)), ".")
+		}
+		if err := addSubtitle(fileID, language, label, "sidecar", p, data); err != nil {
+			log.Printf("Warning: importSidecarSubtitles: failed to import %s: %v", p, err)
+			continue
+		}
+		imported = append(imported, p)
+		added++
+	}
+
+	if added > 0 {
+		if err := indexSubtitleText(fileID); err != nil {
+			log.Printf("Warning: importSidecarSubtitles: failed to index subtitles of file id=%d: %v", fileID, err)
+		}
+	}
+	return imported
+}
+
+// isSidecarSubtitle reports whether rel is a subtitle file belonging to one
+// of the videos in a directory import, given their slash-separated relative
+// paths without extension
+func isSidecarSubtitle(rel string, videoStems map[string]bool) bool {
+	if !subtitleExts[strings.ToLower(path.Ext(rel))] {
+		return false
+	}
+	base := strings.TrimSuffix(rel, path.Ext(rel))
+	for {
+		if videoStems[base] {
+			return true
+		}
+		i := strings.LastIndex(base, ".")
+		if i <= strings.LastIndex(base, "/") {
+			return false
+		}
+		base = base[:i]
+	}
+}
+
+type subtitleCue struct {
+	start float64
+	text  string
+}
+
+// parseSubtitleCues reads the start time and plain text of each cue in a
+// WebVTT track, skipping headers, notes and empty cues
+func parseSubtitleCues(vtt []byte) []subtitleCue {
+	var cues []subtitleCue
+	blocks := strings.Split(strings.ReplaceAll(string(vtt), "\r\n", "\n"), "\n\n")
+	for _, block := range blocks {
+		lines := strings.Split(strings.TrimSpace(block), "\n")
+		for i, line := range lines {
+			if !strings.Contains(line, "-->") {
+				continue
+			}
+			text := cueMarkup.ReplaceAllString(strings.Join(lines[i+1:], " "), "")
+			if text = strings.TrimSpace(text); text != "" {
+				start, _ := parseClock(strings.TrimSpace(strings.Split(line, "-->")[0]))
+				cues = append(cues, subtitleCue{start: start, text: text})
+			}
+			break
+		}
+	}
+	return cues
+}
+
+// subtitleCueText returns the spoken text of a WebVTT track, one cue per line
+func subtitleCueText(vtt []byte) string {
+	var lines []string
+	for _, cue := range parseSubtitleCues(vtt) {
+		lines = append(lines, cue.text)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// indexSubtitleText stores the text of all of a file's tracks for search,
+// unless subtitle indexing is turned off
+func indexSubtitleText(fileID int64) error {
+	subs, err := getFileSubtitles(int(fileID))
+	if err != nil {
+		return err
+	}
+	var parts []string
+	for _, s := range subs {
+		if !config.IndexSubtitles {
+			break
+		}
+		data, err := os.ReadFile(subtitlePath(fileID, int64(s.ID)))
+		if err != nil {
+			continue
+		}
+		if text := subtitleCueText(data); text != "" {
+			parts = append(parts, text)
+		}
+	}
+
+	if len(parts) == 0 {
+		_, err = db.Exec(`DELETE FROM file_text WHERE file_id = ? AND source = 'subtitles'`, fileID)
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO file_text (file_id, source, content) VALUES (?, 'subtitles', ?)
+		ON CONFLICT(file_id, source) DO UPDATE SET content = excluded.content`,
+		fileID, strings.Join(parts, "\n"))
+	return err
+}
+
+// fileSubtitlesHandler re-extracts embedded subtitles or deletes a track, for
+// /file/{id}/subtitles
+func fileSubtitlesHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+		return
+	}
+	redirect := func(kind, msg string) {
+		http.Redirect(w, r, "/file/"+parts[2]+"?"+kind+"="+url.QueryEscape(msg), http.StatusSeeOther)
+	}
+
+	var f File
+	err := db.QueryRow("SELECT id, filename FROM files WHERE id = ?", parts[2]).Scan(&f.ID, &f.Filename)
+	if err != nil {
+		renderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.FormValue("action") {
+	case "extract":
+		queueSubtitleJob(int64(f.ID), f.Filename)
+		http.Redirect(w, r, "/jobs", http.StatusSeeOther)
+
+	case "delete":
+		var subID int64
+		if err := db.QueryRow(`SELECT id FROM file_subtitles WHERE id = ? AND file_id = ?`, r.FormValue("subtitle_id"), f.ID).Scan(&subID); err != nil {
+			redirect("error", "Subtitle track not found")
+			return
+		}
+		if err := os.Remove(subtitlePath(int64(f.ID), subID)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: fileSubtitlesHandler: failed to delete track %d of file id=%d: %v", subID, f.ID, err)
+		}
+		if _, err := db.Exec(`DELETE FROM file_subtitles WHERE id = ?`, subID); err != nil {
+			log.Printf("Error: fileSubtitlesHandler: failed to delete track %d of file id=%d: %v", subID, f.ID, err)
+			redirect("error", "Failed to delete subtitle track")
+			return
+		}
+		if err := indexSubtitleText(int64(f.ID)); err != nil {
+			log.Printf("Warning: fileSubtitlesHandler: failed to index subtitles of file id=%d: %v", f.ID, err)
+		}
+		redirect("success", "Subtitle track deleted")
+
+	default:
+		http.Redirect(w, r, "/file/"+parts[2], http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ruleTerm is a single "field op value" comparison inside a rule condition
+type ruleTerm struct {
+	Field  string
+	Op     string
+	Value  string
+	Negate bool
+	re     *regexp.Regexp // compiled Value for the ~ operator
+}
+
+// ruleSubject holds everything a rule condition can look at for one file
+type ruleSubject struct {
+	ID         int
+	Filename   string
+	Size       int64
+	Source     string
+	Properties map[string]string
+	Tags       map[string][]string
+}
+
+var ruleOperators = []string{"!=", ">=", "<=", "=", "~", ">", "<"}
+
+// splitKeyword splits s on a space-delimited ASCII keyword,
+// case-insensitively. It compares in place rather than upper-casing s, which
+// can change the byte length of non-ASCII characters
+func splitKeyword(s, keyword string) []string {
+	sep := " " + keyword + " "
+	var parts []string
+	start := 0
+	for i := 0; i+len(sep) <= len(s); i++ {
+		if strings.EqualFold(s[i:i+len(sep)], sep) {
+			parts = append(parts, s[start:i])
+			start = i + len(sep)
+			i = start - 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseRuleCondition parses e.g. "filetype=mp4 AND duration=long OR tag:status=new"
+// into OR-groups of AND-ed terms. AND binds tighter than OR.
+func parseRuleCondition(condition string) ([][]ruleTerm, error) {
+	condition = strings.TrimSpace(condition)
+	if condition == "" {
+		return nil, fmt.Errorf("condition cannot be empty")
+	}
+
+	var groups [][]ruleTerm
+	for _, orPart := range splitKeyword(condition, "OR") {
+		var terms []ruleTerm
+		for _, raw := range splitKeyword(orPart, "AND") {
+			term, err := parseRuleTerm(raw)
+			if err != nil {
+				return nil, err
+			}
+			terms = append(terms, term)
+		}
+		groups = append(groups, terms)
+	}
+	return groups, nil
+}
+
+func parseRuleTerm(raw string) (ruleTerm, error) {
+	raw = strings.TrimSpace(raw)
+	var term ruleTerm
+	if len(raw) > 4 && strings.EqualFold(raw[:4], "NOT ") {
+		term.Negate = true
+		raw = strings.TrimSpace(raw[4:])
+	}
+
+	opIdx, op := -1, ""
+	for _, candidate := range ruleOperators {
+		if idx := strings.Index(raw, candidate); idx > 0 && (opIdx < 0 || idx < opIdx) {
+			opIdx, op = idx, candidate
+		}
+	}
+	if opIdx < 0 {
+		return term, fmt.Errorf("invalid term %q, expected field=value", raw)
+	}
+
+	term.Field = strings.ToLower(strings.TrimSpace(raw[:opIdx]))
+	term.Op = op
+	term.Value = strings.TrimSpace(raw[opIdx+len(op):])
+	if term.Field == "" || term.Value == "" {
+		return term, fmt.Errorf("invalid term %q, field and value are required", raw)
+	}
+
+	switch op {
+	case "~":
+		re, err := regexp.Compile("(?i)" + term.Value)
+		if err != nil {
+			return term, fmt.Errorf("invalid pattern in %q: %v", raw, err)
+		}
+		term.re = re
+	case ">", "<", ">=", "<=":
+		if _, err := parseRuleNumber(term.Value); err != nil {
+			return term, fmt.Errorf("invalid number in %q: %v", raw, err)
+		}
+	}
+	return term, nil
+}
+
+// parseRuleNumber parses plain numbers and sizes such as 500KB, 20MB or 1.5GB
+func parseRuleNumber(s string) (float64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := 1.0
+	for _, unit := range []struct {
+		suffix string
+		mult   float64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			multiplier = unit.mult
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+// subjectValues returns the values a field resolves to for a subject
+func (s ruleSubject) subjectValues(field string) []string {
+	switch {
+	case field == "filename":
+		return []string{s.Filename}
+	case field == "ext":
+		return []string{strings.TrimPrefix(strings.ToLower(filepath.Ext(s.Filename)), ".")}
+	case field == "size":
+		return []string{strconv.FormatInt(s.Size, 10)}
+	case field == "source":
+		if s.Source == "" {
+			return nil
+		}
+		return []string{s.Source}
+	case strings.HasPrefix(field, "tag:"):
+		return s.Tags[strings.TrimPrefix(field, "tag:")]
+	default:
+		if v, ok := s.Properties[field]; ok {
+			return []string{v}
+		}
+		return nil
+	}
+}
+
+func (t ruleTerm) matches(s ruleSubject) bool {
+	values := s.subjectValues(t.Field)
+	result := false
+
+	switch t.Op {
+	case "=", "!=":
+		for _, v := range values {
+			if t.Value == "*" || strings.EqualFold(v, t.Value) {
+				result = true
+				break
+			}
+		}
+		if t.Op == "!=" {
+			result = !result
+		}
+	case "~":
+		for _, v := range values {
+			if t.re.MatchString(v) {
+				result = true
+				break
+			}
+		}
+	default:
+		want, _ := parseRuleNumber(t.Value)
+		for _, v := range values {
+			got, err := parseRuleNumber(v)
+			if err != nil {
+				continue
+			}
+			if (t.Op == ">" && got > want) || (t.Op == "<" && got < want) ||
+				(t.Op == ">=" && got >= want) || (t.Op == "<=" && got <= want) {
+				result = true
+				break
+			}
+		}
+	}
+
+	if t.Negate {
+		return !result
+	}
+	return result
+}
+
+func conditionMatches(groups [][]ruleTerm, s ruleSubject) bool {
+	for _, terms := range groups {
+		all := true
+		for _, term := range terms {
+			if !term.matches(s) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRuleSubjects loads the data rules evaluate against, for one file or (fileID 0) all files
+func loadRuleSubjects(fileID int) ([]ruleSubject, error) {
+	where, args := "", []interface{}{}
+	if fileID != 0 {
+		where, args = " WHERE f.id = ?", append(args, fileID)
+	}
+
+	rows, err := db.Query(`
+		SELECT f.id, f.filename, f.path, COALESCE(s.origin, '')
+		FROM files f
+		LEFT JOIN file_sources s ON s.file_id = f.id`+where+`
+		ORDER BY f.id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	var subjects []ruleSubject
+	index := make(map[int]int)
+	for rows.Next() {
+		var s ruleSubject
+		var path string
+		if err := rows.Scan(&s.ID, &s.Filename, &path, &s.Source); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if info, err := os.Stat(filepath.Join(config.UploadDir, path)); err == nil {
+			s.Size = info.Size()
+		}
+		s.Properties = make(map[string]string)
+		s.Tags = make(map[string][]string)
+		index[s.ID] = len(subjects)
+		subjects = append(subjects, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	fileWhere := strings.Replace(where, "f.id", "file_id", 1)
+	propRows, err := db.Query(`SELECT file_id, key, value FROM file_properties`+fileWhere, args...)
+	if err != nil {
+		return nil, err
+	}
+	for propRows.Next() {
+		var id int
+		var key, value string
+		if err := propRows.Scan(&id, &key, &value); err != nil {
+			propRows.Close()
+			return nil, err
+		}
+		if i, ok := index[id]; ok {
+			subjects[i].Properties[key] = value
+		}
+	}
+	propRows.Close()
+
+	tagWhere := strings.Replace(where, "f.id", "ft.file_id", 1)
+	tagRows, err := db.Query(`
+		SELECT ft.file_id, c.name, t.value
+		FROM file_tags ft
+		JOIN tags t ON t.id = ft.tag_id
+		JOIN categories c ON c.id = t.category_id`+tagWhere, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer tagRows.Close()
+	for tagRows.Next() {
+		var id int
+		var cat, val string
+		if err := tagRows.Scan(&id, &cat, &val); err != nil {
+			return nil, err
+		}
+		if i, ok := index[id]; ok {
+			subjects[i].Tags[cat] = append(subjects[i].Tags[cat], val)
+		}
+	}
+	return subjects, tagRows.Err()
+}
+
+func hasTag(s ruleSubject, category, value string) bool {
+	for _, v := range s.Tags[category] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTagRules evaluates every enabled rule against one file and adds the resulting tags
+func applyTagRules(fileID int64) int {
+	if len(config.TagRules) == 0 {
+		return 0
+	}
+
+	subjects, err := loadRuleSubjects(int(fileID))
+	if err != nil || len(subjects) == 0 {
+		if err != nil {
+			log.Printf("Warning: applyTagRules: failed to load file id=%d: %v", fileID, err)
+		}
+		return 0
+	}
+	subject := subjects[0]
+
+	added := 0
+	for _, rule := range config.TagRules {
+		if !rule.Enabled {
+			continue
+		}
+		groups, err := parseRuleCondition(rule.Condition)
+		if err != nil {
+			log.Printf("Warning: applyTagRules: skipping rule %q: %v", rule.Name, err)
+			continue
+		}
+		if !conditionMatches(groups, subject) || hasTag(subject, rule.Category, rule.Value) {
+			continue
+		}
+		if err := addTagToFile(subject.ID, rule.Category, rule.Value); err != nil {
+			log.Printf("Warning: applyTagRules: failed to add tag %s:%s to file id=%d: %v", rule.Category, rule.Value, fileID, err)
+			continue
+		}
+		subject.Tags[rule.Category] = append(subject.Tags[rule.Category], rule.Value)
+		added++
+	}
+	return added
+}
+
+// testTagRule counts matching files for a rule and how many still lack its tag
+func testTagRule(rule TagRule, subjects []ruleSubject) TagRuleResult {
+	result := TagRuleResult{Rule: rule}
+	groups, err := parseRuleCondition(rule.Condition)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	for _, s := range subjects {
+		if !conditionMatches(groups, s) {
+			continue
+		}
+		result.Matches++
+		if rule.Category != "" && !hasTag(s, rule.Category, rule.Value) {
+			result.Pending++
+		}
+		if len(result.Samples) < 10 {
+			result.Samples = append(result.Samples, File{ID: s.ID, Filename: s.Filename})
+		}
+	}
+	return result
+}
+
+func parseTagRulesFromForm(r *http.Request) ([]TagRule, error) {
+	var rules []TagRule
+	for i := 0; ; i++ {
+		name := strings.TrimSpace(r.FormValue(fmt.Sprintf("tag_rules[%d][name]", i)))
+		if name == "" {
+			break
+		}
+		rule := TagRule{
+			Name:      name,
+			Condition: strings.TrimSpace(r.FormValue(fmt.Sprintf("tag_rules[%d][condition]", i))),
+			Category:  strings.TrimSpace(r.FormValue(fmt.Sprintf("tag_rules[%d][category]", i))),
+			Value:     strings.TrimSpace(r.FormValue(fmt.Sprintf("tag_rules[%d][value]", i))),
+			Enabled:   r.FormValue(fmt.Sprintf("tag_rules[%d][enabled]", i)) == "true",
+		}
+		if rule.Category == "" || rule.Value == "" {
+			return nil, fmt.Errorf("rule %d is missing a tag category or value", i+1)
+		}
+		if _, err := parseRuleCondition(rule.Condition); err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func handleSaveTagRules(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	rules, err := parseTagRulesFromForm(r)
+	if err != nil {
+		data := currentAdminState(r, orphanData, missingThumbnails)
+		data.Error = err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	config.TagRules = rules
+
+	if err := SaveConfig(db, config); err != nil {
+		log.Printf("Error: handleSaveTagRules: failed to save configuration: %v", err)
+		data := currentAdminState(r, orphanData, missingThumbnails)
+		data.Error = "Failed to save configuration: " + err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	data := currentAdminState(r, orphanData, missingThumbnails)
+	data.Success = "Tag rules saved successfully!"
+	renderAdminPage(w, r, data)
+}
+
+func handleTestTagRules(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	data := currentAdminState(r, orphanData, missingThumbnails)
+
+	subjects, err := loadRuleSubjects(0)
+	if err != nil {
+		log.Printf("Error: handleTestTagRules: failed to load files: %v", err)
+		data.Error = "Failed to load files: " + err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	for _, rule := range config.TagRules {
+		data.TagRuleResults = append(data.TagRuleResults, testTagRule(rule, subjects))
+	}
+
+	if condition := strings.TrimSpace(r.FormValue("test_condition")); condition != "" {
+		result := testTagRule(TagRule{Name: "Ad-hoc test", Condition: condition}, subjects)
+		data.TagRuleTest = &result
+	}
+
+	data.Success = fmt.Sprintf("Tested %d rules against %d files.", len(config.TagRules), len(subjects))
+	renderAdminPage(w, r, data)
+}
+
+func handleApplyTagRules(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	data := currentAdminState(r, orphanData, missingThumbnails)
+
+	rows, err := db.Query(`SELECT id FROM files ORDER BY id`)
+	if err != nil {
+		log.Printf("Error: handleApplyTagRules: failed to query files: %v", err)
+		data.Error = "Failed to query files: " + err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	added := 0
+	for _, id := range ids {
+		added += applyTagRules(id)
+	}
+
+	data.Success = fmt.Sprintf("Tag rules added %d tags across %d files.", added, len(ids))
+	renderAdminPage(w, r, data)
+}
@@ -24,6 +24,8 @@ func InitTemplates() (*template.Template, error) {
 			}
 			return false
 		},
+		"isTextFile": isTextFile,
+		"textRenderMode": textRenderMode,
 		"dict": func(values ...interface{}) (map[string]interface{}, error) {
 			if len(values)%2 != 0 {
 				return nil, fmt.Errorf("dict requires an even number of args")
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// textEditMu serialises saves so the version check and the write can't
+// interleave between two editors
+var textEditMu sync.Mutex
+
+var errTextConflict = fmt.Errorf("the file was changed since it was opened")
+
+// maxEditableTextSize caps the files the editor loads whole; larger files
+// are paged by the viewer, which offers no Edit button for them
+const maxEditableTextSize = largeTextSize
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// textVersionLimit returns how many previous versions of a file are kept
+func textVersionLimit() int {
+	n, err := strconv.Atoi(config.TextVersions)
+	if err != nil || n < 0 {
+		return 10
+	}
+	return n
+}
+
+// versionsDir holds a file's previous versions, named by the Unix time in
+// nanoseconds at which they were replaced
+func versionsDir(fileID int) string {
+	return filepath.Join(config.UploadDir, "versions", strconv.Itoa(fileID))
+}
+
+// listTextVersions returns a file's kept versions, newest first
+func listTextVersions(fileID int) []TextVersion {
+	entries, err := os.ReadDir(versionsDir(fileID))
+	if err != nil {
+		return nil
+	}
+	var versions []TextVersion
+	for _, e := range entries {
+		id := strings.TrimSuffix(e.Name(), ".txt")
+		nanos, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || e.IsDir() {
+			continue
+		}
+		v := TextVersion{ID: id, Time: time.Unix(0, nanos).Format("2006-01-02 15:04:05")}
+		if info, err := e.Info(); err == nil {
+			v.Size = info.Size()
+		}
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID > versions[j].ID })
+	return versions
+}
+
+// readTextVersion loads a kept version. The ID must be one listTextVersions
+// produced, which keeps it inside the versions directory
+func readTextVersion(fileID int, id string) ([]byte, error) {
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid version")
+	}
+	return os.ReadFile(filepath.Join(versionsDir(fileID), id+".txt"))
+}
+
+// keepTextVersion stores the content being replaced and drops the oldest
+// versions beyond the configured limit
+func keepTextVersion(fileID int, content []byte) error {
+	limit := textVersionLimit()
+	if limit == 0 {
+		return nil
+	}
+	dir := versionsDir(fileID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, strconv.FormatInt(time.Now().UnixNano(), 10)+".txt")
+	if err := os.WriteFile(name, content, 0644); err != nil {
+		return err
+	}
+	versions := listTextVersions(fileID)
+	for _, v := range versions[min(limit, len(versions)):] {
+		os.Remove(filepath.Join(dir, v.ID+".txt"))
+	}
+	return nil
+}
+
+// loadEditableText reads a text file for editing, refusing files the
+// editor can't round-trip
+func loadEditableText(f File) (string, []byte, error) {
+	if !isTextFile(f.Filename) {
+		return "", nil, fmt.Errorf("only text files can be edited")
+	}
+	path := filepath.Join(config.UploadDir, f.Path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if info.Size() > maxEditableTextSize {
+		return "", nil, fmt.Errorf("file is too large to edit")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !utf8.Valid(data) {
+		return "", nil, fmt.Errorf("file is not UTF-8 text")
+	}
+	return path, data, nil
+}
+
+// writeTextContent replaces a text file's content if it still matches
+// baseHash, keeping the old content as a version. It returns the new hash,
+// or the current one along with errTextConflict when the file has changed
+func writeTextContent(f File, content, baseHash string) (string, error) {
+	textEditMu.Lock()
+	defer textEditMu.Unlock()
+
+	path, current, err := loadEditableText(f)
+	if err != nil {
+		return "", err
+	}
+	if currentHash := contentHash(current); currentHash != baseHash {
+		return currentHash, errTextConflict
+	}
+
+	// Browsers submit textareas with LF line endings; keep the file's CRLF
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	if bytes.Contains(current, []byte("\r\n")) {
+		content = strings.ReplaceAll(content, "\n", "\r\n")
+	}
+	data := []byte(content)
+	if bytes.Equal(data, current) {
+		return baseHash, nil
+	}
+
+	if err := keepTextVersion(f.ID, current); err != nil {
+		log.Printf("Warning: writeTextContent: failed to keep previous version of file id=%d: %v", f.ID, err)
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	refreshProperties(int64(f.ID), path)
+	indexFileContent(int64(f.ID), path)
+	return contentHash(data), nil
+}
+
+// fileEditHandler serves /file/{id}/edit. GET returns the text and its hash
+// as JSON; POST saves content if the file still has the hash it was opened
+// with, and answers 409 Conflict with the current hash otherwise
+func fileEditHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	var f File
+	err := db.QueryRow("SELECT id, filename, path FROM files WHERE id = ?", parts[2]).Scan(&f.ID, &f.Filename, &f.Path)
+	if err != nil {
+		respondJSON(w, http.StatusNotFound, map[string]interface{}{"success": false, "error": "File not found"})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		_, data, err := loadEditableText(f)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "error": err.Error()})
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"content": strings.ReplaceAll(string(data), "\r\n", "\n"),
+			"hash":    contentHash(data),
+		})
+		return
+	}
+
+	hash, err := writeTextContent(f, r.FormValue("content"), r.FormValue("hash"))
+	switch {
+	case err == errTextConflict:
+		respondJSON(w, http.StatusConflict, map[string]interface{}{"success": false, "conflict": true, "hash": hash, "error": err.Error()})
+	case err != nil:
+		log.Printf("Error: fileEditHandler: failed to save file id=%d: %v", f.ID, err)
+		respondJSON(w, http.StatusBadRequest, map[string]interface{}{"success": false, "error": err.Error()})
+	default:
+		respondJSON(w, http.StatusOK, map[string]interface{}{"success": true, "hash": hash})
+	}
+}
+
+// fileVersionsHandler lists a text file's previous versions at
+// /file/{id}/versions, shows ?diff={version} against the current text and
+// restores a version on POST
+func fileVersionsHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	var f File
+	err := db.QueryRow("SELECT id, filename, path FROM files WHERE id = ?", parts[2]).Scan(&f.ID, &f.Filename, &f.Path)
+	if err != nil {
+		renderError(w, "File not found", http.StatusNotFound)
+		return
+	}
+	_, current, err := loadEditableText(f)
+	if err != nil {
+		renderError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		redirect := func(kind, msg string) {
+			http.Redirect(w, r, "/file/"+parts[2]+"?"+kind+"="+url.QueryEscape(msg), http.StatusSeeOther)
+		}
+		version := r.FormValue("version")
+		data, err := readTextVersion(f.ID, version)
+		if err != nil {
+			redirect("error", "Version not found")
+			return
+		}
+		// Restoring replaces the current text, which becomes a version itself
+		if _, err := writeTextContent(f, string(data), contentHash(current)); err != nil {
+			log.Printf("Error: fileVersionsHandler: failed to restore version %s of file id=%d: %v", version, f.ID, err)
+			redirect("error", "Failed to restore version: "+err.Error())
+			return
+		}
+		nanos, _ := strconv.ParseInt(version, 10, 64)
+		redirect("success", "Restored the version from "+time.Unix(0, nanos).Format("2006-01-02 15:04:05"))
+		return
+	}
+
+	data := VersionsPageData{File: f, Versions: listTextVersions(f.ID)}
+	if diff := r.URL.Query().Get("diff"); diff != "" {
+		old, err := readTextVersion(f.ID, diff)
+		if err != nil {
+			renderError(w, "Version not found", http.StatusNotFound)
+			return
+		}
+		data.DiffVersion = diff
+		data.Hunks = diffHunks(diffLines(splitTextLines(old), splitTextLines(current)), 3)
+	}
+	renderTemplate(w, "versions.html", buildPageData("Versions of "+f.Filename, data))
+}
+
+// splitTextLines splits text into lines, ignoring CRLF and a final newline
+func splitTextLines(data []byte) []string {
+	text := strings.TrimSuffix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxRenderSize caps the files rendered server-side; larger ones are shown raw
+const maxRenderSize = 4 << 20
+
+var (
+	plainTextExts = map[string]bool{".txt": true, ".log": true, ".csv": true, ".nfo": true}
+	markdownExts  = map[string]bool{".md": true, ".markdown": true}
+)
+
+// isTextFile reports whether a file opens in the text viewer
+func isTextFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	_, source := sourceExts[ext]
+	return plainTextExts[ext] || markdownExts[ext] || source
+}
+
+// textRenderMode returns "markdown" or "code" for text files the viewer can
+// render, or "" for plain text
+func textRenderMode(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch {
+	case markdownExts[ext]:
+		return "markdown"
+	case sourceExts[ext] != "":
+		return "code"
+	}
+	return ""
+}
+
+// fileRenderHandler serves /file/{id}/render: a Markdown file as sanitised
+// HTML or a source file with syntax highlighting, for the text viewer
+func fileRenderHandler(w http.ResponseWriter, r *http.Request, parts []string) {
+	var f File
+	err := db.QueryRow("SELECT id, filename, path FROM files WHERE id = ?", parts[2]).Scan(&f.ID, &f.Filename, &f.Path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	mode := textRenderMode(f.Filename)
+	if mode == "" {
+		http.Error(w, "File type is not rendered", http.StatusBadRequest)
+		return
+	}
+
+	path := filepath.Join(config.UploadDir, f.Path)
+	info, err := os.Stat(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if info.Size() > maxRenderSize {
+		http.Error(w, "File too large to render", http.StatusRequestEntityTooLarge)
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Error: fileRenderHandler: failed to read %s: %v", path, err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	var out string
+	if mode == "markdown" {
+		out = renderMarkdown(text)
+	} else {
+		out = renderSourceHTML(text, sourceLanguages[sourceExts[strings.ToLower(filepath.Ext(f.Filename))]])
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(out))
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// encoderCodecs maps ffmpeg encoder names to the codec name ffprobe reports,
+// so a profile can tell when a stream is already in the target codec
+var encoderCodecs = map[string]string{
+	"libx264":    "h264",
+	"libx265":    "hevc",
+	"libvpx-vp9": "vp9",
+	"libaom-av1": "av1",
+	"libsvtav1":  "av1",
+	"libopus":    "opus",
+	"libmp3lame": "mp3",
+	"libfdk_aac": "aac",
+}
+
+var outputExtPattern = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// probeMedia reads container and stream details with ffprobe's JSON output
+func probeMedia(path string) (*MediaProbe, error) {
+	out, err := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe media: %v", err)
+	}
+
+	var raw struct {
+		Format struct {
+			FormatName string            `json:"format_name"`
+			Duration   string            `json:"duration"`
+			BitRate    string            `json:"bit_rate"`
+			Tags       map[string]string `json:"tags"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType   string            `json:"codec_type"`
+			CodecName   string            `json:"codec_name"`
+			Width       int               `json:"width"`
+			Height      int               `json:"height"`
+			SampleRate  string            `json:"sample_rate"`
+			Tags        map[string]string `json:"tags"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &raw); err != nil {
+		return nil, fmt.Errorf("invalid ffprobe output: %v", err)
+	}
+
+	probe := &MediaProbe{FormatName: raw.Format.FormatName, Tags: make(map[string]string)}
+	probe.Duration, _ = strconv.ParseFloat(raw.Format.Duration, 64)
+	probe.BitRate, _ = strconv.Atoi(raw.Format.BitRate)
+	for k, v := range raw.Format.Tags {
+		probe.Tags[strings.ToLower(k)] = v
+	}
+	for _, s := range raw.Streams {
+		switch {
+		// Embedded cover art shows up as a single-frame video stream
+		case s.CodecType == "video" && s.Disposition.AttachedPic == 1:
+			probe.HasCover = true
+		case s.CodecType == "video" && probe.VideoCodec == "":
+			probe.VideoCodec = s.CodecName
+			probe.Width, probe.Height = s.Width, s.Height
+		case s.CodecType == "subtitle":
+			probe.SubtitleCodecs = append(probe.SubtitleCodecs, s.CodecName)
+		case s.CodecType == "audio" && probe.AudioCodec == "":
+			probe.AudioCodec = s.CodecName
+			probe.SampleRate, _ = strconv.Atoi(s.SampleRate)
+			// Ogg files keep their Vorbis comments on the stream
+			for k, v := range s.Tags {
+				if _, ok := probe.Tags[strings.ToLower(k)]; !ok {
+					probe.Tags[strings.ToLower(k)] = v
+				}
+			}
+		}
+	}
+	return probe, nil
+}
+
+// matchesList reports whether any value appears in a comma-separated list;
+// an empty list matches everything
+func matchesList(list string, values ...string) bool {
+	if strings.TrimSpace(list) == "" {
+		return true
+	}
+	for _, item := range strings.Split(strings.ToLower(list), ",") {
+		item = strings.TrimSpace(item)
+		for _, v := range values {
+			if item != "" && item == strings.ToLower(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func codecAliases(codec string) []string {
+	if codec == "hevc" || codec == "h265" {
+		return []string{"hevc", "h265"}
+	}
+	return []string{codec}
+}
+
+// profileMatches checks a profile's container and codec filters. The
+// container filter accepts the file extension or one of ffprobe's format names
+func profileMatches(p TranscodeProfile, probe *MediaProbe, ext string) bool {
+	containers := append([]string{strings.TrimPrefix(ext, ".")}, strings.Split(probe.FormatName, ",")...)
+	return matchesList(p.Containers, containers...) &&
+		matchesList(p.VideoCodecs, codecAliases(probe.VideoCodec)...) &&
+		matchesList(p.AudioCodecs, probe.AudioCodec)
+}
+
+// targetCodec returns the stream codec an encoder setting produces, "copy"
+// when the stream is left alone or already in that codec
+func targetCodec(encoder, current string) string {
+	encoder = strings.TrimSpace(encoder)
+	if encoder == "" || encoder == "copy" {
+		return "copy"
+	}
+	codec, ok := encoderCodecs[encoder]
+	if !ok {
+		codec = encoder
+	}
+	if codec == current {
+		return "copy"
+	}
+	return encoder
+}
+
+// planTranscode works out the ffmpeg arguments (without input and output)
+// and output extension for a profile. ok is false when the profile would
+// leave the file as it is
+func planTranscode(p TranscodeProfile, probe *MediaProbe, ext string, fixedExt bool) (args []string, outExt string, ok bool) {
+	scale := p.MaxHeight > 0 && probe.Height > p.MaxHeight
+
+	videoEnc := targetCodec(p.VideoEncoder, probe.VideoCodec)
+	if scale && videoEnc == "copy" {
+		videoEnc = p.VideoEncoder
+		if videoEnc == "" || videoEnc == "copy" {
+			videoEnc = "libx264"
+		}
+	}
+	audioEnc := targetCodec(p.AudioEncoder, probe.AudioCodec)
+
+	outExt = ext
+	if e := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(p.OutputExt)), "."); e != "" && !fixedExt {
+		outExt = "." + e
+	}
+
+	if videoEnc == "copy" && audioEnc == "copy" && outExt == ext {
+		return nil, ext, false
+	}
+
+	args = []string{"-c:v", videoEnc}
+	if videoEnc != "copy" {
+		args = append(args, strings.Fields(p.VideoArgs)...)
+	}
+	if scale {
+		args = append(args, "-vf", fmt.Sprintf("scale=-2:%d", p.MaxHeight))
+	}
+	args = append(args, "-c:a", audioEnc)
+	args = append(args, subtitleArgs(probe.SubtitleCodecs, outExt)...)
+	switch outExt {
+	case ".mp4", ".m4v", ".mov":
+		args = append(args, "-movflags", "+faststart")
+	}
+	return args, outExt, true
+}
+
+// subtitleArgs keeps the subtitle streams the output container can hold:
+// all of them in Matroska, and the text ones converted for MP4 and WebM.
+// Mapping any stream turns off ffmpeg's default stream selection, so the
+// main video and audio streams are mapped as well
+func subtitleArgs(codecs []string, outExt string) []string {
+	var encoder string
+	switch outExt {
+	case ".mkv":
+		encoder = "copy"
+	case ".mp4", ".m4v", ".mov":
+		encoder = "mov_text"
+	case ".webm":
+		encoder = "webvtt"
+	default:
+		return []string{"-sn"}
+	}
+
+	var maps []string
+	for i, codec := range codecs {
+		if encoder == "copy" || textSubtitleCodecs[codec] {
+			maps = append(maps, "-map", fmt.Sprintf("0:s:%d", i))
+		}
+	}
+	if len(maps) == 0 {
+		return []string{"-sn"}
+	}
+	args := append([]string{"-map", "0:V:0", "-map", "0:a:0?"}, maps...)
+	return append(args, "-c:s", encoder)
+}
+
+// selectTranscodeProfile returns the first enabled profile that matches and
+// would change the file, along with its plan
+func selectTranscodeProfile(probe *MediaProbe, ext string, fixedExt bool) (*TranscodeProfile, []string, string) {
+	for i := range config.TranscodeProfiles {
+		p := config.TranscodeProfiles[i]
+		if !p.Enabled || !profileMatches(p, probe, ext) {
+			continue
+		}
+		if args, outExt, ok := planTranscode(p, probe, ext, fixedExt); ok {
+			return &p, args, outExt
+		}
+	}
+	return nil, nil, ext
+}
+
+// keepOriginal moves the untouched upload into the originals directory
+func keepOriginal(tempPath, filename string) (string, error) {
+	dir := filepath.Join(config.UploadDir, "originals")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := filename
+	ext := filepath.Ext(filename)
+	for n := 2; ; n++ {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(filename, ext), n, ext)
+	}
+	if err := os.Rename(tempPath, filepath.Join(dir, name)); err != nil {
+		return "", err
+	}
+	return "originals/" + name, nil
+}
+
+// transcodeVideo applies the matching transcode profile to tempPath and
+// writes the result next to finalPath. Unless fixedExt is set a profile may
+// change the extension, so the returned path can differ from finalPath. With
+// no matching profile the file is simply moved into place. original is the
+// path of the untouched upload when the profile keeps it
+func transcodeVideo(tempPath, finalPath string, fixedExt bool) (outPath, original, warningMsg string, err error) {
+	probe, err := probeMedia(tempPath)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	ext := strings.ToLower(filepath.Ext(finalPath))
+	profile, args, outExt := selectTranscodeProfile(probe, ext, fixedExt)
+	if profile == nil {
+		if err := os.Rename(tempPath, finalPath); err != nil {
+			return "", "", "", fmt.Errorf("failed to move file: %v", err)
+		}
+		return finalPath, "", "", nil
+	}
+
+	outPath = finalPath
+	if outExt != ext {
+		outName := strings.TrimSuffix(filepath.Base(finalPath), filepath.Ext(finalPath)) + outExt
+		if taken, _ := filenameTaken(outName); taken {
+			outName = numberedFilename(outName)
+		}
+		outPath = filepath.Join(filepath.Dir(finalPath), outName)
+	}
+
+	cmdArgs := append([]string{"-y", "-i", tempPath}, args...)
+	cmd := exec.Command("ffmpeg", append(cmdArgs, outPath)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		os.Remove(outPath)
+		return "", "", "", fmt.Errorf("failed to transcode with profile %q: %v", profile.Name, err)
+	}
+
+	warningMsg = fmt.Sprintf("The video (%s/%s) has been transcoded with the %q profile.", probe.VideoCodec, probe.AudioCodec, profile.Name)
+	if profile.KeepOriginal {
+		kept, err := keepOriginal(tempPath, filepath.Base(finalPath))
+		if err != nil {
+			log.Printf("Warning: transcodeVideo: could not keep original of %s: %v", finalPath, err)
+			os.Remove(tempPath)
+		} else {
+			original = kept
+			warningMsg += " The original was kept as " + kept + "."
+		}
+	} else {
+		os.Remove(tempPath)
+	}
+	return outPath, original, warningMsg, nil
+}
+
+// recordOriginal remembers the untouched upload kept when a file was
+// transcoded, replacing any kept for earlier content of the file
+func recordOriginal(fileID int64, original string) {
+	if original == "" {
+		return
+	}
+	removeOriginal(fileID)
+	if _, err := db.Exec(`INSERT INTO file_originals (file_id, path) VALUES (?, ?)`, fileID, original); err != nil {
+		log.Printf("Warning: recordOriginal: failed to record original of file id=%d: %v", fileID, err)
+	}
+}
+
+// removeOriginal deletes the original kept for a file, if there is one
+func removeOriginal(fileID int64) {
+	var original string
+	if err := db.QueryRow(`SELECT path FROM file_originals WHERE file_id = ?`, fileID).Scan(&original); err != nil {
+		return
+	}
+	if err := os.Remove(filepath.Join(config.UploadDir, original)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: removeOriginal: failed to delete %s: %v", original, err)
+	}
+	if _, err := db.Exec(`DELETE FROM file_originals WHERE file_id = ?`, fileID); err != nil {
+		log.Printf("Warning: removeOriginal: failed to forget original of file id=%d: %v", fileID, err)
+	}
+}
+
+func parseTranscodeProfilesFromForm(r *http.Request) ([]TranscodeProfile, error) {
+	var profiles []TranscodeProfile
+	for i := 0; ; i++ {
+		field := func(name string) string {
+			return strings.TrimSpace(r.FormValue(fmt.Sprintf("transcode_profiles[%d][%s]", i, name)))
+		}
+		name := field("name")
+		if name == "" {
+			break
+		}
+		p := TranscodeProfile{
+			Name:         name,
+			Containers:   field("containers"),
+			VideoCodecs:  field("video_codecs"),
+			AudioCodecs:  field("audio_codecs"),
+			VideoEncoder: field("video_encoder"),
+			VideoArgs:    field("video_args"),
+			AudioEncoder: field("audio_encoder"),
+			OutputExt:    strings.TrimPrefix(strings.ToLower(field("output_ext")), "."),
+			KeepOriginal: field("keep_original") == "true",
+			Enabled:      field("enabled") == "true",
+		}
+		if h := field("max_height"); h != "" {
+			n, err := strconv.Atoi(h)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("profile %d: invalid max height %q", i+1, h)
+			}
+			p.MaxHeight = n
+		}
+		if strings.ContainsAny(p.VideoEncoder+p.AudioEncoder, " \t") {
+			return nil, fmt.Errorf("profile %d: encoder names cannot contain spaces", i+1)
+		}
+		if p.OutputExt != "" && !outputExtPattern.MatchString(p.OutputExt) {
+			return nil, fmt.Errorf("profile %d: invalid output extension %q", i+1, p.OutputExt)
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+func handleSaveTranscodeProfiles(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	profiles, err := parseTranscodeProfilesFromForm(r)
+	if err != nil {
+		data := currentAdminState(r, orphanData, missingThumbnails)
+		data.Error = err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	config.TranscodeProfiles = profiles
+
+	if err := SaveConfig(db, config); err != nil {
+		log.Printf("Error: handleSaveTranscodeProfiles: failed to save configuration: %v", err)
+		data := currentAdminState(r, orphanData, missingThumbnails)
+		data.Error = "Failed to save configuration: " + err.Error()
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	data := currentAdminState(r, orphanData, missingThumbnails)
+	data.Success = "Transcode profiles saved successfully!"
+	renderAdminPage(w, r, data)
+}
+
+// handleTestTranscodeProfiles probes a library file and shows which profile
+// would apply to it as a new upload, without transcoding anything
+func handleTestTranscodeProfiles(w http.ResponseWriter, r *http.Request, orphanData OrphanData, missingThumbnails []VideoFile) {
+	data := currentAdminState(r, orphanData, missingThumbnails)
+
+	var result TranscodeTestResult
+	result.FileID, _ = strconv.Atoi(strings.TrimSpace(r.FormValue("test_file_id")))
+	var relPath string
+	if err := db.QueryRow("SELECT filename, path FROM files WHERE id=?", result.FileID).Scan(&result.Filename, &relPath); err != nil {
+		data.Error = "File not found"
+		renderAdminPage(w, r, data)
+		return
+	}
+
+	path := filepath.Join(config.UploadDir, relPath)
+	probe, err := probeMedia(path)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Probe = probe
+		ext := strings.ToLower(filepath.Ext(path))
+		if profile, args, outExt := selectTranscodeProfile(probe, ext, false); profile != nil {
+			result.Profile = profile.Name
+			result.Command = "ffmpeg -i input" + ext + " " + strings.Join(args, " ") + " output" + outExt
+		}
+	}
+
+	data.TranscodeTest = &result
+	renderAdminPage(w, r, data)
+}
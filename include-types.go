@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 type File struct {
 	ID              int
 	Filename        string
@@ -7,6 +9,17 @@ type File struct {
 	Path            string
 	Description     string
 	Tags            map[string][]string
+	Matches         []TextMatch // lines matching a search in the file's contents
+}
+
+// TextMatch is a line of a file's indexed contents that matches a search.
+// URL deep-links to the line, chapter or subtitle cue
+type TextMatch struct {
+	Location string
+	URL      string
+	Before   string
+	Match    string
+	After    string
 }
 
 type Config struct {
@@ -15,10 +28,21 @@ type Config struct {
 	UploadDir    string
 	ServerPort   string
 	// Values from database
-	GallerySize  string
-	ItemsPerPage string
-	TagAliases   []TagAliasGroup
-	SedRules     []SedRule
+	GallerySize       string
+	ItemsPerPage      string
+	ConflictPolicy    string
+	AutoFinishStatus  bool
+	HLSCacheMB        string
+	IndexSubtitles    bool
+	IndexEPUB         bool
+	TextVersions      string
+	NotesVersions     string
+	TagAliases        []TagAliasGroup
+	SedRules          []SedRule
+	FilenameRules     []FilenameRule
+	TagRules          []TagRule
+	MetadataMappings  []MetadataMapping
+	TranscodeProfiles []TranscodeProfile
 }
 
 type Breadcrumb struct {
@@ -79,6 +103,8 @@ type VideoFile struct {
 	HasThumbnail    bool
 	ThumbnailPath   string
 	EscapedFilename string
+	IsAudio         bool
+	IsImage         bool
 }
 
 type filter struct {
@@ -120,15 +146,297 @@ type Note struct {
 	Original string // The full line as stored
 }
 
+// NoteVersion is one entry of the notes history: the notes as saved, and
+// whether that was a save, import or restore
+type NoteVersion struct {
+	ID     int
+	Time   string
+	Source string
+	Lines  int
+}
+
 type SedRule struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
 	Command     string `json:"command"`
 }
 
+type FilenameRule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+}
+
+type FilenameRuleMatch struct {
+	FileID   int
+	Filename string
+	Tags     []TagPair
+}
+
+type TagRule struct {
+	Name      string `json:"name"`
+	Condition string `json:"condition"`
+	Category  string `json:"category"`
+	Value     string `json:"value"`
+	Enabled   bool   `json:"enabled"`
+}
+
+type TagRuleResult struct {
+	Rule    TagRule
+	Matches int
+	Pending int // matching files that do not have the tag yet
+	Samples []File
+	Error   string
+}
+
+// MetadataMapping copies one field of external metadata (e.g. a yt-dlp info
+// JSON) into a tag category, a property or the file description
+type MetadataMapping struct {
+	Source string `json:"source"`
+	Field  string `json:"field"`
+	Target string `json:"target"` // "tag", "property" or "description"
+	Name   string `json:"name"`   // tag category or property key
+}
+
+type MetadataResult struct {
+	Tags        []TagPair
+	Properties  []TagPair // Category holds the property key
+	Description string
+}
+
+// TranscodeProfile describes how uploaded videos matching its container and
+// codec filters are converted. Filters are comma-separated; empty matches any
+type TranscodeProfile struct {
+	Name         string `json:"name"`
+	Containers   string `json:"containers"`
+	VideoCodecs  string `json:"video_codecs"`
+	AudioCodecs  string `json:"audio_codecs"`
+	VideoEncoder string `json:"video_encoder"` // "copy" or an ffmpeg encoder, e.g. "libx264"
+	VideoArgs    string `json:"video_args"`    // extra encoder arguments, e.g. "-crf 23"
+	AudioEncoder string `json:"audio_encoder"` // "copy" or an ffmpeg encoder, e.g. "aac"
+	MaxHeight    int    `json:"max_height"`    // downscale taller videos, 0 for no limit
+	OutputExt    string `json:"output_ext"`    // e.g. "mp4", empty keeps the extension
+	KeepOriginal bool   `json:"keep_original"`
+	Enabled      bool   `json:"enabled"`
+}
+
+type MediaProbe struct {
+	FormatName string
+	Duration   float64
+	BitRate    int // bits per second
+	VideoCodec string
+	Width      int
+	Height     int
+	AudioCodec string
+	SampleRate int
+	HasCover   bool
+	Tags       map[string]string // container and audio stream tags, lowercased keys
+	// SubtitleCodecs lists the codec of each subtitle stream in order
+	SubtitleCodecs []string
+}
+
+type TranscodeTestResult struct {
+	FileID   int
+	Filename string
+	Probe    *MediaProbe
+	Profile  string
+	Command  string
+	Error    string
+}
+
+// FileSource records how a file entered the library: kind is one of upload,
+// url, ytdlp, local or archive; origin is the URL, path or original filename
+type FileSource struct {
+	Kind        string
+	Origin      string
+	Extractor   string
+	AddedAt     string
+	Domain      string
+	Refreshable bool
+}
+
+type ImportPlanItem struct {
+	Source     string
+	RelPath    string
+	Filename   string
+	Tags       []TagPair
+	ExistingID int64
+	Error      string
+}
+
+type DirImportPageData struct {
+	Root    string
+	Options DirImportOptions
+	Items   []ImportPlanItem
+	New     int
+}
+
+type Job struct {
+	ID       int
+	Kind     string
+	Label    string
+	Status   string // queued, running, done or failed
+	Message  string
+	FileID   int64
+	Created  time.Time
+	Finished time.Time
+}
+
+type Playlist struct {
+	ID          int
+	URL         string
+	Title       string
+	LastChecked string
+	Entries     int
+}
+
+type JobsPageData struct {
+	Notice    string
+	Jobs      []Job
+	Active    int
+	Playlists []Playlist
+}
+
+// FilePosition is where a file was last left off. Position is a page index,
+// a timestamp in seconds or a line number depending on Kind
+type FilePosition struct {
+	FileID    int
+	Kind      string
+	Position  float64
+	Total     float64
+	Finished  bool
+	UpdatedAt string
+}
+
+type PositionEntry struct {
+	File      File
+	Position  FilePosition
+	Label     string
+	Percent   int
+	ResumeURL string
+}
+
+type PositionsPageData struct {
+	View    string // continue or finished
+	Entries []PositionEntry
+	Error   string
+}
+
+// Marker is a labelled point in a video or audio file. Source is "user" for
+// markers added in the player and "chapter" for imported embedded chapters
+type Marker struct {
+	ID              int
+	FileID          int
+	Filename        string
+	EscapedFilename string
+	Time            float64
+	Clock           string
+	Label           string
+	Source          string
+	Category        string // optional tag
+	Value           string
+}
+
+// Subtitle is a WebVTT text track for a video. Source is "embedded" for
+// streams extracted from the file and "sidecar" for .srt/.vtt files found
+// next to it on import
+type Subtitle struct {
+	ID       int
+	FileID   int
+	Language string
+	Label    string
+	Source   string
+}
+
+// TextVersion is a previous version of an edited text file. ID is the Unix
+// time in nanoseconds when it was replaced
+type TextVersion struct {
+	ID   string
+	Time string
+	Size int64
+}
+
+type VersionsPageData struct {
+	File        File
+	Versions    []TextVersion
+	DiffVersion string
+	Hunks       [][]DiffLine
+}
+
+// DiffLine is one line of a line diff. Op is "same", "add" or "del"; the
+// line numbers are 0 on the side the line is missing from
+type DiffLine struct {
+	Op      string
+	OldLine int
+	NewLine int
+	Text    string
+}
+
+type MarkersPageData struct {
+	Query   string
+	Tag     string
+	Markers []Marker
+	Total   int
+}
+
 type CBZImage struct {
 	Filename string
 	Index    int
+	Type     string // ComicInfo page type, e.g. FrontCover
+}
+
+type CBZBuilderData struct {
+	SelectionMode string // range or tags
+	FileRange     string
+	TagQuery      string
+	Order         string // listed, id or filename
+	Filename      string
+	MergeTags     bool
+	Error         string
+}
+
+type CBZEditorData struct {
+	File    File
+	Images  []CBZImage
+	Error   string
+	Success string
+}
+
+// ComicInfo is the ComicRack metadata file found in many CBZ archives. Fields
+// holds every simple element by its snake_cased name
+type ComicInfo struct {
+	Fields map[string]string
+	Pages  []ComicPageInfo
+}
+
+type ComicPageInfo struct {
+	Image int    // index into the name-sorted images of the archive
+	Type  string // FrontCover, Story, Deleted, ...
+}
+
+type EPUBChapter struct {
+	Index int
+	Path  string // archive member path
+	Title string
+}
+
+type EPUBBook struct {
+	Title       string
+	Authors     []string
+	Language    string
+	Series      string
+	SeriesIndex string
+	Cover       string // archive member path of the cover image
+	Chapters    []EPUBChapter
+}
+
+type EPUBViewData struct {
+	File         File
+	Book         *EPUBBook
+	CurrentIndex int
+	Chapter      EPUBChapter
+	ChapterURL   string
+	HasPrev      bool
+	HasNext      bool
 }
 
 type AdminPageData struct {
@@ -138,6 +446,16 @@ type AdminPageData struct {
 	OrphanData        OrphanData
 	ActiveTab         string
 	MissingThumbnails []VideoFile
+	MissingSprites    []VideoFile
+	SpritesChecked    bool // MissingSprites is only looked up on the thumbnails tab
+	FilenameMatches   []FilenameRuleMatch
+	TagRuleResults    []TagRuleResult
+	TagRuleTest       *TagRuleResult
+	MetadataTest      *MetadataResult
+	MetadataTestInput string
+	MetadataSources   []string
+	ConflictPolicies  []string
+	TranscodeTest     *TranscodeTestResult
 }
 
 type notesAnalysis struct {
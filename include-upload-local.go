@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -27,7 +28,7 @@ func localFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Confirm the file actually exists and is a regular file (not a dir/symlink)
+	// Confirm the path exists and is a regular file or a directory to walk
 	info, err := os.Stat(absPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -37,8 +38,16 @@ func localFileHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	if info.IsDir() {
+		if rel, err := filepath.Rel(config.UploadDir, absPath); err == nil && !strings.HasPrefix(rel, "..") {
+			renderError(w, "Cannot import from inside the upload directory", http.StatusBadRequest)
+			return
+		}
+		handleDirImport(w, r, absPath)
+		return
+	}
 	if !info.Mode().IsRegular() {
-		renderError(w, "Path must point to a regular file", http.StatusBadRequest)
+		renderError(w, "Path must point to a regular file or directory", http.StatusBadRequest)
 		return
 	}
 
@@ -51,16 +60,54 @@ func localFileHandler(w http.ResponseWriter, r *http.Request) {
 
 	deleteSource := r.FormValue("delete_source") == "on"
 
-	id, warningMsg, err := processUpload(f, filepath.Base(absPath))
+	if r.FormValue("extract_zip") == "on" && strings.ToLower(filepath.Ext(absPath)) == ".zip" {
+		ids, warnings, complete, err := importZipArchive(f, info.Size(), filepath.Base(absPath), zipImportOptionsFromForm(r.FormValue))
+		if err != nil {
+			renderError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Keep the archive if any member was not imported, as it still holds
+		// the only copy
+		if deleteSource && !complete {
+			warnings = append(warnings, "source archive kept because not every file was imported")
+		} else if deleteSource {
+			f.Close()
+			if removeErr := os.Remove(absPath); removeErr != nil {
+				warnings = append(warnings, fmt.Sprintf("could not delete source file: %v", removeErr))
+			}
+		}
+		redirectTarget := "/untagged"
+		if len(ids) == 1 {
+			redirectTarget = fmt.Sprintf("/file/%d", ids[0])
+		}
+		redirectWithWarning(w, r, redirectTarget, strings.Join(warnings, "; "))
+		return
+	}
+
+	id, warningMsg, err := processUpload(f, filepath.Base(absPath), r.FormValue("conflict_policy"))
+	if errors.Is(err, errIngestSkipped) {
+		redirectWithWarning(w, r, fmt.Sprintf("/file/%d", id), warningMsg)
+		return
+	}
 	if err != nil {
 		renderError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	recordFileSource(id, "local", absPath, "")
+	applyTagRules(id)
+
+	var sidecars []string
+	if isVideoFile(absPath) {
+		sidecars = importSidecarSubtitles(id, absPath)
+	}
+
 	if deleteSource {
 		f.Close()
-		if removeErr := os.Remove(absPath); removeErr != nil {
-			warningMsg = strings.TrimPrefix(fmt.Sprintf("%s; could not delete source file: %v", warningMsg, removeErr), "; ")
+		for _, p := range append([]string{absPath}, sidecars...) {
+			if removeErr := os.Remove(p); removeErr != nil {
+				warningMsg = strings.TrimPrefix(fmt.Sprintf("%s; could not delete source file: %v", warningMsg, removeErr), "; ")
+			}
 		}
 	}
 
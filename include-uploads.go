@@ -1,6 +1,7 @@
 package main
 
 import (
+    "errors"
     "fmt"
     "io"
     "log"
@@ -35,6 +36,11 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	var warnings []string
 	var lastID int64
+	var added int
+
+	extractZip := r.FormValue("extract_zip") == "on"
+	zipOpts := zipImportOptionsFromForm(r.FormValue)
+	policy := r.FormValue("conflict_policy")
 
 	// Process each file
 	for _, fileHeader := range files {
@@ -45,13 +51,33 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer file.Close()
 
-		id, warningMsg, err := processUpload(file, fileHeader.Filename)
+		if extractZip && strings.ToLower(filepath.Ext(fileHeader.Filename)) == ".zip" {
+			ids, zipWarnings, _, err := importZipArchive(file, fileHeader.Size, fileHeader.Filename, zipOpts)
+			warnings = append(warnings, zipWarnings...)
+			if err != nil {
+				warnings = append(warnings, err.Error())
+				continue
+			}
+			added += len(ids)
+			continue
+		}
+
+		id, warningMsg, err := processUpload(file, fileHeader.Filename, policy)
+		if errors.Is(err, errIngestSkipped) {
+			lastID = id
+			added++
+			warnings = append(warnings, warningMsg)
+			continue
+		}
 		if err != nil {
 			renderError(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		lastID = id
+		added++
+		recordFileSource(id, "upload", fileHeader.Filename, "")
+		applyTagRules(id)
 
 		if warningMsg != "" {
 			warnings = append(warnings, warningMsg)
@@ -64,24 +90,15 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	redirectTarget := "/untagged"
-	if len(files) == 1 && lastID != 0 {
+	if added == 1 && lastID != 0 {
 		redirectTarget = "/file/" + strconv.FormatInt(lastID, 10)
 	}
 
 	redirectWithWarning(w, r, redirectTarget, warningMsg)
 }
 
-func processUpload(src io.Reader, filename string) (int64, string, error) {
-    finalFilename, finalPath, conflictID, err := checkFileConflictStrict(filename)
-    if err != nil {
-        return 0, "", err
-    }
-    if conflictID != 0 {
-        return conflictID, "", nil
-    }
-
-    tempPath := finalPath + ".tmp"
-    tempFile, err := os.Create(tempPath)
+func processUpload(src io.Reader, filename, policy string) (int64, string, error) {
+    tempFile, err := os.CreateTemp(config.UploadDir, ".upload-*.tmp")
     if err != nil {
         return 0, "", fmt.Errorf("failed to create temp file: %v", err)
     }
@@ -89,32 +106,59 @@ func processUpload(src io.Reader, filename string) (int64, string, error) {
     _, err = io.Copy(tempFile, src)
     tempFile.Close()
     if err != nil {
-        os.Remove(tempPath)
+        os.Remove(tempFile.Name())
         return 0, "", fmt.Errorf("failed to copy file data: %v", err)
     }
 
-    ext := strings.ToLower(filepath.Ext(filename))
-    videoExts := map[string]bool{
-        ".mp4": true, ".mov": true, ".avi": true,
-        ".mkv": true, ".webm": true, ".m4v": true,
+    return ingestFile(tempFile.Name(), filename, policy)
+}
+
+// storeNewFile moves content into place under a free filename, converts it
+// if needed and creates its database entry
+func storeNewFile(tempPath, filename string) (int64, string, error) {
+    finalFilename := filename
+    finalPath := filepath.Join(config.UploadDir, filename)
+
+    workPath := finalPath + ".tmp"
+    if err := os.Rename(tempPath, workPath); err != nil {
+        os.Remove(tempPath)
+        return 0, "", fmt.Errorf("failed to move temp file: %v", err)
     }
 
-    var processedPath string
+    ext := strings.ToLower(filepath.Ext(filename))
+
+    var processedPath, original string
     var warningMsg string
+    var err error
 
-    if videoExts[ext] || ext == ".cbz" {
+    if isVideoFile(filename) || ext == ".cbz" {
         // Process videos and CBZ files
-        processedPath, warningMsg, err = processVideoFile(tempPath, finalPath)
+        processedPath, original, warningMsg, err = processVideoFile(workPath, finalPath, false)
         if err != nil {
-            os.Remove(tempPath)
+            os.Remove(workPath)
             return 0, "", err
         }
+        // A transcode profile may have changed the extension
+        finalFilename = filepath.Base(processedPath)
     } else {
         // Non-video, non-CBZ → just rename temp file to final
-        if err := os.Rename(tempPath, finalPath); err != nil {
+        if err := os.Rename(workPath, finalPath); err != nil {
             return 0, "", fmt.Errorf("failed to move file: %v", err)
         }
         processedPath = finalPath
+        if isAudioFile(finalPath) {
+            if err := generateAudioThumbnail(finalPath, config.UploadDir, finalFilename); err != nil {
+                log.Printf("Warning: could not generate audio thumbnail: %v", err)
+            }
+        } else if ext == ".epub" {
+            if err := generateEPUBThumbnail(finalPath, config.UploadDir, finalFilename); err != nil {
+                log.Printf("Warning: could not generate EPUB thumbnail: %v", err)
+            }
+        } else if isImageFile(finalPath) {
+            if err := generateImageThumbnail(finalPath, config.UploadDir, finalFilename); err != nil {
+                log.Printf("Warning: could not generate image thumbnail: %v", err)
+            }
+        }
     }
 
     id, err := saveFileToDatabase(finalFilename, processedPath)
@@ -122,6 +166,25 @@ func processUpload(src io.Reader, filename string) (int64, string, error) {
         os.Remove(processedPath)
         return 0, "", err
     }
+    recordOriginal(id, original)
+
+    // Tag rules already ran during property computation; re-run them if
+    // filename rules added tags that conditions may depend on
+    if applyFilenameRules(id, finalFilename) > 0 {
+        applyTagRules(id)
+    }
+
+    indexFileContent(id, processedPath)
+
+    if isVideoFile(finalFilename) {
+        queueSpriteJob(id, finalFilename)
+        queueSubtitleJob(id, finalFilename)
+    }
+    if isVideoFile(finalFilename) || isAudioFile(finalFilename) {
+        if _, err := importChapters(id, processedPath); err != nil {
+            log.Printf("Warning: could not import chapters: %v", err)
+        }
+    }
 
     return id, warningMsg, nil
 }
@@ -168,12 +231,19 @@ func uploadFromURLHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	id, warningMsg, err := processUpload(resp.Body, filename)
+	id, warningMsg, err := processUpload(resp.Body, filename, r.FormValue("conflict_policy"))
+	if errors.Is(err, errIngestSkipped) {
+		redirectWithWarning(w, r, fmt.Sprintf("/file/%d", id), warningMsg)
+		return
+	}
 	if err != nil {
 		renderError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	recordFileSource(id, "url", fileURL, "")
+	applyTagRules(id)
+
 	redirectWithWarning(w, r, fmt.Sprintf("/file/%d", id), warningMsg)
 }
 
@@ -189,108 +259,109 @@ func ytdlpHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	outTemplate := filepath.Join(config.UploadDir, "%(title)s.%(ext)s")
-	filenameCmd := exec.Command("yt-dlp", "--playlist-items", "1", "-f", "mp4", "-o", outTemplate, "--get-filename", videoURL)
-	filenameBytes, err := filenameCmd.Output()
-	if err != nil {
-		renderError(w, fmt.Sprintf("Failed to get filename: %v", err), http.StatusInternalServerError)
+	id, warningMsg, err := downloadYtdlpVideo(videoURL, r.FormValue("conflict_policy"))
+	if err != nil && !errors.Is(err, errIngestSkipped) {
+		renderError(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	expectedFullPath := strings.TrimSpace(string(filenameBytes))
-	expectedFilename := filepath.Base(expectedFullPath)
 
-	finalFilename, finalPath, conflictID, err := checkFileConflictStrict(expectedFilename)
-	if err != nil {
-		renderError(w, err.Error(), http.StatusConflict)
-		return
+	redirectWithWarning(w, r, fmt.Sprintf("/file/%d", id), warningMsg)
+}
+
+// downloadYtdlpVideo fetches the first video behind a URL with yt-dlp and adds it
+// to the library, resolving a taken filename with the given conflict policy.
+// Like ingestFile it returns errIngestSkipped when nothing was added
+func downloadYtdlpVideo(videoURL, policy string) (int64, string, error) {
+	policy = resolveConflictPolicy(policy)
+
+	// Under the skip policy, avoid downloading something we already have
+	if policy == "skip" {
+		filenameCmd := exec.Command("yt-dlp", "--playlist-items", "1", "-f", "mp4", "-o", "%(title)s.%(ext)s", "--get-filename", videoURL)
+		filenameBytes, err := filenameCmd.Output()
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to get filename: %v", err)
+		}
+		expectedFilename := sanitizeFilename(filepath.Base(strings.TrimSpace(string(filenameBytes))))
+		if taken, conflictID := filenameTaken(expectedFilename); taken {
+			if conflictID == 0 {
+				return 0, "", fmt.Errorf("a file named %s already exists on disk but not in the database", expectedFilename)
+			}
+			return conflictID, fmt.Sprintf("%s already exists; kept file/%d unchanged", expectedFilename, conflictID), errIngestSkipped
+		}
 	}
-	if conflictID != 0 {
-		redirectWithWarning(w, r, fmt.Sprintf("/file/%d", conflictID), "")
-		return
+
+	dir, err := os.MkdirTemp(config.UploadDir, ".ytdlp-")
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create temp directory: %v", err)
 	}
+	defer os.RemoveAll(dir)
 
-	downloadCmd := exec.Command("yt-dlp", "--playlist-items", "1", "-f", "mp4", "-o", outTemplate, videoURL)
+	outTemplate := filepath.Join(dir, "%(title)s.%(ext)s")
+	downloadCmd := exec.Command("yt-dlp", "--playlist-items", "1", "-f", "mp4", "--write-info-json", "--no-write-playlist-metafiles", "-o", outTemplate, videoURL)
 	downloadCmd.Stdout = os.Stdout
 	downloadCmd.Stderr = os.Stderr
 	if err := downloadCmd.Run(); err != nil {
-		renderError(w, fmt.Sprintf("Failed to download video: %v", err), http.StatusInternalServerError)
-		return
+		return 0, "", fmt.Errorf("failed to download video: %v", err)
 	}
 
-	if expectedFullPath != finalPath {
-		if err := os.Rename(expectedFullPath, finalPath); err != nil {
-			renderError(w, fmt.Sprintf("Failed to move downloaded file: %v", err), http.StatusInternalServerError)
-			return
+	all, _ := filepath.Glob(filepath.Join(dir, "*"))
+	var downloaded []string
+	for _, m := range all {
+		if !strings.HasSuffix(m, ".json") && !strings.HasSuffix(m, ".part") {
+			downloaded = append(downloaded, m)
 		}
 	}
-
-	tempPath := finalPath + ".tmp"
-	if err := os.Rename(finalPath, tempPath); err != nil {
-		renderError(w, fmt.Sprintf("Failed to create temp file for processing: %v", err), http.StatusInternalServerError)
-		return
+	if len(downloaded) != 1 {
+		return 0, "", fmt.Errorf("yt-dlp did not produce a single file")
 	}
+	downloadedPath := downloaded[0]
+	infoPath := strings.TrimSuffix(downloadedPath, filepath.Ext(downloadedPath)) + ".info.json"
 
-	processedPath, warningMsg, err := processVideoFile(tempPath, finalPath)
+	id, warningMsg, err := ingestFile(downloadedPath, sanitizeFilename(filepath.Base(downloadedPath)), policy)
+	if errors.Is(err, errIngestSkipped) {
+		return id, warningMsg, err
+	}
 	if err != nil {
-		os.Remove(tempPath)
-		renderError(w, fmt.Sprintf("Failed to process video: %v", err), http.StatusInternalServerError)
-		return
+		return 0, "", err
 	}
 
-	id, err := saveFileToDatabase(finalFilename, processedPath)
-	if err != nil {
-		os.Remove(processedPath)
-		renderError(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err := applyYtdlpInfoFile(id, infoPath, videoURL); err != nil {
+		log.Printf("Warning: downloadYtdlpVideo: could not read info JSON for file id=%d: %v", id, err)
+		recordFileSource(id, "ytdlp", videoURL, "")
 	}
+	applyTagRules(id)
 
-	redirectWithWarning(w, r, fmt.Sprintf("/file/%d", id), warningMsg)
+	return id, warningMsg, nil
 }
 
-func processVideoFile(tempPath, finalPath string) (string, string, error) {
+// processVideoFile moves a video or CBZ into place, transcoding videos when a
+// profile applies. Unless fixedExt is set the result may get a new extension.
+// The second result is the original kept by the transcode profile, if any
+func processVideoFile(tempPath, finalPath string, fixedExt bool) (string, string, string, error) {
 	ext := strings.ToLower(filepath.Ext(finalPath))
 
 	// Handle CBZ files
 	if ext == ".cbz" {
 		if err := os.Rename(tempPath, finalPath); err != nil {
-			return "", "", fmt.Errorf("failed to move file: %v", err)
+			return "", "", "", fmt.Errorf("failed to move file: %v", err)
 		}
 		if err := generateCBZThumbnail(finalPath, config.UploadDir, filepath.Base(finalPath)); err != nil {
 			log.Printf("Warning: could not generate CBZ thumbnail: %v", err)
 		}
-		return finalPath, "", nil
+		return finalPath, "", "", nil
 	}
 
 	// Handle video files
-	codec, err := detectVideoCodec(tempPath)
+	processedPath, original, warningMsg, err := transcodeVideo(tempPath, finalPath, fixedExt)
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
-	if codec == "hevc" || codec == "h265" {
-		warningMsg := "The video uses HEVC and has been re-encoded to H.264 for browser compatibility."
-		if err := reencodeHEVCToH264(tempPath, finalPath); err != nil {
-			return "", "", fmt.Errorf("failed to re-encode HEVC video: %v", err)
-		}
-		os.Remove(tempPath)
 
-		if err := generateThumbnail(finalPath, config.UploadDir, filepath.Base(finalPath)); err != nil {
-			log.Printf("Warning: could not generate thumbnail after HEVC re-encode: %v", err)
-		}
-
-		return finalPath, warningMsg, nil
-	}
-	if err := os.Rename(tempPath, finalPath); err != nil {
-		return "", "", fmt.Errorf("failed to move file: %v", err)
+	if err := generateThumbnail(processedPath, config.UploadDir, filepath.Base(processedPath)); err != nil {
+		log.Printf("Warning: could not generate thumbnail: %v", err)
 	}
 
-	// Generate thumbnail for video files
-	if ext == ".mp4" || ext == ".mov" || ext == ".avi" || ext == ".mkv" || ext == ".webm" || ext == ".m4v" {
-		if err := generateThumbnail(finalPath, config.UploadDir, filepath.Base(finalPath)); err != nil {
-			log.Printf("Warning: could not generate thumbnail: %v", err)
-		}
-	}
-
-	return finalPath, "", nil
+	return processedPath, original, warningMsg, nil
 }
 
 func saveFileToDatabase(filename, path string) (int64, error) {
@@ -312,21 +383,14 @@ func saveFileToDatabase(filename, path string) (int64, error) {
 }
 
 
-func detectVideoCodec(filePath string) (string, error) {
-	cmd := exec.Command("ffprobe", "-v", "error", "-select_streams", "v:0",
-		"-show_entries", "stream=codec_name", "-of", "default=nokey=1:noprint_wrappers=1", filePath)
-	out, err := cmd.Output()
+// recordFileSource stores where a file came from; the first recorded origin wins.
+// extractor identifies the remote item (e.g. "Youtube:<id>") when known
+func recordFileSource(fileID int64, kind, origin, extractor string) {
+	_, err := db.Exec(
+		`INSERT OR IGNORE INTO file_sources (file_id, kind, origin, extractor) VALUES (?, ?, ?, ?)`,
+		fileID, kind, origin, extractor,
+	)
 	if err != nil {
-		return "", fmt.Errorf("failed to probe video codec: %v", err)
+		log.Printf("Warning: recordFileSource: failed to record source for file id=%d: %v", fileID, err)
 	}
-	return strings.TrimSpace(string(out)), nil
 }
-
-func reencodeHEVCToH264(inputPath, outputPath string) error {
-	cmd := exec.Command("ffmpeg", "-i", inputPath,
-		"-c:v", "libx264", "-profile:v", "baseline", "-preset", "fast", "-crf", "23",
-		"-c:a", "aac", "-movflags", "+faststart", outputPath)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	return cmd.Run()
-}
\ No newline at end of file
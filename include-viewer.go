@@ -8,6 +8,8 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -265,12 +267,54 @@ func fileHandler(w http.ResponseWriter, r *http.Request) {
 		propRows.Close()
 	}
 
+	markers, err := getFileMarkers(f.ID)
+	if err != nil {
+		log.Printf("Warning: fileHandler: failed to query markers for file id=%d: %v", f.ID, err)
+	}
+
+	subtitles, err := getFileSubtitles(f.ID)
+	if err != nil {
+		log.Printf("Warning: fileHandler: failed to query subtitles for file id=%d: %v", f.ID, err)
+	}
+
+	needsStream := false
+	if isVideoFile(f.Filename) {
+		playback, ok := fileProps["playback"]
+		if !ok {
+			// Videos added before the playback property existed are probed once
+			if probe, err := probeMedia(filepath.Join(config.UploadDir, f.Path)); err == nil {
+				playback = playbackProperty(probe, filepath.Ext(f.Filename))
+				setProperty(int64(f.ID), "playback", playback)
+			} else {
+				log.Printf("Warning: fileHandler: failed to probe file id=%d: %v", f.ID, err)
+			}
+		}
+		needsStream = playback == "hls"
+	}
+
+	largeText := false
+	if isTextFile(f.Filename) {
+		if info, err := os.Stat(filepath.Join(config.UploadDir, f.Path)); err == nil {
+			largeText = info.Size() > largeTextSize
+		}
+	}
+
 	pageData := buildPageDataWithIP(f.Filename, struct {
 		File            File
 		Categories      []string
 		EscapedFilename string
 		Properties      map[string]string
-	}{f, cats, url.PathEscape(f.Filename), fileProps})
+		Source          *FileSource
+		Position        *FilePosition
+		Markers         []Marker
+		Subtitles       []Subtitle
+		NeedsHLS        bool
+		LargeText       bool
+		Error           string
+		Success         string
+		Warning         string
+	}{f, cats, url.PathEscape(f.Filename), fileProps, getFileSource(f.ID), getFilePosition(f.ID), markers, subtitles, needsStream, largeText,
+		r.URL.Query().Get("error"), r.URL.Query().Get("success"), r.URL.Query().Get("warning")})
 
 	renderTemplate(w, "file.html", pageData)
 }
@@ -364,6 +408,19 @@ func getOrCreateCategoryAndTag(category, value string) (int, int, error) {
 	return catID, tagID, nil
 }
 
+// addTagToFile attaches category:value to a file, creating the tag if needed
+func addTagToFile(fileID int, category, value string) error {
+	_, tagID, err := getOrCreateCategoryAndTag(category, value)
+	if err != nil {
+		return err
+	}
+	if tagID == 0 {
+		return fmt.Errorf("tag value cannot be empty")
+	}
+	_, err = db.Exec("INSERT OR IGNORE INTO file_tags(file_id, tag_id) VALUES (?, ?)", fileID, tagID)
+	return err
+}
+
 func listFilesHandler(w http.ResponseWriter, r *http.Request) {
 	page := pageFromRequest(r)
 	perPage := perPageFromConfig(50)
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ZipImportOptions controls how the members of an extracted archive are tagged
+type ZipImportOptions struct {
+	ArchiveCategory string // tag each member with the archive name, if set
+	FolderCategory  string // tag each member with its folder names, if set
+	ConflictPolicy  string
+}
+
+func zipImportOptionsFromForm(formValue func(string) string) ZipImportOptions {
+	return ZipImportOptions{
+		ArchiveCategory: strings.TrimSpace(formValue("zip_archive_category")),
+		FolderCategory:  strings.TrimSpace(formValue("zip_folder_category")),
+		ConflictPolicy:  formValue("conflict_policy"),
+	}
+}
+
+// zipMemberPath normalises a member name, rejecting anything that would
+// escape the archive root once extracted (absolute paths, drive letters, "..")
+func zipMemberPath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, ":") {
+		return "", false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", false
+	}
+	return cleaned, true
+}
+
+// importFilename picks the library filename for a file at a slash-separated
+// relative path and returns its folder components. Files sharing a base name
+// in different folders keep their folder path as a prefix so they don't
+// collapse into one file; baseCounts holds lower-cased base name counts
+func importFilename(relPath string, baseCounts map[string]int) (string, []string) {
+	dir := path.Dir(relPath)
+	var folders []string
+	if dir != "." {
+		folders = strings.Split(dir, "/")
+	}
+
+	filename := path.Base(relPath)
+	if baseCounts[strings.ToLower(filename)] > 1 && len(folders) > 0 {
+		filename = strings.Join(folders, "_") + "_" + filename
+	}
+	return sanitizeFilename(filename), folders
+}
+
+// isZipJunk skips metadata entries that archivers add alongside real content
+func isZipJunk(memberPath string) bool {
+	base := path.Base(memberPath)
+	return strings.HasPrefix(memberPath, "__MACOSX/") || base == ".DS_Store" || base == "Thumbs.db" || base == "desktop.ini"
+}
+
+// importZipArchive extracts each regular file in the archive through
+// processUpload. Returns the IDs of the files added, any per-member warnings
+// and whether every member was imported, so callers know the archive is safe
+// to delete
+func importZipArchive(ra io.ReaderAt, size int64, archiveName string, opts ZipImportOptions) ([]int64, []string, bool, error) {
+	zr, err := zip.NewReader(ra, size)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("failed to read zip archive: %v", err)
+	}
+
+	archiveBase := strings.TrimSuffix(filepath.Base(archiveName), filepath.Ext(archiveName))
+
+	type member struct {
+		file *zip.File
+		path string
+	}
+
+	var members []member
+	var warnings []string
+	complete := true
+	baseCounts := make(map[string]int)
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() || !f.Mode().IsRegular() {
+			continue
+		}
+		memberPath, ok := zipMemberPath(f.Name)
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("skipped unsafe path %q", f.Name))
+			complete = false
+			continue
+		}
+		if isZipJunk(memberPath) {
+			continue
+		}
+		members = append(members, member{file: f, path: memberPath})
+		baseCounts[strings.ToLower(path.Base(memberPath))]++
+	}
+
+	if len(members) == 0 {
+		return nil, warnings, false, fmt.Errorf("archive %s contains no files", archiveName)
+	}
+
+	var ids []int64
+	for _, m := range members {
+		filename, folders := importFilename(m.path, baseCounts)
+
+		rc, err := m.file.Open()
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: failed to open: %v", m.path, err))
+			complete = false
+			continue
+		}
+		id, warningMsg, err := processUpload(rc, filename, opts.ConflictPolicy)
+		rc.Close()
+		if errors.Is(err, errIngestSkipped) {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", m.path, warningMsg))
+			complete = false
+			continue
+		}
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", m.path, err))
+			complete = false
+			continue
+		}
+		if warningMsg != "" {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", m.path, warningMsg))
+		}
+
+		recordFileSource(id, "archive", archiveName+"/"+m.path, "")
+
+		if opts.ArchiveCategory != "" && archiveBase != "" {
+			if err := addTagToFile(int(id), opts.ArchiveCategory, archiveBase); err != nil {
+				warnings = append(warnings, fmt.Sprintf("%s: failed to add archive tag: %v", m.path, err))
+			}
+		}
+		if opts.FolderCategory != "" {
+			for _, folder := range folders {
+				if err := addTagToFile(int(id), opts.FolderCategory, folder); err != nil {
+					warnings = append(warnings, fmt.Sprintf("%s: failed to add folder tag: %v", m.path, err))
+				}
+			}
+		}
+		applyTagRules(id)
+
+		ids = append(ids, id)
+	}
+
+	return ids, warnings, complete, nil
+}
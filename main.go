@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"html/template"
 	"log"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -59,6 +60,12 @@ func main() {
 		log.Fatalf("Failed to load templates: %v", err)
 	}
 
+	// Start the background worker for queued imports
+	startJobWorker()
+
+	// Go's built-in MIME table lacks WebVTT, which <track> elements require
+	mime.AddExtensionType(".vtt", "text/vtt; charset=utf-8")
+
 	// Register all routes
 	RegisterRoutes()
 
@@ -27,7 +27,7 @@ function showThumbnailSubTab(subTabName) {
 }
 
 document.addEventListener('DOMContentLoaded', function() {
-    showAdminTab('settings');
+    showAdminTab(window.activeAdminTab || 'settings');
     showThumbnailSubTab('missing');
 
     document.querySelectorAll('.auto-hide-success').forEach(div => {
@@ -0,0 +1,94 @@
+// filename-rules.js - Manage filename tagging rules in admin interface
+// Relies on appendHidden() from sed-rules.js and escapeHtml() from common.js
+
+let filenameRules = [];
+
+document.addEventListener('DOMContentLoaded', function() {
+    filenameRules = window.initialFilenameRules || [];
+    renderFilenameRules();
+    setupFilenameRulesForm();
+});
+
+function renderFilenameRules() {
+    const container = document.getElementById('filename-rules');
+    if (!container) return;
+
+    container.innerHTML = '';
+
+    filenameRules.forEach((rule, index) => {
+        const ruleDiv = document.createElement('div');
+        ruleDiv.style.cssText = 'border: 1px solid #ddd; padding: 15px; margin-bottom: 15px; border-radius: 5px;';
+
+        ruleDiv.innerHTML = `
+            <div style="display: flex; justify-content: space-between; align-items: start; margin-bottom: 10px;">
+                <h4 style="margin: 0;">Rule ${index + 1}</h4>
+                <button onclick="removeFilenameRule(${index})" style="background-color: #dc3545; color: white; padding: 5px 10px; border: none; border-radius: 3px; font-size: 12px; cursor: pointer;">
+                    Remove
+                </button>
+            </div>
+
+            <div style="margin-bottom: 10px;">
+                <label style="display: block; font-weight: bold; margin-bottom: 5px; font-size: 13px;">Name:</label>
+                <input type="text" value="${escapeHtml(rule.name)}"
+                       onchange="updateFilenameRule(${index}, 'name', this.value)"
+                       placeholder="e.g., Artist prefix"
+                       style="width: 100%; padding: 6px; font-size: 13px; border: 1px solid #ccc; border-radius: 3px;">
+            </div>
+
+            <div style="margin-bottom: 0;">
+                <label style="display: block; font-weight: bold; margin-bottom: 5px; font-size: 13px;">Pattern:</label>
+                <input type="text" value="${escapeHtml(rule.pattern)}"
+                       onchange="updateFilenameRule(${index}, 'pattern', this.value)"
+                       placeholder="e.g., ^\\[(?P<artist>[^\\]]+)\\]"
+                       style="width: 100%; padding: 6px; font-size: 13px; font-family: monospace; border: 1px solid #ccc; border-radius: 3px;">
+                <small>Go regular expression; each named group becomes a tag category</small>
+            </div>
+        `;
+
+        container.appendChild(ruleDiv);
+    });
+}
+
+function addFilenameRule() {
+    filenameRules.push({
+        name: '',
+        pattern: ''
+    });
+    renderFilenameRules();
+}
+
+function removeFilenameRule(index) {
+    if (confirm('Remove this filename rule?')) {
+        filenameRules.splice(index, 1);
+        renderFilenameRules();
+    }
+}
+
+function updateFilenameRule(index, field, value) {
+    if (filenameRules[index]) {
+        filenameRules[index][field] = value;
+    }
+}
+
+function setupFilenameRulesForm() {
+    const form = document.getElementById('filenamerules-form');
+    if (!form) return;
+
+    form.addEventListener('submit', function(e) {
+        for (let i = 0; i < filenameRules.length; i++) {
+            const rule = filenameRules[i];
+            if (!rule.name || !rule.pattern) {
+                e.preventDefault();
+                alert(`Rule ${i + 1} is incomplete. Please fill in Name and Pattern.`);
+                return;
+            }
+        }
+
+        this.querySelectorAll('input[data-generated]').forEach(el => el.remove());
+
+        filenameRules.forEach((rule, i) => {
+            appendHidden(this, `filename_rules[${i}][name]`,    rule.name);
+            appendHidden(this, `filename_rules[${i}][pattern]`, rule.pattern);
+        });
+    });
+}
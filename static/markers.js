@@ -0,0 +1,57 @@
+// markers.js - Chapter and marker list, seek-bar ticks and #t= links
+// Loaded after positions.js so a #t= link wins over the saved position
+
+function initMarkers() {
+  const player = document.getElementById('videoPlayer') || document.getElementById('audioPlayer');
+  if (!player) return;
+
+  const seek = (seconds) => {
+    player.currentTime = seconds;
+    player.play();
+  };
+
+  const links = Array.from(document.querySelectorAll('.marker-link'));
+  links.forEach(link => {
+    link.addEventListener('click', e => {
+      e.preventDefault();
+      history.replaceState(null, '', link.getAttribute('href'));
+      seek(Number(link.dataset.time));
+    });
+  });
+
+  const form = document.getElementById('marker-form');
+  if (form) {
+    form.addEventListener('submit', () => {
+      const time = document.getElementById('marker-time');
+      if (!time.value.trim()) time.value = player.currentTime.toFixed(1);
+    });
+  }
+
+  const onMetadata = () => {
+    if (links.length > 0 && player.duration > 0) {
+      const bar = document.createElement('div');
+      bar.className = 'marker-ticks';
+      bar.style.width = `${player.clientWidth}px`;
+      links.forEach(link => {
+        const time = Number(link.dataset.time);
+        const tick = document.createElement('span');
+        tick.className = 'marker-tick';
+        tick.style.left = `${Math.min(time / player.duration, 1) * 100}%`;
+        tick.title = `${link.textContent} ${link.dataset.label}`;
+        tick.addEventListener('click', () => seek(time));
+        bar.appendChild(tick);
+      });
+      player.insertAdjacentElement('afterend', bar);
+    }
+
+    const match = location.hash.match(/^#t=([\d.]+)$/);
+    if (match) player.currentTime = parseFloat(match[1]);
+  };
+  if (player.readyState >= 1) {
+    onMetadata();
+  } else {
+    player.addEventListener('loadedmetadata', onMetadata, { once: true });
+  }
+}
+
+document.addEventListener('DOMContentLoaded', initMarkers);
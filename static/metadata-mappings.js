@@ -0,0 +1,101 @@
+// metadata-mappings.js - Manage metadata field mappings in admin interface
+// Relies on appendHidden() from sed-rules.js and escapeHtml() from common.js
+
+let metadataMappings = [];
+
+const metadataTargets = ['tag', 'property', 'description'];
+
+document.addEventListener('DOMContentLoaded', function() {
+    metadataMappings = window.initialMetadataMappings || [];
+    renderMetadataMappings();
+    setupMetadataMappingsForm();
+});
+
+function metadataOptions(values, selected) {
+    return values.map(v =>
+        `<option value="${escapeHtml(v)}" ${v === selected ? 'selected' : ''}>${escapeHtml(v)}</option>`
+    ).join('');
+}
+
+function renderMetadataMappings() {
+    const container = document.getElementById('metadata-mappings');
+    if (!container) return;
+
+    container.innerHTML = '';
+    const sources = window.metadataSources || ['ytdlp'];
+
+    metadataMappings.forEach((mapping, index) => {
+        const row = document.createElement('div');
+        row.style.cssText = 'display: flex; gap: 8px; align-items: center; margin-bottom: 8px;';
+
+        row.innerHTML = `
+            <select onchange="updateMetadataMapping(${index}, 'source', this.value)" style="padding: 6px; font-size: 13px;">
+                ${metadataOptions(sources, mapping.source)}
+            </select>
+            <input type="text" value="${escapeHtml(mapping.field)}"
+                   onchange="updateMetadataMapping(${index}, 'field', this.value)"
+                   placeholder="field, e.g. uploader"
+                   style="flex: 1; padding: 6px; font-size: 13px; font-family: monospace; border: 1px solid #ccc; border-radius: 3px;">
+            <span>&rarr;</span>
+            <select onchange="updateMetadataMapping(${index}, 'target', this.value); renderMetadataMappings();" style="padding: 6px; font-size: 13px;">
+                ${metadataOptions(metadataTargets, mapping.target)}
+            </select>
+            <input type="text" value="${escapeHtml(mapping.name)}"
+                   onchange="updateMetadataMapping(${index}, 'name', this.value)"
+                   placeholder="${mapping.target === 'property' ? 'property key' : 'tag category'}"
+                   ${mapping.target === 'description' ? 'disabled' : ''}
+                   style="flex: 1; padding: 6px; font-size: 13px; border: 1px solid #ccc; border-radius: 3px;">
+            <button onclick="removeMetadataMapping(${index})" style="background-color: #dc3545; color: white; padding: 5px 10px; border: none; border-radius: 3px; font-size: 12px; cursor: pointer;">
+                Remove
+            </button>
+        `;
+
+        container.appendChild(row);
+    });
+}
+
+function addMetadataMapping() {
+    metadataMappings.push({
+        source: (window.metadataSources || ['ytdlp'])[0],
+        field: '',
+        target: 'tag',
+        name: ''
+    });
+    renderMetadataMappings();
+}
+
+function removeMetadataMapping(index) {
+    metadataMappings.splice(index, 1);
+    renderMetadataMappings();
+}
+
+function updateMetadataMapping(index, field, value) {
+    if (metadataMappings[index]) {
+        metadataMappings[index][field] = value;
+    }
+}
+
+function setupMetadataMappingsForm() {
+    const form = document.getElementById('metadata-form');
+    if (!form) return;
+
+    form.addEventListener('submit', function(e) {
+        for (let i = 0; i < metadataMappings.length; i++) {
+            const m = metadataMappings[i];
+            if (!m.field || (m.target !== 'description' && !m.name)) {
+                e.preventDefault();
+                alert(`Mapping ${i + 1} is incomplete. Please fill in the field and the category or property name.`);
+                return;
+            }
+        }
+
+        this.querySelectorAll('input[data-generated]').forEach(el => el.remove());
+
+        metadataMappings.forEach((m, i) => {
+            appendHidden(this, `metadata_mappings[${i}][source]`, m.source);
+            appendHidden(this, `metadata_mappings[${i}][field]`,  m.field);
+            appendHidden(this, `metadata_mappings[${i}][target]`, m.target);
+            appendHidden(this, `metadata_mappings[${i}][name]`,   m.target === 'description' ? '' : m.name);
+        });
+    });
+}
@@ -6,6 +6,8 @@ const searchInput = document.getElementById('search-input');
 
 let originalContent = editor.value;
 let currentContent = editor.value;
+// Sed rules applied since loading, recorded with the save in the history
+let appliedSedRules = [];
 
 // Initialize preview with clickable links
 document.addEventListener('DOMContentLoaded', () => {
@@ -120,13 +122,14 @@ async function saveNotes() {
         const response = await fetch('/notes/save', {
             method: 'POST',
             headers: {'Content-Type': 'application/x-www-form-urlencoded'},
-            body: `content=${encodeURIComponent(content)}`
+            body: `content=${encodeURIComponent(content)}&sed=${encodeURIComponent(appliedSedRules.join(', '))}`
         });
 
         const result = await response.json();
 
         if (result.success) {
             showMessage('Notes saved successfully!', 'success');
+            appliedSedRules = [];
             originalContent = content;
             // Reload to show sorted/deduped version
             setTimeout(() => location.reload(), 1000);
@@ -192,6 +195,7 @@ async function applySedRule(ruleIndex) {
         if (result.success) {
             editor.value = result.content;
             currentContent = result.content;
+            appliedSedRules.push(result.rule);
             updatePreview(result.content);
             updateStats(result.stats);
             showMessage('Sed rule applied successfully!', 'success');
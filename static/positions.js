@@ -0,0 +1,76 @@
+// positions.js - Remember where media and text files were left and resume there
+// Media players report their time every few seconds; text-viewer.js calls
+// trackTextPosition() once the text has loaded
+
+// Short clips are not worth resuming
+const minTrackedDuration = 60;
+
+function savePosition(fileID, kind, position, total, beacon) {
+  const body = new URLSearchParams({ kind: kind, position: String(position), total: String(total) });
+  if (beacon && navigator.sendBeacon) {
+    navigator.sendBeacon(`/position/${fileID}`, body);
+    return;
+  }
+  fetch(`/position/${fileID}`, { method: 'POST', body: body }).catch(() => {});
+}
+
+function trackMediaPosition() {
+  const container = document.getElementById('videoContainer') || document.getElementById('audioContainer');
+  const player = document.getElementById('videoPlayer') || document.getElementById('audioPlayer');
+  if (!container || !player) return;
+
+  const fileID = container.dataset.fileId;
+  const resume = parseFloat(container.dataset.resume);
+  let lastSaved = 0;
+
+  // Live MP4 streams report an infinite duration and cannot be resumed
+  const tracked = () => isFinite(player.duration) && player.duration >= minTrackedDuration;
+
+  const save = (beacon) => {
+    if (!tracked()) return;
+    savePosition(fileID, 'time', player.currentTime.toFixed(1), player.duration.toFixed(1), beacon);
+    lastSaved = Date.now();
+  };
+
+  const restore = () => {
+    if (!tracked()) return;
+    // A looping player never fires ended, so the end would not be recorded
+    player.loop = false;
+    if (resume > 0 && resume < player.duration - 5) {
+      player.currentTime = resume;
+    }
+  };
+  if (player.readyState >= 1) {
+    restore();
+  } else {
+    player.addEventListener('loadedmetadata', restore, { once: true });
+  }
+
+  player.addEventListener('timeupdate', () => {
+    if (Date.now() - lastSaved > 10000) save(false);
+  });
+  player.addEventListener('pause', () => save(false));
+  player.addEventListener('ended', () => save(false));
+  window.addEventListener('pagehide', () => save(true));
+}
+
+function trackTextPosition() {
+  const container = document.getElementById('text-viewer-container');
+  const viewer = document.getElementById('text-viewer');
+  if (!container || !viewer) return;
+
+  const fileID = container.dataset.fileId;
+  const resume = parseInt(container.dataset.resume, 10);
+
+  if (resume > 1) {
+    scrollToLine(resume);
+  }
+
+  let timer = null;
+  viewer.addEventListener('scroll', () => {
+    clearTimeout(timer);
+    timer = setTimeout(() => savePosition(fileID, 'line', currentTextLine(), textLineCount()), 1000);
+  });
+}
+
+document.addEventListener('DOMContentLoaded', trackMediaPosition);
@@ -0,0 +1,136 @@
+// sprites.js - Hover-scrub previews from a video's sprite sheet
+// Gallery videos with data-sprite preview the frame under the cursor; the
+// player gets a storyboard bar that previews and seeks
+
+const spriteTracks = {};
+
+// loadSpriteTrack fetches and parses a WebVTT thumbnail track once. Videos
+// without a sprite sheet resolve to null
+function loadSpriteTrack(url) {
+  if (!spriteTracks[url]) {
+    spriteTracks[url] = fetch(url)
+      .then(res => res.ok ? res.text() : null)
+      .then(text => text ? parseSpriteTrack(text, url) : null)
+      .catch(() => null);
+  }
+  return spriteTracks[url];
+}
+
+function parseVTTTime(s) {
+  const parts = s.trim().split(':').map(parseFloat);
+  return parts.reduce((total, part) => total * 60 + part, 0);
+}
+
+function parseSpriteTrack(text, baseURL) {
+  const cues = [];
+  let sheetWidth = 0, sheetHeight = 0;
+  for (const block of text.split(/\r?\n\r?\n/)) {
+    const lines = block.trim().split(/\r?\n/);
+    const timing = lines.findIndex(line => line.includes('-->'));
+    if (timing < 0 || timing + 1 >= lines.length) continue;
+
+    const [start, end] = lines[timing].split('-->').map(parseVTTTime);
+    const [src, hash] = lines[timing + 1].split('#xywh=');
+    if (!hash) continue;
+    const [x, y, w, h] = hash.split(',').map(Number);
+    cues.push({ start, end, src: new URL(src, new URL(baseURL, location.href)).href, x, y, w, h });
+    sheetWidth = Math.max(sheetWidth, x + w);
+    sheetHeight = Math.max(sheetHeight, y + h);
+  }
+  if (cues.length === 0) return null;
+  return { cues, sheetWidth, sheetHeight, duration: cues[cues.length - 1].end };
+}
+
+// showSpriteTile paints one cue into el, scaled to the given width
+function showSpriteTile(el, track, cue, width) {
+  const scale = width / cue.w;
+  el.style.backgroundImage = `url("${cue.src}")`;
+  el.style.backgroundPosition = `${-cue.x * scale}px ${-cue.y * scale}px`;
+  el.style.backgroundSize = `${track.sheetWidth * scale}px ${track.sheetHeight * scale}px`;
+  el.style.width = `${width}px`;
+  el.style.height = `${cue.h * scale}px`;
+}
+
+function cueAtFraction(track, fraction) {
+  const index = Math.floor(Math.min(Math.max(fraction, 0), 0.9999) * track.cues.length);
+  return track.cues[index];
+}
+
+function initGallerySprites() {
+  document.querySelectorAll('.gallery-video[data-sprite]').forEach(item => {
+    let overlay = null;
+
+    item.addEventListener('mousemove', e => {
+      loadSpriteTrack(item.dataset.sprite).then(track => {
+        if (!track || !item.matches(':hover')) return;
+        if (!overlay) {
+          overlay = document.createElement('div');
+          overlay.className = 'sprite-preview';
+          item.appendChild(overlay);
+        }
+        const rect = item.getBoundingClientRect();
+        showSpriteTile(overlay, track, cueAtFraction(track, (e.clientX - rect.left) / rect.width), rect.width);
+        overlay.style.display = 'block';
+      });
+    });
+
+    item.addEventListener('mouseleave', () => {
+      if (overlay) overlay.style.display = 'none';
+    });
+  });
+}
+
+function formatSpriteTime(seconds) {
+  const s = Math.floor(seconds);
+  const pad = n => String(n).padStart(2, '0');
+  if (s >= 3600) return `${Math.floor(s / 3600)}:${pad(Math.floor(s / 60) % 60)}:${pad(s % 60)}`;
+  return `${Math.floor(s / 60)}:${pad(s % 60)}`;
+}
+
+function initPlayerStoryboard() {
+  const container = document.getElementById('videoContainer');
+  const player = document.getElementById('videoPlayer');
+  if (!container || !player || !container.dataset.sprite) return;
+
+  loadSpriteTrack(container.dataset.sprite).then(track => {
+    if (!track) return;
+
+    const bar = document.createElement('div');
+    bar.className = 'storyboard-bar';
+    bar.style.width = `${player.clientWidth}px`;
+    const progress = document.createElement('div');
+    progress.className = 'storyboard-progress';
+    const preview = document.createElement('div');
+    preview.className = 'storyboard-preview';
+    const label = document.createElement('span');
+    preview.appendChild(label);
+    bar.append(progress, preview);
+    player.insertAdjacentElement('afterend', bar);
+
+    const duration = () => player.duration || track.duration;
+
+    bar.addEventListener('mousemove', e => {
+      const rect = bar.getBoundingClientRect();
+      const fraction = Math.min(Math.max((e.clientX - rect.left) / rect.width, 0), 1);
+      const cue = cueAtFraction(track, fraction);
+      showSpriteTile(preview, track, cue, cue.w);
+      const left = Math.min(Math.max(e.clientX - rect.left - cue.w / 2, 0), rect.width - cue.w);
+      preview.style.left = `${left}px`;
+      preview.style.display = 'block';
+      label.textContent = formatSpriteTime(fraction * duration());
+    });
+    bar.addEventListener('mouseleave', () => { preview.style.display = 'none'; });
+    bar.addEventListener('click', e => {
+      const rect = bar.getBoundingClientRect();
+      player.currentTime = (e.clientX - rect.left) / rect.width * duration();
+    });
+    player.addEventListener('timeupdate', () => {
+      progress.style.width = `${player.currentTime / duration() * 100}%`;
+    });
+  });
+}
+
+document.addEventListener('DOMContentLoaded', () => {
+  initGallerySprites();
+  initPlayerStoryboard();
+});
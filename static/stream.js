@@ -0,0 +1,77 @@
+// stream.js - Play videos the browser can't decode through the HLS endpoint
+// The server flags files with unsupported containers or codecs; others switch
+// over when the original fails to load. Browsers without native HLS use
+// hls.js when it is saved as static/hls.min.js, and otherwise play the same
+// stream as fragmented MP4, which can only be seeked within what has loaded
+
+function loadHlsJs() {
+  if (window.Hls) return Promise.resolve(window.Hls);
+  return new Promise((resolve, reject) => {
+    const script = document.createElement('script');
+    script.src = '/static/hls.min.js';
+    script.onload = () => window.Hls ? resolve(window.Hls) : reject();
+    script.onerror = reject;
+    document.head.appendChild(script);
+  });
+}
+
+function initStream() {
+  const container = document.getElementById('videoContainer');
+  const player = document.getElementById('videoPlayer');
+  const status = document.getElementById('hls-status');
+  if (!container || !player || !container.dataset.hls) return;
+
+  let streaming = false;
+  const setStatus = (text) => { if (status) status.textContent = text ? ` - ${text}` : ''; };
+
+  const useSource = (src) => {
+    player.querySelectorAll('source').forEach(s => s.remove());
+    player.src = src;
+    player.load();
+  };
+
+  const startHLS = () => {
+    if (streaming) return;
+    streaming = true;
+    const url = container.dataset.hls;
+    const resumeAt = player.currentTime;
+    setStatus('preparing stream, this can take a moment');
+    player.addEventListener('loadedmetadata', () => {
+      setStatus('streaming');
+      if (resumeAt > 0) player.currentTime = resumeAt;
+    }, { once: true });
+
+    if (player.canPlayType('application/vnd.apple.mpegurl')) {
+      useSource(url);
+      return;
+    }
+    loadHlsJs().then(Hls => {
+      if (!Hls.isSupported()) throw new Error();
+      player.querySelectorAll('source').forEach(s => s.remove());
+      const hls = new Hls();
+      hls.loadSource(url);
+      hls.attachMedia(player);
+    }).catch(() => {
+      setStatus('streaming as MP4, seeking is limited to what has loaded');
+      useSource(container.dataset.mp4);
+    });
+  };
+
+  if (container.dataset.hlsNeeded === 'true') {
+    startHLS();
+  } else {
+    const source = player.querySelector('source');
+    if (source) source.addEventListener('error', startHLS, { once: true });
+    player.addEventListener('error', startHLS, { once: true });
+  }
+
+  const toggle = document.getElementById('hls-toggle');
+  if (toggle) {
+    toggle.addEventListener('click', e => {
+      e.preventDefault();
+      startHLS();
+    });
+  }
+}
+
+document.addEventListener('DOMContentLoaded', initStream);
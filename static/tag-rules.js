@@ -0,0 +1,120 @@
+// tag-rules.js - Manage condition-based tagging rules in admin interface
+// Relies on appendHidden() from sed-rules.js and escapeHtml() from common.js
+
+let tagRules = [];
+
+document.addEventListener('DOMContentLoaded', function() {
+    tagRules = window.initialTagRules || [];
+    renderTagRules();
+    setupTagRulesForm();
+});
+
+function renderTagRules() {
+    const container = document.getElementById('tag-rules');
+    if (!container) return;
+
+    container.innerHTML = '';
+
+    tagRules.forEach((rule, index) => {
+        const ruleDiv = document.createElement('div');
+        ruleDiv.style.cssText = 'border: 1px solid #ddd; padding: 15px; margin-bottom: 15px; border-radius: 5px;';
+
+        ruleDiv.innerHTML = `
+            <div style="display: flex; justify-content: space-between; align-items: start; margin-bottom: 10px;">
+                <h4 style="margin: 0;">Rule ${index + 1}</h4>
+                <label style="font-size: 13px;">
+                    <input type="checkbox" ${rule.enabled ? 'checked' : ''}
+                           onchange="updateTagRule(${index}, 'enabled', this.checked)"> Enabled
+                </label>
+                <button onclick="removeTagRule(${index})" style="background-color: #dc3545; color: white; padding: 5px 10px; border: none; border-radius: 3px; font-size: 12px; cursor: pointer;">
+                    Remove
+                </button>
+            </div>
+
+            <div style="margin-bottom: 10px;">
+                <label style="display: block; font-weight: bold; margin-bottom: 5px; font-size: 13px;">Name:</label>
+                <input type="text" value="${escapeHtml(rule.name)}"
+                       onchange="updateTagRule(${index}, 'name', this.value)"
+                       placeholder="e.g., Long MP4s"
+                       style="width: 100%; padding: 6px; font-size: 13px; border: 1px solid #ccc; border-radius: 3px;">
+            </div>
+
+            <div style="margin-bottom: 10px;">
+                <label style="display: block; font-weight: bold; margin-bottom: 5px; font-size: 13px;">Condition:</label>
+                <input type="text" value="${escapeHtml(rule.condition)}"
+                       onchange="updateTagRule(${index}, 'condition', this.value)"
+                       placeholder="e.g., filetype=mp4 AND duration=long"
+                       style="width: 100%; padding: 6px; font-size: 13px; font-family: monospace; border: 1px solid #ccc; border-radius: 3px;">
+            </div>
+
+            <div style="margin-bottom: 0; display: flex; gap: 10px;">
+                <div style="flex: 1;">
+                    <label style="display: block; font-weight: bold; margin-bottom: 5px; font-size: 13px;">Tag Category:</label>
+                    <input type="text" value="${escapeHtml(rule.category)}"
+                           onchange="updateTagRule(${index}, 'category', this.value)"
+                           placeholder="e.g., format"
+                           style="width: 100%; padding: 6px; font-size: 13px; border: 1px solid #ccc; border-radius: 3px;">
+                </div>
+                <div style="flex: 1;">
+                    <label style="display: block; font-weight: bold; margin-bottom: 5px; font-size: 13px;">Tag Value:</label>
+                    <input type="text" value="${escapeHtml(rule.value)}"
+                           onchange="updateTagRule(${index}, 'value', this.value)"
+                           placeholder="e.g., feature"
+                           style="width: 100%; padding: 6px; font-size: 13px; border: 1px solid #ccc; border-radius: 3px;">
+                </div>
+            </div>
+        `;
+
+        container.appendChild(ruleDiv);
+    });
+}
+
+function addTagRule() {
+    tagRules.push({
+        name: '',
+        condition: '',
+        category: '',
+        value: '',
+        enabled: false
+    });
+    renderTagRules();
+}
+
+function removeTagRule(index) {
+    if (confirm('Remove this tag rule?')) {
+        tagRules.splice(index, 1);
+        renderTagRules();
+    }
+}
+
+function updateTagRule(index, field, value) {
+    if (tagRules[index]) {
+        tagRules[index][field] = value;
+    }
+}
+
+function setupTagRulesForm() {
+    const form = document.getElementById('tagrules-form');
+    if (!form) return;
+
+    form.addEventListener('submit', function(e) {
+        for (let i = 0; i < tagRules.length; i++) {
+            const rule = tagRules[i];
+            if (!rule.name || !rule.condition || !rule.category || !rule.value) {
+                e.preventDefault();
+                alert(`Rule ${i + 1} is incomplete. Please fill in Name, Condition, Tag Category and Tag Value.`);
+                return;
+            }
+        }
+
+        this.querySelectorAll('input[data-generated]').forEach(el => el.remove());
+
+        tagRules.forEach((rule, i) => {
+            appendHidden(this, `tag_rules[${i}][name]`,      rule.name);
+            appendHidden(this, `tag_rules[${i}][condition]`, rule.condition);
+            appendHidden(this, `tag_rules[${i}][category]`,  rule.category);
+            appendHidden(this, `tag_rules[${i}][value]`,     rule.value);
+            appendHidden(this, `tag_rules[${i}][enabled]`,   rule.enabled ? 'true' : 'false');
+        });
+    });
+}
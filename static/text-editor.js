@@ -0,0 +1,82 @@
+// The editor loads the text with its hash and sends the hash back on save,
+// so the server can refuse to overwrite changes made since it was opened
+let editHash = '';
+
+function setEditStatus(text, isError) {
+  const status = document.getElementById("edit-status");
+  status.textContent = text;
+  status.style.color = isError ? "#dc3545" : "";
+}
+
+function setEditing(editing) {
+  document.getElementById("text-viewer").style.display = editing ? "none" : "";
+  document.getElementById("text-editor").style.display = editing ? "" : "none";
+  document.getElementById("edit-start").style.display = editing ? "none" : "";
+  document.getElementById("edit-save").style.display = editing ? "" : "none";
+  document.getElementById("edit-cancel").style.display = editing ? "" : "none";
+}
+
+async function startEditing() {
+  const fileId = document.getElementById("text-viewer-container").dataset.fileId;
+  try {
+    const response = await fetch(`/file/${fileId}/edit`, { cache: "no-cache" });
+    const result = await response.json();
+    if (!result.success) {
+      setEditStatus(result.error, true);
+      return;
+    }
+    editHash = result.hash;
+    const editor = document.getElementById("text-editor");
+    editor.value = result.content;
+    setEditing(true);
+    setEditStatus("", false);
+    editor.focus();
+  } catch (error) {
+    setEditStatus("Error: " + error.message, true);
+  }
+}
+
+function cancelEdit() {
+  setEditing(false);
+  setEditStatus("", false);
+}
+
+async function saveEdit() {
+  const fileId = document.getElementById("text-viewer-container").dataset.fileId;
+  const content = document.getElementById("text-editor").value;
+  try {
+    const response = await fetch(`/file/${fileId}/edit`, {
+      method: "POST",
+      headers: {"Content-Type": "application/x-www-form-urlencoded"},
+      body: `content=${encodeURIComponent(content)}&hash=${encodeURIComponent(editHash)}`
+    });
+    const result = await response.json();
+
+    if (result.conflict) {
+      if (!confirm("The file was changed since you started editing. Overwrite it? The other version is kept under Versions.")) {
+        setEditStatus("Not saved: the file was changed elsewhere", true);
+        return;
+      }
+      editHash = result.hash;
+      return saveEdit();
+    }
+    if (!result.success) {
+      setEditStatus("Failed to save: " + result.error, true);
+      return;
+    }
+
+    editHash = result.hash;
+    setEditing(false);
+    setEditStatus("Saved", false);
+    await loadTextFile();
+  } catch (error) {
+    setEditStatus("Error: " + error.message, true);
+  }
+}
+
+document.getElementById("text-editor").addEventListener("keydown", e => {
+  if ((e.ctrlKey || e.metaKey) && e.key === "s") {
+    e.preventDefault();
+    saveEdit();
+  }
+});
@@ -1,16 +1,150 @@
 let originalText = '';
+let renderedHTML = '';
 
+// Large files are paged through /lines instead of downloaded whole. The
+// viewer holds a window of loaded lines and extends it while scrolling
+const lazyPageLines = 500;
+const lazyMaxLines = 4000;
+let lazyTotal = 0;
+let lazyFirst = 0;
+let lazyLast = 0;
+let lazyLoading = false;
+
+// loadTextFile fetches the raw text, then the server-rendered Markdown or
+// highlighted source for files that have one. Rendering failures (such as
+// files too large to render) leave the raw view in place
 async function loadTextFile() {
+  const container = document.getElementById("text-viewer-container");
   const viewer = document.getElementById("text-viewer");
   const filename = viewer.dataset.filename;
-  const response = await fetch(`/uploads/${filename}`);
+  if (container.dataset.lazy) {
+    viewer.classList.add("lazy");
+    await showLinesAround(1);
+    viewer.addEventListener("scroll", extendLazyText);
+    return;
+  }
+  const response = await fetch(`/uploads/${filename}`, { cache: "no-cache" });
   const text = await response.text();
   originalText = text;
   viewer.textContent = text;
+
+  if (!container.dataset.render) return;
+  const rendered = await fetch(`/file/${container.dataset.fileId}/render`, { cache: "no-cache" }).catch(() => null);
+  if (!rendered || !rendered.ok) return;
+  renderedHTML = await rendered.text();
+  document.getElementById("render-toggle").style.display = "";
+  showRendered();
+}
+
+async function fetchLines(from, to) {
+  const fileId = document.getElementById("text-viewer-container").dataset.fileId;
+  const response = await fetch(`/file/${fileId}/lines?from=${from}&to=${to}`, { cache: "no-cache" });
+  const result = await response.json();
+  if (!result.success) throw new Error(result.error);
+  lazyTotal = result.total;
+  return result;
+}
+
+function lineElements(result) {
+  const fragment = document.createDocumentFragment();
+  result.lines.forEach((text, i) => {
+    const el = document.createElement("div");
+    el.className = "text-line";
+    el.dataset.line = result.from + i;
+    el.textContent = text;
+    fragment.appendChild(el);
+  });
+  return fragment;
+}
+
+// showLinesAround replaces the loaded window with a page around a line
+async function showLinesAround(lineNum) {
+  const viewer = document.getElementById("text-viewer");
+  const from = Math.max(1, lineNum - 100);
+  const result = await fetchLines(from, from + lazyPageLines - 1);
+  viewer.replaceChildren(lineElements(result));
+  lazyFirst = result.from;
+  lazyLast = result.to;
+}
+
+// extendLazyText loads the next or previous page when the viewer nears the
+// end of the loaded window, dropping lines from the other end so the page
+// stays small
+async function extendLazyText() {
+  const viewer = document.getElementById("text-viewer");
+  if (lazyLoading) return;
+  const nearBottom = viewer.scrollTop + 2 * viewer.clientHeight > viewer.scrollHeight;
+  const nearTop = viewer.scrollTop < viewer.clientHeight;
+  lazyLoading = true;
+  try {
+    if (nearBottom && lazyLast < lazyTotal) {
+      const result = await fetchLines(lazyLast + 1, lazyLast + lazyPageLines);
+      viewer.appendChild(lineElements(result));
+      lazyLast = result.to;
+      const excess = lazyLast - lazyFirst + 1 - lazyMaxLines;
+      if (excess > 0) {
+        const shift = viewer.children[excess].offsetTop - viewer.firstElementChild.offsetTop;
+        for (let i = 0; i < excess; i++) viewer.firstElementChild.remove();
+        viewer.scrollTop -= shift;
+        lazyFirst += excess;
+      }
+    } else if (nearTop && lazyFirst > 1) {
+      const result = await fetchLines(Math.max(1, lazyFirst - lazyPageLines), lazyFirst - 1);
+      const height = viewer.scrollHeight;
+      viewer.prepend(lineElements(result));
+      viewer.scrollTop += viewer.scrollHeight - height;
+      lazyFirst = result.from;
+      for (; lazyLast - lazyFirst + 1 > lazyMaxLines; lazyLast--) viewer.lastElementChild.remove();
+    }
+  } finally {
+    lazyLoading = false;
+  }
+}
+
+// textLineCount returns the number of lines in the file being viewed
+function textLineCount() {
+  if (document.getElementById("text-viewer").classList.contains("lazy")) return lazyTotal;
+  return originalText.split("\n").length;
+}
+
+function showRendered() {
+  const container = document.getElementById("text-viewer-container");
+  const viewer = document.getElementById("text-viewer");
+  viewer.innerHTML = renderedHTML;
+  viewer.classList.remove("raw", "with-lines");
+  viewer.classList.add("rendered", container.dataset.render);
+  document.getElementById("render-toggle").textContent = "Raw";
+}
+
+function showRaw() {
+  const container = document.getElementById("text-viewer-container");
+  const viewer = document.getElementById("text-viewer");
+  viewer.textContent = originalText;
+  viewer.classList.remove("rendered", "with-lines", container.dataset.render);
+  viewer.classList.add("raw");
+  const toggle = document.getElementById("render-toggle");
+  if (toggle) toggle.textContent = "Rendered";
+}
+
+function toggleRendered() {
+  const viewer = document.getElementById("text-viewer");
+  if (viewer.classList.contains("rendered")) {
+    showRaw();
+  } else {
+    showRendered();
+  }
 }
 
 function toggleLineNumbers() {
   const viewer = document.getElementById("text-viewer");
+  // Highlighted source and paged files number their lines with CSS; rendered
+  // Markdown has no lines to number, so switch to the raw text
+  if (viewer.classList.contains("code") || viewer.classList.contains("lazy")) {
+    viewer.classList.toggle("with-lines");
+    return;
+  }
+  if (viewer.classList.contains("rendered")) showRaw();
+
   if (viewer.classList.contains("with-lines")) {
     viewer.classList.remove("with-lines");
     viewer.textContent = originalText; // Use stored original text
@@ -59,8 +193,56 @@ function makeLineNumbersClickable(containerId, viewerId) {
   });
 }
 
-function scrollToLine(lineNum) {
+// renderedElementForLine finds the rendered element holding a source line:
+// the last one starting at or before it
+function renderedElementForLine(viewer, lineNum) {
+  let found = null;
+  for (const el of viewer.querySelectorAll("[data-line]")) {
+    const line = Number(el.dataset.line);
+    if (line > lineNum) continue;
+    if (!found || line >= Number(found.dataset.line)) found = el;
+  }
+  return found;
+}
+
+// currentTextLine returns the source line at the top of the viewer
+function currentTextLine() {
   const viewer = document.getElementById("text-viewer");
+  const lazy = viewer.classList.contains("lazy");
+  const totalLines = textLineCount();
+  if (viewer.scrollTop + viewer.clientHeight >= viewer.scrollHeight - 2 && (!lazy || lazyLast === lazyTotal)) return totalLines;
+  if (viewer.classList.contains("rendered") || lazy) {
+    const top = viewer.getBoundingClientRect().top;
+    for (const el of viewer.querySelectorAll("[data-line]")) {
+      if (el.getBoundingClientRect().bottom > top) return Number(el.dataset.line);
+    }
+  }
+  return Math.floor(viewer.scrollTop / viewer.scrollHeight * totalLines) + 1;
+}
+
+async function scrollToLine(lineNum) {
+  const viewer = document.getElementById("text-viewer");
+
+  if (viewer.classList.contains("lazy")) {
+    if (lineNum < lazyFirst || lineNum > lazyLast) await showLinesAround(lineNum);
+    const el = viewer.querySelector(`[data-line="${lineNum}"]`);
+    if (el) {
+      viewer.scrollTop += el.getBoundingClientRect().top - viewer.getBoundingClientRect().top;
+      el.style.background = "#ff06";
+      setTimeout(() => el.style.background = "", 2000);
+    }
+    return;
+  }
+
+  if (viewer.classList.contains("rendered")) {
+    const el = renderedElementForLine(viewer, lineNum);
+    if (el) {
+      viewer.scrollTop += el.getBoundingClientRect().top - viewer.getBoundingClientRect().top;
+      el.style.background = "#ff06";
+      setTimeout(() => el.style.background = "", 2000);
+    }
+    return;
+  }
 
   // If line numbers are visible, find the specific line span
   if (viewer.classList.contains("with-lines")) {
@@ -80,10 +262,63 @@ function scrollToLine(lineNum) {
   }
 }
 
+// grepText searches a paged file on the server and lists the matching lines
+let grepQuery = '';
+
+async function grepText(event) {
+  event.preventDefault();
+  grepQuery = event.target.q.value.trim();
+  document.getElementById("grep-results").replaceChildren();
+  if (grepQuery) await loadGrepMatches(1);
+}
+
+async function loadGrepMatches(from) {
+  const fileId = document.getElementById("text-viewer-container").dataset.fileId;
+  const results = document.getElementById("grep-results");
+  results.querySelector(".grep-more")?.remove();
+  const response = await fetch(`/file/${fileId}/grep?q=${encodeURIComponent(grepQuery)}&from=${from}`);
+  const result = await response.json();
+  if (!result.success) {
+    results.textContent = result.error;
+    return;
+  }
+  if (result.matches.length === 0 && from === 1) {
+    results.textContent = "No matches";
+    return;
+  }
+  for (const m of result.matches) {
+    const link = document.createElement("a");
+    link.href = `#l${m.line}`;
+    link.className = "grep-match";
+    link.innerHTML = `<span class="grep-line">${m.line}</span>${escapeHtml(m.before)}<mark>${escapeHtml(m.match)}</mark>${escapeHtml(m.after)}`;
+    link.addEventListener("click", e => {
+      e.preventDefault();
+      history.replaceState(null, "", `#l${m.line}`);
+      scrollToLine(m.line);
+    });
+    results.appendChild(link);
+  }
+  if (result.next) {
+    const more = document.createElement("button");
+    more.className = "text-button grep-more";
+    more.textContent = "More matches";
+    more.onclick = () => loadGrepMatches(result.next);
+    results.appendChild(more);
+  }
+}
+
+// jumpToHashLine follows #l45 links, such as those on search results
+function jumpToHashLine() {
+  const match = location.hash.match(/^#[lL](\d+)$/);
+  if (match) scrollToLine(Number(match[1]));
+}
+
+window.addEventListener("hashchange", jumpToHashLine);
+
 // Run it after the page loads
 document.addEventListener("DOMContentLoaded", () => {
   // Replace "description-container" with the ID of your description element
   makeLineNumbersClickable("current-description", "text-viewer");
 });
 
-    loadTextFile();
+    loadTextFile().then(trackTextPosition).then(jumpToHashLine);
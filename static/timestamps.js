@@ -10,6 +10,7 @@ function parseTimestamp(ts) {
 function makeTimestampsClickable(containerId, videoId, imageId) {
   const container = document.getElementById(containerId);
   const video = document.getElementById(videoId);
+  const player = video || document.getElementById('audioPlayer');
   const image = document.getElementById(imageId);
   const videoContainer = document.getElementById('videoContainer');
   const imageContainer = document.getElementById('imageContainer');
@@ -33,9 +34,9 @@ function makeTimestampsClickable(containerId, videoId, imageId) {
     if (e.target.classList.contains("timestamp")) {
       e.preventDefault();
       const time = Number(e.target.dataset.time);
-      if (video) {
-        video.currentTime = time;
-        video.play();
+      if (player) {
+        player.currentTime = time;
+        player.play();
       }
     } else if (e.target.classList.contains("rotate")) {
       e.preventDefault();
@@ -0,0 +1,125 @@
+// transcode-profiles.js - Manage video transcode profiles in admin interface
+// Relies on appendHidden() from sed-rules.js and escapeHtml() from common.js
+
+let transcodeProfiles = [];
+
+const transcodeFields = ['name', 'containers', 'video_codecs', 'audio_codecs', 'video_encoder',
+    'video_args', 'audio_encoder', 'max_height', 'output_ext'];
+
+document.addEventListener('DOMContentLoaded', function() {
+    transcodeProfiles = window.initialTranscodeProfiles || [];
+    renderTranscodeProfiles();
+    setupTranscodeProfilesForm();
+});
+
+function transcodeInput(index, field, value, label, hint, flex) {
+    return `
+        <div style="flex: ${flex || 1};">
+            <label style="display: block; font-weight: bold; margin-bottom: 5px; font-size: 13px;">${label}:</label>
+            <input type="text" value="${escapeHtml(String(value || ''))}"
+                   onchange="updateTranscodeProfile(${index}, '${field}', this.value)"
+                   placeholder="${escapeHtml(hint)}"
+                   style="width: 100%; padding: 6px; font-size: 13px; font-family: monospace; border: 1px solid #ccc; border-radius: 3px;">
+        </div>`;
+}
+
+function renderTranscodeProfiles() {
+    const container = document.getElementById('transcode-profiles');
+    if (!container) return;
+
+    container.innerHTML = '';
+
+    transcodeProfiles.forEach((profile, index) => {
+        const profileDiv = document.createElement('div');
+        profileDiv.style.cssText = 'border: 1px solid #ddd; padding: 15px; margin-bottom: 15px; border-radius: 5px;';
+
+        profileDiv.innerHTML = `
+            <div style="display: flex; justify-content: space-between; align-items: start; margin-bottom: 10px;">
+                <h4 style="margin: 0;">Profile ${index + 1}</h4>
+                <label style="font-size: 13px;">
+                    <input type="checkbox" ${profile.enabled ? 'checked' : ''}
+                           onchange="updateTranscodeProfile(${index}, 'enabled', this.checked)"> Enabled
+                </label>
+                <label style="font-size: 13px;">
+                    <input type="checkbox" ${profile.keep_original ? 'checked' : ''}
+                           onchange="updateTranscodeProfile(${index}, 'keep_original', this.checked)"> Keep original
+                </label>
+                <button onclick="removeTranscodeProfile(${index})" style="background-color: #dc3545; color: white; padding: 5px 10px; border: none; border-radius: 3px; font-size: 12px; cursor: pointer;">
+                    Remove
+                </button>
+            </div>
+
+            <div style="margin-bottom: 10px; display: flex; gap: 10px;">
+                ${transcodeInput(index, 'name', profile.name, 'Name', 'e.g., Remux MKV to MP4', 2)}
+                ${transcodeInput(index, 'containers', profile.containers, 'Containers', 'any, or e.g. mkv,avi')}
+                ${transcodeInput(index, 'video_codecs', profile.video_codecs, 'Video Codecs', 'any, or e.g. av1,vp9')}
+                ${transcodeInput(index, 'audio_codecs', profile.audio_codecs, 'Audio Codecs', 'any, or e.g. opus')}
+            </div>
+
+            <div style="margin-bottom: 0; display: flex; gap: 10px;">
+                ${transcodeInput(index, 'video_encoder', profile.video_encoder, 'Video Encoder', 'copy or libx264')}
+                ${transcodeInput(index, 'video_args', profile.video_args, 'Encoder Arguments', 'e.g., -preset fast -crf 23', 2)}
+                ${transcodeInput(index, 'audio_encoder', profile.audio_encoder, 'Audio Encoder', 'copy or aac')}
+                ${transcodeInput(index, 'max_height', profile.max_height || '', 'Max Height', 'e.g., 1080')}
+                ${transcodeInput(index, 'output_ext', profile.output_ext, 'Output Extension', 'keep, or e.g. mp4')}
+            </div>
+        `;
+
+        container.appendChild(profileDiv);
+    });
+}
+
+function addTranscodeProfile() {
+    transcodeProfiles.push({
+        name: '',
+        containers: '',
+        video_codecs: '',
+        audio_codecs: '',
+        video_encoder: 'copy',
+        video_args: '',
+        audio_encoder: 'copy',
+        max_height: 0,
+        output_ext: '',
+        keep_original: false,
+        enabled: false
+    });
+    renderTranscodeProfiles();
+}
+
+function removeTranscodeProfile(index) {
+    if (confirm('Remove this transcode profile?')) {
+        transcodeProfiles.splice(index, 1);
+        renderTranscodeProfiles();
+    }
+}
+
+function updateTranscodeProfile(index, field, value) {
+    if (transcodeProfiles[index]) {
+        transcodeProfiles[index][field] = value;
+    }
+}
+
+function setupTranscodeProfilesForm() {
+    const form = document.getElementById('transcode-form');
+    if (!form) return;
+
+    form.addEventListener('submit', function(e) {
+        for (let i = 0; i < transcodeProfiles.length; i++) {
+            if (!transcodeProfiles[i].name) {
+                e.preventDefault();
+                alert(`Profile ${i + 1} needs a name.`);
+                return;
+            }
+        }
+
+        this.querySelectorAll('input[data-generated]').forEach(el => el.remove());
+
+        transcodeProfiles.forEach((profile, i) => {
+            transcodeFields.forEach(field => {
+                appendHidden(this, `transcode_profiles[${i}][${field}]`, String(profile[field] || ''));
+            });
+            appendHidden(this, `transcode_profiles[${i}][keep_original]`, profile.keep_original ? 'true' : 'false');
+            appendHidden(this, `transcode_profiles[${i}][enabled]`,       profile.enabled ? 'true' : 'false');
+        });
+    });
+}